@@ -0,0 +1,252 @@
+//
+// Package cluster runs ticketd as a raft cluster. Every ticketd mutation is committed through the raft log before it
+// is applied, so sessions, tickets and locks survive the loss of a minority of nodes.
+//
+// Node ids are the nodes' api base urls (e.g. http://10.0.0.1:8001). The http package uses the leader id to forward
+// requests to the leader.
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/turbosquid/ticketd/ticket"
+)
+
+const (
+	defaultApplyTimeout = 5 * time.Second
+	snapshotsRetained   = 2
+	maxTransportPool    = 3
+)
+
+//
+// Node configuration
+type Config struct {
+	Id                string        // Node id -- the node's api base url
+	RaftAddr          string        // host:port for raft traffic. Must be reachable by other nodes
+	DataDir           string        // Directory for the raft log and snapshots. We will attempt to create it
+	Bootstrap         bool          // Bootstrap a new cluster with this node as its only member. Ignored if we already have state
+	ApplyTimeout      time.Duration // How long to wait for a command to commit. Defaults to 5s
+	SnapshotInterval  time.Duration // How often to check if we should snapshot and compact the log. Defaults to raft's default
+	SnapshotThreshold uint64        // Snapshot once this many entries have been committed since the last snapshot. Defaults to raft's default
+	Logger            ticket.Logger // Defaults to the ticketd logger level 3
+	raftConfig        *raft.Config  // Overrides raft configuration. Used by the local cluster harness
+}
+
+//
+// A cluster node. Node implements ticket.Committer and ticket.Membership
+type Node struct {
+	id           string
+	td           *ticket.TicketD
+	raft         *raft.Raft
+	applyTimeout time.Duration
+	closers      []io.Closer
+}
+
+//
+// Start a node with a bolt log store, file snapshots and a tcp transport, and attach it to td. td must be started
+func NewNode(cfg *Config, td *ticket.TicketD) (n *Node, err error) {
+	if err = os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return
+	}
+	logger := raftLogger(cfg)
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open raft log: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(cfg.DataDir, snapshotsRetained, logger)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("unable to open snapshot store: %w", err)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", cfg.RaftAddr)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	trans, err := raft.NewTCPTransportWithLogger(cfg.RaftAddr, addr, maxTransportPool, 10*time.Second, logger)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("unable to start raft transport: %w", err)
+	}
+	n, err = newNode(cfg, td, store, store, snaps, trans)
+	if err != nil {
+		trans.Close()
+		store.Close()
+		return
+	}
+	n.closers = append(n.closers, trans, store)
+	return
+}
+
+// Start a node on the given stores and transport
+func newNode(cfg *Config, td *ticket.TicketD, logs raft.LogStore, stable raft.StableStore, snaps raft.SnapshotStore,
+	trans raft.Transport) (n *Node, err error) {
+	n = &Node{id: cfg.Id, td: td, applyTimeout: cfg.ApplyTimeout}
+	if n.applyTimeout == 0 {
+		n.applyTimeout = defaultApplyTimeout
+	}
+	rc := raft.DefaultConfig()
+	if cfg.raftConfig != nil {
+		rc = cfg.raftConfig
+	}
+	rc.LocalID = raft.ServerID(cfg.Id)
+	rc.Logger = raftLogger(cfg)
+	if cfg.SnapshotInterval != 0 {
+		rc.SnapshotInterval = cfg.SnapshotInterval
+	}
+	if cfg.SnapshotThreshold != 0 {
+		rc.SnapshotThreshold = cfg.SnapshotThreshold
+	}
+	if cfg.Bootstrap {
+		hasState, err := raft.HasExistingState(logs, stable, snaps)
+		if err != nil {
+			return nil, err
+		}
+		if !hasState {
+			servers := raft.Configuration{Servers: []raft.Server{{ID: rc.LocalID, Address: trans.LocalAddr()}}}
+			if err = raft.BootstrapCluster(rc, logs, stable, snaps, trans, servers); err != nil {
+				return nil, fmt.Errorf("unable to bootstrap cluster: %w", err)
+			}
+		}
+	}
+	replayTo, err := logs.LastIndex()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read raft log: %w", err)
+	}
+	n.raft, err = raft.NewRaft(rc, &fsm{td: td, replayTo: replayTo}, logs, stable, snaps, trans)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start raft: %w", err)
+	}
+	td.SetCommitter(n)
+	return
+}
+
+//
+// Stop the node. The TicketD is detached and should be stopped as well
+func (n *Node) Shutdown() (err error) {
+	err = n.raft.Shutdown().Error()
+	for _, c := range n.closers {
+		c.Close()
+	}
+	return
+}
+
+//
+// Commit a command through the raft log. Implements ticket.Committer
+func (n *Node) Commit(cmd *ticket.Command) (res *ticket.Result) {
+	if !n.IsLeader() {
+		return &ticket.Result{Err: fmt.Errorf("leader is %s (%w)", n.Leader(), ticket.ErrNotLeader)}
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return &ticket.Result{Err: err}
+	}
+	f := n.raft.Apply(data, n.applyTimeout)
+	if err = f.Error(); err != nil {
+		return &ticket.Result{Err: leaderError(err)}
+	}
+	res, ok := f.Response().(*ticket.Result)
+	if !ok {
+		return &ticket.Result{Err: fmt.Errorf("unexpected response from raft: %#v", f.Response())}
+	}
+	return
+}
+
+//
+// Is this node the leader? Implements ticket.Committer
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+//
+// Get the leader id, or empty if there is no leader. Implements ticket.Committer
+func (n *Node) Leader() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+//
+// Wait until the cluster has a leader
+func (n *Node) WaitForLeader(timeout time.Duration) (leader string, err error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if leader = n.Leader(); leader != "" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = fmt.Errorf("no leader after %s", timeout)
+	return
+}
+
+//
+// Add a voting member. Must be called on the leader. Implements ticket.Membership
+func (n *Node) AddMember(id, addr string) (err error) {
+	err = n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, n.applyTimeout).Error()
+	return leaderError(err)
+}
+
+//
+// Remove a member. Must be called on the leader. Implements ticket.Membership
+func (n *Node) RemoveMember(id string) (err error) {
+	err = n.raft.RemoveServer(raft.ServerID(id), 0, n.applyTimeout).Error()
+	return leaderError(err)
+}
+
+//
+// List members. Implements ticket.Membership
+func (n *Node) Members() (members []ticket.Member, err error) {
+	f := n.raft.GetConfiguration()
+	if err = f.Error(); err != nil {
+		return
+	}
+	leader := n.Leader()
+	for _, s := range f.Configuration().Servers {
+		members = append(members, ticket.Member{Id: string(s.ID), Addr: string(s.Address), Voter: s.Suffrage == raft.Voter,
+			Leader: string(s.ID) == leader})
+	}
+	return
+}
+
+//
+// Take a snapshot now, and compact the log
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+// Wrap raft leadership errors in ticket.ErrNotLeader
+func leaderError(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return fmt.Errorf("%s (%w)", err.Error(), ticket.ErrNotLeader)
+	}
+	return err
+}
+
+// Send raft logs to our logger
+func raftLogger(cfg *Config) hclog.Logger {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = &ticket.DefaultLogger{Level: 3}
+	}
+	return hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Info, Output: &logWriter{logger}})
+}
+
+type logWriter struct {
+	logger ticket.Logger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.Log(2, "%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,202 @@
+package cluster
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+)
+
+var logLevel = flag.Int("loglevel", 0, "Log level to use")
+
+func TestClusterCommit(t *testing.T) {
+	r := require.New(t)
+	lc, err := StartLocalCluster(3, &Config{Logger: &ticket.DefaultLogger{Level: *logLevel}})
+	r.NoError(err)
+	defer lc.Shutdown()
+	leader, err := lc.Leader(5 * time.Second)
+	r.NoError(err)
+	td := lc.TicketDs[leader]
+	issuerId, err := td.OpenSession("issuer", "ANY", 5000)
+	r.NoError(err)
+	r.NoError(td.IssueTicket(issuerId, "test", "foo", []byte("foo data")))
+	claimantId, err := td.OpenSession("claimant", "ANY", 5000)
+	r.NoError(err)
+	ok, tick, err := td.ClaimTicket(claimantId, "test")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("foo", tick.Name)
+	ok, err = td.Lock(claimantId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	// Every node applies committed commands
+	waitForSeq(t, lc, td.Seq())
+	for i, ntd := range lc.TicketDs {
+		ok, err = ntd.HasTicket(claimantId, "test", "foo")
+		r.NoError(err)
+		r.True(ok)
+		r.Len(ntd.GetResources(), 2)
+		if i != leader {
+			// Followers refuse mutations
+			_, err = ntd.OpenSession("nope", "ANY", 5000)
+			r.True(errors.Is(err, ticket.ErrNotLeader))
+			r.Equal(nodeId(leader), ntd.Leader())
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	r := require.New(t)
+	lc, err := StartLocalCluster(3, &Config{Logger: &ticket.DefaultLogger{Level: *logLevel}})
+	r.NoError(err)
+	defer lc.Shutdown()
+	leader, err := lc.Leader(5 * time.Second)
+	r.NoError(err)
+	td := lc.TicketDs[leader]
+	lockerId, err := td.OpenSession("locker", "ANY", 2000)
+	r.NoError(err)
+	ok, err := td.Lock(lockerId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	otherId, err := td.OpenSession("other", "ANY", 30000)
+	r.NoError(err)
+	// Lose the leader. The lock survives on the new leader
+	lc.StopNode(leader)
+	newLeader, err := lc.Leader(5 * time.Second)
+	r.NoError(err)
+	r.NotEqual(leader, newLeader)
+	td = lc.TicketDs[newLeader]
+	ok, err = td.Lock(otherId, "lock")
+	r.NoError(err)
+	r.False(ok)
+	ok, err = td.Lock(lockerId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	// The new leader expires the locker session on schedule
+	time.Sleep(2500 * time.Millisecond)
+	ok, err = td.Lock(otherId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	// Lose another node. With no quorum, nothing can be committed
+	for i := range lc.Nodes {
+		if i != leader && i != newLeader {
+			lc.StopNode(i)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	err = td.RefreshSession(otherId)
+	r.Error(err)
+}
+
+func TestClusterMembership(t *testing.T) {
+	r := require.New(t)
+	lc, err := StartLocalCluster(3, &Config{Logger: &ticket.DefaultLogger{Level: *logLevel}, SnapshotThreshold: 10})
+	r.NoError(err)
+	defer lc.Shutdown()
+	leader, err := lc.Leader(5 * time.Second)
+	r.NoError(err)
+	td := lc.TicketDs[leader]
+	issuerId, err := td.OpenSession("issuer", "ANY", 30000)
+	r.NoError(err)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+		r.NoError(td.IssueTicket(issuerId, "test", name, []byte(name)))
+	}
+	// Compact the log so the new node has to be sent a snapshot
+	r.NoError(lc.Nodes[leader].Snapshot())
+	i, err := lc.AddNode()
+	r.NoError(err)
+	members, err := td.Members()
+	r.NoError(err)
+	r.Len(members, 4)
+	waitForSeq(t, lc, td.Seq())
+	res := lc.TicketDs[i].GetResources()
+	r.Len(res["test"].Tickets, 12)
+	r.Equal(issuerId, res["test"].Tickets["a"].Issuer.Id)
+	// And remove it again
+	r.NoError(td.RemoveMember(nodeId(i)))
+	members, err = td.Members()
+	r.NoError(err)
+	r.Len(members, 3)
+}
+
+func TestClusterRestartAudit(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit.log")
+	start := func() (n *Node, td *ticket.TicketD, l *ticket.AuditLog) {
+		l, err := ticket.OpenAuditLog(auditPath, 1024*1024, 1)
+		r.NoError(err)
+		td = ticket.NewTicketD(100, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+		td.SetAuditLog(l)
+		td.Start()
+		n, err = NewNode(&Config{Id: "node-0", RaftAddr: "127.0.0.1:17301", DataDir: filepath.Join(dir, "raft"),
+			Bootstrap: true, Logger: &ticket.DefaultLogger{Level: *logLevel}}, td)
+		r.NoError(err)
+		deadline := time.Now().Add(10 * time.Second)
+		for !n.IsLeader() {
+			r.True(time.Now().Before(deadline), "no leader")
+			time.Sleep(10 * time.Millisecond)
+		}
+		return
+	}
+	n, td, l := start()
+	id, err := td.OpenSession("locker", "ANY", 60000)
+	r.NoError(err)
+	ok, err := td.Lock(id, "lock")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(td.ForceUnlock("lock"))
+	seq := td.Seq()
+	before, err := l.Query(&ticket.AuditQuery{})
+	r.NoError(err)
+	r.Len(before, 3)
+	n.Shutdown()
+	td.Quit()
+	l.Close()
+
+	// Raft applies the whole log again on restart, but nothing is audited twice
+	n, td, l = start()
+	defer func() {
+		n.Shutdown()
+		td.Quit()
+		l.Close()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for td.Seq() < seq {
+		r.True(time.Now().Before(deadline), "log not applied after restart")
+		time.Sleep(10 * time.Millisecond)
+	}
+	after, err := l.Query(&ticket.AuditQuery{})
+	r.NoError(err)
+	r.Equal(before, after)
+	// New commands are audited as usual
+	_, err = td.OpenSession("after", "ANY", 60000)
+	r.NoError(err)
+	after, err = l.Query(&ticket.AuditQuery{})
+	r.NoError(err)
+	r.Len(after, 4)
+	r.True(after[3].Seq > seq)
+}
+
+// Wait for every running node to apply up to seq
+func waitForSeq(t *testing.T, lc *LocalCluster, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for i, td := range lc.TicketDs {
+		for !lc.stopped[i] && td.Seq() < seq {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d did not catch up to seq %d", i, seq)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(m.Run())
+}
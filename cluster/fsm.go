@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/hashicorp/raft"
+	"github.com/turbosquid/ticketd/ticket"
+)
+
+// Raft state machine. Committed commands are applied to ticketd, and snapshots are ticketd's flattened state
+type fsm struct {
+	td       *ticket.TicketD
+	replayTo uint64 // Last index in the log when we started. Entries up to here are being applied again
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	cmd := &ticket.Command{}
+	if err := json.Unmarshal(l.Data, cmd); err != nil {
+		return &ticket.Result{Err: err}
+	}
+	cmd.Replayed = l.Index <= f.replayTo
+	return f.td.ApplyCommitted(cmd)
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	state, err := f.td.ExportState()
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{state}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) (err error) {
+	defer rc.Close()
+	state := &ticket.ReplicaState{}
+	if err = json.NewDecoder(rc).Decode(state); err != nil {
+		return
+	}
+	return f.td.RestoreState(state)
+}
+
+type fsmSnapshot struct {
+	state *ticket.ReplicaState
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) (err error) {
+	if err = json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/turbosquid/ticketd/ticket"
+)
+
+//
+// LocalCluster is an in-process cluster for tests. Nodes keep their logs in memory, talk over in-memory transports
+// and use short raft timeouts. Node ids are node-0, node-1, etc.
+type LocalCluster struct {
+	Nodes      []*Node
+	TicketDs   []*ticket.TicketD
+	transports []*raft.InmemTransport
+	stopped    []bool
+	cfg        Config
+}
+
+//
+// Start a local cluster of size nodes. cfg supplies the logger and snapshot settings for every node, and may be nil
+func StartLocalCluster(size int, cfg *Config) (lc *LocalCluster, err error) {
+	lc = &LocalCluster{}
+	if cfg != nil {
+		lc.cfg = *cfg
+	}
+	servers := raft.Configuration{}
+	for i := 0; i < size; i++ {
+		_, trans := raft.NewInmemTransport("")
+		lc.transports = append(lc.transports, trans)
+		servers.Servers = append(servers.Servers, raft.Server{ID: raft.ServerID(nodeId(i)), Address: trans.LocalAddr()})
+	}
+	lc.connectAll()
+	for i := 0; i < size; i++ {
+		if _, err = lc.startNode(i, &servers); err != nil {
+			lc.Shutdown()
+			return nil, err
+		}
+	}
+	return
+}
+
+//
+// Start a new node and add it to the cluster
+func (lc *LocalCluster) AddNode() (i int, err error) {
+	_, trans := raft.NewInmemTransport("")
+	lc.transports = append(lc.transports, trans)
+	i = len(lc.transports) - 1
+	lc.connectAll()
+	if _, err = lc.startNode(i, nil); err != nil {
+		return
+	}
+	leader, err := lc.Leader(5 * time.Second)
+	if err != nil {
+		return
+	}
+	err = lc.Nodes[leader].AddMember(nodeId(i), string(trans.LocalAddr()))
+	return
+}
+
+//
+// Wait for a leader and return its index
+func (lc *LocalCluster) Leader(timeout time.Duration) (i int, err error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for i, n := range lc.Nodes {
+			if !lc.stopped[i] && n.IsLeader() {
+				return i, nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return -1, fmt.Errorf("no leader after %s", timeout)
+}
+
+//
+// Cut a node off from the rest of the cluster
+func (lc *LocalCluster) Disconnect(i int) {
+	lc.transports[i].DisconnectAll()
+	for j, t := range lc.transports {
+		if j != i {
+			t.Disconnect(lc.transports[i].LocalAddr())
+		}
+	}
+}
+
+//
+// Reconnect a node cut off with Disconnect
+func (lc *LocalCluster) Reconnect(i int) {
+	for j, t := range lc.transports {
+		if j != i {
+			t.Connect(lc.transports[i].LocalAddr(), lc.transports[i])
+			lc.transports[i].Connect(t.LocalAddr(), t)
+		}
+	}
+}
+
+//
+// Stop a node and its TicketD
+func (lc *LocalCluster) StopNode(i int) {
+	if lc.stopped[i] {
+		return
+	}
+	lc.Disconnect(i)
+	lc.Nodes[i].Shutdown()
+	lc.TicketDs[i].Quit()
+	lc.stopped[i] = true
+}
+
+//
+// Stop all nodes
+func (lc *LocalCluster) Shutdown() {
+	for i := range lc.Nodes {
+		lc.StopNode(i)
+	}
+}
+
+func (lc *LocalCluster) connectAll() {
+	for _, t := range lc.transports {
+		for _, peer := range lc.transports {
+			if t != peer {
+				t.Connect(peer.LocalAddr(), peer)
+			}
+		}
+	}
+}
+
+// Start node i. If servers is not nil, bootstrap it with that configuration
+func (lc *LocalCluster) startNode(i int, servers *raft.Configuration) (n *Node, err error) {
+	td := ticket.NewTicketD(100, "", 0, lc.cfg.Logger, nil)
+	td.Start()
+	cfg := lc.cfg
+	cfg.Id = nodeId(i)
+	cfg.raftConfig = localRaftConfig()
+	cfg.raftConfig.LocalID = raft.ServerID(cfg.Id)
+	logs := raft.NewInmemStore()
+	snaps := raft.NewInmemSnapshotStore()
+	if servers != nil {
+		if err = raft.BootstrapCluster(cfg.raftConfig, logs, logs, snaps, lc.transports[i], *servers); err != nil {
+			td.Quit()
+			return
+		}
+	}
+	if n, err = newNode(&cfg, td, logs, logs, snaps, lc.transports[i]); err != nil {
+		td.Quit()
+		return
+	}
+	lc.Nodes = append(lc.Nodes, n)
+	lc.TicketDs = append(lc.TicketDs, td)
+	lc.stopped = append(lc.stopped, false)
+	return
+}
+
+// Raft configuration with short timeouts
+func localRaftConfig() (rc *raft.Config) {
+	rc = raft.DefaultConfig()
+	rc.HeartbeatTimeout = 50 * time.Millisecond
+	rc.ElectionTimeout = 50 * time.Millisecond
+	rc.LeaderLeaseTimeout = 50 * time.Millisecond
+	rc.CommitTimeout = 5 * time.Millisecond
+	return
+}
+
+func nodeId(i int) string {
+	return fmt.Sprintf("node-%d", i)
+}
@@ -0,0 +1,143 @@
+package http
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/turbosquid/ticketd/ticket"
+	"net/http"
+	"time"
+)
+
+// Only let callers the access control policy grants the admin verb through
+func adminOnly(handler handlerFunc) handlerFunc {
+	return func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if err := td.Authorize(r.Context(), ticket.VerbAdmin, ""); err != nil {
+			apiErr(w, err)
+			return
+		}
+		handler(td, w, r, params)
+	}
+}
+
+// Result of an invariant check
+type CheckResponse struct {
+	Ok         bool
+	Violations []string // One line per violation found
+}
+
+//
+// Check ticketd invariants now. Violations are reported in the response, which is a 200 either way
+func getAdminCheck(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	violations, err := td.CheckInvariantsContext(r.Context())
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+	if violations == nil {
+		violations = []string{}
+	}
+	jsonResp(w, &CheckResponse{Ok: len(violations) == 0, Violations: violations}, 200)
+}
+
+//
+// Report what each namespace holds, and its quotas
+func getAdminUsage(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	usage, err := td.UsageContext(r.Context())
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+	jsonResp(w, usage, 200)
+}
+
+//
+// Query recent audit log entries, oldest first. Filter with the namespace, resource, session (id), name (of the
+// session), since (RFC3339) and limit query parameters
+func getAdminAudit(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	l := td.AuditLog()
+	if l == nil {
+		http.Error(w, "No audit log", http.StatusNotImplemented)
+		return
+	}
+	q := &ticket.AuditQuery{Namespace: getSingleQueryParam(r.URL, "namespace", ""),
+		Resource: getSingleQueryParam(r.URL, "resource", ""), SessId: getSingleQueryParam(r.URL, "session", ""),
+		SessName: getSingleQueryParam(r.URL, "name", ""), Limit: getSingleQueryParamInt(r.URL, "limit", 0)}
+	if since := getSingleQueryParam(r.URL, "since", ""); since != "" {
+		var err error
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, fmt.Sprintf("Bad since time: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := l.Query(q)
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+	jsonResp(w, entries, 200)
+}
+
+//
+// Close a session, whoever owns it
+func deleteAdminSession(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpForceCloseSession, RequestId: requestId(r),
+		SessId: params.ByName("id")})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, "Ok", 200)
+}
+
+//
+// Close every session with the name and/or source given in the query. Returns the ids of the sessions closed
+func deleteAdminSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	name, src := getSingleQueryParam(r.URL, "name", ""), getSingleQueryParam(r.URL, "src", "")
+	if name == "" && src == "" {
+		http.Error(w, "closing sessions needs a name or a src", http.StatusBadRequest)
+		return
+	}
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpCloseSessions, RequestId: requestId(r),
+		Name: name, Src: src})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, res.Closed, 200)
+}
+
+//
+// Unlock a lock, whoever holds it
+func deleteAdminLock(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpForceUnlock, RequestId: requestId(r),
+		Resource: params.ByName("resource")})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, "Ok", 200)
+}
+
+//
+// Release the claim on the ticket named in the query, whoever holds it
+func deleteAdminClaim(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpForceRelease, RequestId: requestId(r),
+		Resource: params.ByName("resource"), Name: getSingleQueryParam(r.URL, "name", "")})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, "Ok", 200)
+}
+
+//
+// Delete a resource and all its tickets
+func deleteAdminResource(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpDeleteResource, RequestId: requestId(r),
+		Resource: params.ByName("resource")})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, "Ok", 200)
+}
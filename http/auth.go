@@ -0,0 +1,343 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/turbosquid/ticketd/ticket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication
+//
+// Requests carry credentials from a key file, either as a bearer token (Authorization: Bearer <secret>) or as an HMAC
+// signature made with the secret (see HMACKey). Each key names a principal and the roles it has. Every route belongs
+// to one role, so /status, /dump, replication and admin calls can be granted separately from the main api. The peer
+// role marks other members of a cluster, whose word we take for who a forwarded request is from. Signed
+// requests carry a nonce, and a server turns away a nonce it has already seen, so a captured request can't be replayed.
+
+// Roles a key can have
+const (
+	RoleApi         = "api"         // Sessions, tickets, claims and locks
+	RoleStatus      = "status"      // GET /status
+	RoleDump        = "dump"        // GET /dump/...
+	RoleReplication = "replication" // The replication stream, for followers
+	RoleAdmin       = "admin"       // Promotion, cluster membership and the admin endpoints
+	RolePeer        = "peer"        // Cluster members forwarding requests to the leader. Not included in RoleAll
+	RoleAll         = "*"           // Every role
+)
+
+// Authorization scheme of HMAC signed requests
+const hmacScheme = "TD-HMAC-SHA256"
+
+// Largest request body we read to check a signature
+const maxSignedBody = 8 << 20
+
+// How far the timestamp of a signed request may be from our time
+const defaultMaxSkew = 5 * time.Minute
+
+//
+// A key in the key file
+type Key struct {
+	Id        string   // Key id. Names the key in HMAC signed requests
+	Secret    string   // Bearer token, and HMAC secret
+	Principal string   // Who the key belongs to. Defaults to the key id
+	Roles     []string // Roles granted
+}
+
+//
+// A client certificate subject, for servers that ask for client certificates
+type Subject struct {
+	Name  string   // Common name of the certificate subject. Also the principal name
+	Roles []string // Roles granted
+}
+
+//
+// Key file contents. The key file is json
+type KeyFile struct {
+	Keys     []*Key
+	Subjects []*Subject
+}
+
+//
+// An authenticated caller
+type Principal struct {
+	Name  string
+	KeyId string
+	roles map[string]bool
+}
+
+//
+// Does the principal have a role?
+func (p *Principal) Has(role string) bool {
+	return p.roles[role] || p.roles[RoleAll]
+}
+
+//
+// Is the principal a cluster peer? Peers are trusted to say who they forward requests for, so the role has to be
+// granted by name
+func (p *Principal) IsPeer() bool {
+	return p.roles[RolePeer]
+}
+
+//
+// Checks request credentials against the keys in a key file. Call Reload to pick up changes to the file
+type Authenticator struct {
+	path      string
+	MaxSkew   time.Duration // How far the timestamp of a signed request may be from our time. Defaults to 5 minutes
+	mu        sync.RWMutex
+	byId      map[string]*authKey
+	byBearer  map[string]*authKey // Keyed by sha256 of the secret
+	bySubject map[string]*Principal
+	nonces    nonceCache
+}
+
+type authKey struct {
+	secret    []byte
+	principal *Principal
+}
+
+type principalKeyType struct{}
+
+var principalKey principalKeyType
+
+//
+// Create an authenticator from a key file
+func NewAuthenticator(path string) (a *Authenticator, err error) {
+	a = &Authenticator{path: path, MaxSkew: defaultMaxSkew, nonces: nonceCache{seen: map[string]time.Time{}}}
+	if err = a.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+//
+// Re-read the key file. On error, the keys we had are kept
+func (a *Authenticator) Reload() (err error) {
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return
+	}
+	kf := KeyFile{}
+	if err = json.Unmarshal(data, &kf); err != nil {
+		return fmt.Errorf("key file %s: %w", a.path, err)
+	}
+	byId := make(map[string]*authKey, len(kf.Keys))
+	byBearer := make(map[string]*authKey, len(kf.Keys))
+	for i, k := range kf.Keys {
+		if k.Id == "" || k.Secret == "" {
+			return fmt.Errorf("key file %s: key %d needs an id and a secret", a.path, i)
+		}
+		if byId[k.Id] != nil {
+			return fmt.Errorf("key file %s: duplicate key id %s", a.path, k.Id)
+		}
+		name := k.Principal
+		if name == "" {
+			name = k.Id
+		}
+		ak := &authKey{secret: []byte(k.Secret), principal: newPrincipal(name, k.Id, k.Roles)}
+		byId[k.Id] = ak
+		byBearer[hashSecret(k.Secret)] = ak
+	}
+	bySubject := make(map[string]*Principal, len(kf.Subjects))
+	for i, s := range kf.Subjects {
+		if s.Name == "" {
+			return fmt.Errorf("key file %s: subject %d needs a name", a.path, i)
+		}
+		bySubject[s.Name] = newPrincipal(s.Name, "", s.Roles)
+	}
+	a.mu.Lock()
+	a.byId, a.byBearer, a.bySubject = byId, byBearer, bySubject
+	a.mu.Unlock()
+	log.Printf("Loaded %d keys and %d subjects from %s", len(kf.Keys), len(kf.Subjects), a.path)
+	return
+}
+
+func newPrincipal(name, keyId string, roles []string) (p *Principal) {
+	p = &Principal{Name: name, KeyId: keyId, roles: make(map[string]bool, len(roles))}
+	for _, role := range roles {
+		p.roles[role] = true
+	}
+	return
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// Check a request's credentials. Returns the caller, or an error if the request carries no valid credentials
+func (a *Authenticator) Authenticate(r *http.Request) (p *Principal, err error) {
+	authz := r.Header.Get("Authorization")
+	scheme, params, _ := strings.Cut(authz, " ")
+	switch scheme {
+	case "Bearer":
+		a.mu.RLock()
+		ak := a.byBearer[hashSecret(strings.TrimSpace(params))]
+		a.mu.RUnlock()
+		if ak == nil {
+			return nil, fmt.Errorf("unknown token")
+		}
+		return ak.principal, nil
+	case hmacScheme:
+		return a.checkSignature(r, params)
+	case "":
+		return nil, fmt.Errorf("no credentials")
+	}
+	return nil, fmt.Errorf("unsupported authorization scheme %s", scheme)
+}
+
+//
+// Look up a client certificate subject. Nil if the key file does not list it
+func (a *Authenticator) Subject(name string) *Principal {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.bySubject[name]
+}
+
+// Check a HMAC signed request. The body is read, and replaced so handlers can read it again
+func (a *Authenticator) checkSignature(r *http.Request, params string) (p *Principal, err error) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(params, ",") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok {
+			fields[name] = value
+		}
+	}
+	a.mu.RLock()
+	ak := a.byId[fields["Key"]]
+	a.mu.RUnlock()
+	if ak == nil {
+		return nil, fmt.Errorf("unknown key %q", fields["Key"])
+	}
+	ts, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad signature timestamp")
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > a.MaxSkew || skew < -a.MaxSkew {
+		return nil, fmt.Errorf("signature timestamp is %s off", skew.Round(time.Second))
+	}
+	sig, err := hex.DecodeString(fields["Signature"])
+	if err != nil {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if fields["Nonce"] == "" {
+		return nil, fmt.Errorf("signature has no nonce")
+	}
+	body := []byte{}
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody)); err != nil {
+			return nil, fmt.Errorf("reading body: %w", err)
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(sig, signature(ak.secret, r, fields["Timestamp"], fields["Nonce"], body)) {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+	// Only check for a replay once the signature is good, so nobody can burn another caller's nonces. The nonce is
+	// remembered until its timestamp falls out of the skew window, after which the timestamp check turns it away
+	if !a.nonces.add(fields["Key"]+" "+fields["Nonce"], time.Unix(ts, 0).Add(a.MaxSkew)) {
+		return nil, fmt.Errorf("replayed signature")
+	}
+	return ak.principal, nil
+}
+
+// HMAC-SHA256 of a request. Covers the method, uri, timestamp, nonce, the session token and idempotency key headers,
+// and the body
+func signature(secret []byte, r *http.Request, ts, nonce string, body []byte) []byte {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), ts, nonce,
+		r.Header.Get(sessionTokenHeader), r.Header.Get(requestIdHeader), hex.EncodeToString(bodySum[:]))
+	return mac.Sum(nil)
+}
+
+// Nonces of signed requests seen recently, with when they can be forgotten
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// Remember a nonce until expires. False if it has been seen already
+func (c *nonceCache) add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Second {
+		for n, exp := range c.seen {
+			if exp.Before(now) {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+	if exp, ok := c.seen[nonce]; ok && !exp.Before(now) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+//
+// Get the authenticated caller of a request. Nil if the server does not authenticate requests
+func RequestPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey).(*Principal)
+	return p
+}
+
+// Find out who made a request: the holder of the client certificate if the key file lists its subject (or there is no
+// key file, in which case it gets ServerTLS.ClientRoles), else the owner of the credentials the request carries
+func authenticate(opts *ServerOptions, r *http.Request) (p *Principal, err error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if opts.Auth == nil {
+			return newPrincipal(subject, "", opts.TLS.ClientRoles), nil
+		}
+		if p = opts.Auth.Subject(subject); p != nil {
+			return
+		}
+	}
+	if opts.Auth == nil {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	return opts.Auth.Authenticate(r)
+}
+
+// Only let callers with role through. Does nothing if the server does not authenticate requests (with keys or client
+// certificates). Callers are passed on to the ticket layer (ticket.WithPrincipal), where the access control policy
+// applies
+func authorize(opts *ServerOptions, role string, handler handlerFunc) handlerFunc {
+	certs := opts.TLS != nil && opts.TLS.ClientCAFile != ""
+	if (opts.Auth == nil && !certs) || (role == RoleStatus && opts.PublicStatus) {
+		return handler
+	}
+	return func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		p, err := authenticate(opts, r)
+		if err != nil {
+			Debug("Authentication failed for %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ticketd"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		p = trustForwarded(r, p, role)
+		if !p.Has(role) {
+			http.Error(w, fmt.Sprintf("Forbidden: %s does not have the %s role", p.Name, role), http.StatusForbidden)
+			return
+		}
+		ctx := ticket.WithPrincipal(context.WithValue(r.Context(), principalKey, p), p.Name)
+		handler(td, w, r.WithContext(ctx), params)
+	}
+}
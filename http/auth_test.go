@@ -0,0 +1,227 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeyFile(r *require.Assertions, path string, keys ...*Key) {
+	data, err := json.Marshal(&KeyFile{Keys: keys})
+	r.NoError(err)
+	r.NoError(ioutil.WriteFile(path, data, 0600))
+}
+
+func TestAuth(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath,
+		&Key{Id: "app", Secret: "app-secret", Roles: []string{RoleApi}},
+		&Key{Id: "monitor", Secret: "monitor-secret", Roles: []string{RoleStatus}},
+		&Key{Id: "ops", Secret: "ops-secret", Principal: "operations", Roles: []string{RoleAll}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{Auth: auth})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+
+	// No credentials
+	anon := NewClient("http://localhost:8080", 1*time.Second)
+	anon.Credentials = nil
+	_, err = anon.OpenSession("anon", 5000)
+	r.Equal(http.StatusUnauthorized, HttpErrorCode(err))
+	_, err = anon.GetStatus()
+	r.Equal(http.StatusUnauthorized, HttpErrorCode(err))
+
+	// Bearer token
+	app := NewClient("http://localhost:8080", 1*time.Second)
+	app.Credentials = BearerToken("app-secret")
+	sess, err := app.OpenSession("app", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("auth-test", "t1", []byte("data")))
+	_, err = app.GetSessions()
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+
+	// Status only
+	monitor := NewClient("http://localhost:8080", 1*time.Second)
+	monitor.Credentials = BearerToken("monitor-secret")
+	_, err = monitor.GetStatus()
+	r.NoError(err)
+	_, err = monitor.GetResources("")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	_, err = monitor.OpenSession("monitor", 5000)
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+
+	// HMAC signed requests, with and without bodies
+	ops := NewClient("http://localhost:8080", 1*time.Second)
+	ops.Credentials = &HMACKey{Id: "ops", Secret: "ops-secret"}
+	opsSess, err := ops.OpenSession("ops", 5000)
+	r.NoError(err)
+	res, err := opsSess.SyncTickets("auth-test-sync", map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	r.NoError(err)
+	r.Len(res.Issued, 2)
+	resources, err := ops.GetResources("auth-test-sync")
+	r.NoError(err)
+	r.Len(resources["auth-test-sync"].Tickets, 2)
+	ops.Credentials = &HMACKey{Id: "ops", Secret: "wrong"}
+	_, err = ops.GetStatus()
+	r.Equal(http.StatusUnauthorized, HttpErrorCode(err))
+
+	// Reload revokes keys that are gone
+	writeKeyFile(r, keyPath, &Key{Id: "monitor", Secret: "monitor-secret", Roles: []string{RoleStatus}})
+	r.NoError(auth.Reload())
+	r.Equal(http.StatusUnauthorized, HttpErrorCode(sess.Refresh()))
+	_, err = monitor.GetStatus()
+	r.NoError(err)
+	// A bad key file leaves the keys alone
+	r.NoError(ioutil.WriteFile(keyPath, []byte("{"), 0600))
+	r.Error(auth.Reload())
+	_, err = monitor.GetStatus()
+	r.NoError(err)
+}
+
+func TestSignedReplay(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath, &Key{Id: "app", Secret: "app-secret", Roles: []string{RoleApi}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	key := &HMACKey{Id: "app", Secret: "app-secret"}
+	signed := func() *http.Request {
+		req := httptest.NewRequest("PUT", "/api/v1/sessions/s1", strings.NewReader("{}"))
+		req.Header.Set(sessionTokenHeader, "token-1")
+		req.Header.Set(requestIdHeader, "req-1")
+		r.NoError(key.Apply(req))
+		return req
+	}
+	req := signed()
+	authz := req.Header.Get("Authorization")
+	r.Contains(authz, "Nonce=")
+	p, err := auth.Authenticate(req)
+	r.NoError(err)
+	r.Equal("app", p.Name)
+	// The same request can't be sent twice
+	again := httptest.NewRequest("PUT", "/api/v1/sessions/s1", strings.NewReader("{}"))
+	again.Header = req.Header.Clone()
+	_, err = auth.Authenticate(again)
+	r.ErrorContains(err, "replayed")
+	// Nor can its signature be moved to a request with another session token or idempotency key
+	for _, header := range []string{sessionTokenHeader, requestIdHeader} {
+		req = signed()
+		req.Header.Set(header, "other")
+		_, err = auth.Authenticate(req)
+		r.ErrorContains(err, "mismatch")
+	}
+	// A fresh signature of the same request is fine
+	_, err = auth.Authenticate(signed())
+	r.NoError(err)
+	// Signatures need a nonce
+	req = signed()
+	req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "Nonce=", "X=", 1))
+	_, err = auth.Authenticate(req)
+	r.ErrorContains(err, "nonce")
+}
+
+func TestPublicStatus(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath, &Key{Id: "app", Secret: "app-secret", Roles: []string{RoleApi}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{Auth: auth, PublicStatus: true})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+	anon := NewClient("http://localhost:8080", 1*time.Second)
+	anon.Credentials = nil
+	_, err = anon.GetStatus()
+	r.NoError(err)
+	_, err = anon.GetSessions()
+	r.Equal(http.StatusUnauthorized, HttpErrorCode(err))
+}
+
+func TestAccessControl(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath,
+		&Key{Id: "app", Secret: "app-secret", Roles: []string{RoleAll}},
+		&Key{Id: "ops", Secret: "ops-secret", Roles: []string{RoleAll}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.SetPolicy(&ticket.Policy{Grants: []*ticket.Grant{
+		{Principal: "app", Verbs: []ticket.Verb{ticket.VerbIssue, ticket.VerbClaim, ticket.VerbDump}, Resources: []string{"app-"}},
+		{Principal: "ops", Verbs: []ticket.Verb{ticket.VerbAll}, Resources: []string{"*"}},
+	}})
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{Auth: auth})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+
+	app := NewClient("http://localhost:8080", 1*time.Second)
+	app.Credentials = BearerToken("app-secret")
+	sess, err := app.OpenSession("app", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("app-jobs", "t1", nil))
+	err = sess.IssueTicket("other", "t1", nil)
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	r.True(errors.Is(err, ticket.ErrForbidden))
+	r.Equal(http.StatusForbidden, HttpErrorCode(sess.RevokeTicket("app-jobs", "t1")))
+	_, err = app.GetResources("other")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	_, err = app.CheckInvariants()
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+
+	ops := NewClient("http://localhost:8080", 1*time.Second)
+	ops.Credentials = BearerToken("ops-secret")
+	_, err = ops.CheckInvariants()
+	r.NoError(err)
+	resources, err := ops.GetResources("")
+	r.NoError(err)
+	r.Contains(resources, "app-jobs")
+}
+
+func TestSessionTokens(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond)
+	sess1, err := cli.OpenSession("session-1", 5000)
+	r.NoError(err)
+	r.NotEmpty(sess1.Token)
+	sess2, err := cli.OpenSession("session-2", 5000)
+	r.NoError(err)
+	r.NoError(sess1.IssueTicket("tokens", "t1", nil))
+	// Tokens are not dumped
+	sessions, err := cli.GetSessions()
+	r.NoError(err)
+	r.Empty(sessions[sess1.Id].Token)
+	// Acting as another session takes its token
+	stolen := &Session{c: cli, Id: sess1.Id}
+	r.Equal(http.StatusForbidden, HttpErrorCode(stolen.ReleaseTicket("tokens", "t1")))
+	stolen.Token = sess2.Token
+	_, err = stolen.Lock("tokens-lock")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	r.Equal(http.StatusForbidden, HttpErrorCode(stolen.Close()))
+	_, err = stolen.HasTicket("tokens", "t1")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	// Every session route needs the token, including the read-only ones
+	stolen.Token = ""
+	_, err = stolen.HasTicket("tokens", "t1")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	_, err = stolen.HasLock("tokens-lock")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	r.NoError(sess1.Close())
+}
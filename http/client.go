@@ -5,32 +5,65 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/segmentio/ksuid"
 	"github.com/turbosquid/ticketd/ticket"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
 
 const apiPath = "/api/v1"
 
+//
+// Returned by every call on a client that has no server endpoints
+var ErrNoEndpoints = errors.New("no server endpoints")
+
+// Client and Session can be used wherever a ticket.Client or ticket.ClientSession is expected
+var (
+	_ ticket.Client        = (*Client)(nil)
+	_ ticket.ClientSession = (*Session)(nil)
+)
+
 //
 // Error type returned when we get a http error from the server. User
 // HttpErrorCode() to unpack
 type HttpError struct {
-	Code    int
-	Message string
+	Code       int
+	Message    string
+	RetryAfter time.Duration // How long the server asked us to wait before trying again, if it did
 }
 
 func (err *HttpError) Error() string {
 	return err.Message
 }
 
+//
+// Map the http error to the ticketd error it stands for, if any, so errors.Is(err, ticket.ErrNotFound) works the
+// same for http and local clients
+func (err *HttpError) Unwrap() error {
+	switch err.Code {
+	case 404:
+		return ticket.ErrNotFound
+	case 403:
+		return ticket.ErrForbidden
+	case 429:
+		if err.RetryAfter > 0 {
+			return ErrRateLimited
+		}
+		return ticket.ErrQuotaExceeded
+	}
+	return nil
+}
+
 func newHttpError(code int, msg string) (err *HttpError) {
-	return &HttpError{code, msg}
+	return &HttpError{Code: code, Message: msg}
 }
 
 //
@@ -47,63 +80,176 @@ func HttpErrorCode(err error) (code int) {
 }
 
 //
-// API Client -- shareable by multiple goroutines
+// API Client -- shareable by multiple goroutines. A client can be given several server endpoints (the members of a
+// cluster, or a leader and its followers). Calls go to one endpoint at a time, and move on to the next when an endpoint
+// is unreachable or can't reach a leader. Failed calls are retried across endpoints with backoff. Every mutating call
+// carries a unique request id (idempotency key), so the server applies it at most once however often it is retried
 type Client struct {
-	baseUrl string
+	endpoints    *endpoints
+	Retries      int           // Retry rounds once every endpoint has been tried
+	RetryBackoff time.Duration // Wait before the first retry round. Doubles each round
+	Credentials  Credentials   // Attached to every call. Picked up from the environment by default (CredentialsFromEnv)
+	Namespace    string        // Sessions, tickets and dumps are in this namespace. Empty for the default namespace
 	http.Client
 }
 
 //
 // Api session -- restricted to a single goroutine
 type Session struct {
-	c             *Client
-	Id            string
-	heartBeatChan chan interface{}
-	heartBeatWg   sync.WaitGroup
+	c                  *Client
+	Id                 string
+	Token              string        // Session token, presented with every call on the session
+	LeaseWatchInterval time.Duration // How often leases check their claim or lock. Defaults to 1s
+	heartBeatStop      context.CancelFunc
+	heartBeatWg        sync.WaitGroup
 }
 
 //
-// Create a new api client
+// Create a new api client. Failed calls are retried twice, starting with a 100ms backoff
 func NewClient(url string, timeout time.Duration) (c *Client) {
-	c = &Client{url, http.Client{Timeout: timeout}}
+	c = &Client{endpoints: newEndpoints([]string{url}), Retries: 2, RetryBackoff: 100 * time.Millisecond,
+		Credentials: CredentialsFromEnv(), Client: http.Client{Timeout: timeout}}
+	c.CheckRedirect = redirectWithCredentials(func() Credentials { return c.Credentials })
+	return
+}
+
+//
+// Create a new api client that fails over between several server endpoints. Calls are retried for up to 4 rounds
+// across all endpoints, starting with a 100ms backoff. Adjust Retries and RetryBackoff to taste. With no urls, every call
+// fails with ErrNoEndpoints
+func NewFailoverClient(urls []string, timeout time.Duration) (c *Client) {
+	c = &Client{endpoints: newEndpoints(urls), Retries: 4, RetryBackoff: 100 * time.Millisecond,
+		Credentials: CredentialsFromEnv(), Client: http.Client{Timeout: timeout}}
+	c.CheckRedirect = redirectWithCredentials(func() Credentials { return c.Credentials })
+	return
+}
+
+// Copy of a client with a different timeout. Shares endpoint state with the original
+func (c *Client) withTimeout(timeout time.Duration) (out *Client) {
+	out = &Client{endpoints: c.endpoints, Retries: c.Retries, RetryBackoff: c.RetryBackoff, Credentials: c.Credentials,
+		Namespace: c.Namespace, Client: c.Client}
+	out.CheckRedirect = redirectWithCredentials(func() Credentials { return out.Credentials })
+	out.Timeout = timeout
 	return
 }
 
-func (c *Client) urlStr(path string) string {
-	return fmt.Sprintf("%s%s%s", c.baseUrl, apiPath, path)
+// Where the api lives for a path. Calls on namespaced routes go under the client's namespace
+func (c *Client) apiPrefix(path string) string {
+	if c.Namespace == "" || !namespacedPath(path) {
+		return apiPath
+	}
+	return apiPath + "/ns/" + url.PathEscape(c.Namespace)
+}
+
+func (c *Client) callBytes(ctx context.Context, verb, path string, in []byte, objOut interface{}) (err error) {
+	return c.callWith(ctx, verb, path, in, objOut, "", nil)
+}
+
+// Make a call that presents a session token (if not empty). If respHeader is not nil, the response headers are
+// copied into it
+func (c *Client) callWith(ctx context.Context, verb, path string, in []byte, objOut interface{}, token string, respHeader http.Header) (err error) {
+	// The same request id goes with every attempt, so the server can tell a retry from a new call
+	if c.endpoints == nil || len(c.endpoints.urls) == 0 {
+		return fmt.Errorf("%s %s: %w", verb, path, ErrNoEndpoints)
+	}
+	reqId := ""
+	if verb != "GET" {
+		reqId = ksuid.New().String()
+	}
+	backoff := c.RetryBackoff
+	for round := 0; ; round++ {
+		wait := backoff
+		for n := 0; n < len(c.endpoints.urls); n++ {
+			again := false
+			again, err = c.callEndpoint(ctx, verb, path, in, objOut, reqId, token, respHeader)
+			// Rate limited: wait as long as the server asks, then try again
+			if herr, ok := err.(*HttpError); ok && herr.RetryAfter > 0 {
+				Debug("Call %s %s was rate limited, retrying in %s", verb, path, herr.RetryAfter)
+				wait = herr.RetryAfter
+				break
+			}
+			if !again {
+				return
+			}
+			Debug("Call %s %s failed, trying next endpoint: %s", verb, path, err.Error())
+		}
+		if round >= c.Retries {
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
 }
 
-func (c *Client) callBytes(verb, path string, in []byte, objOut interface{}) (err error) {
+// Make a call against the current endpoint. again is set if the call failed in a way that a retry may fix
+func (c *Client) callEndpoint(ctx context.Context, verb, path string, in []byte, objOut interface{}, reqId, token string,
+	respHeader http.Header) (again bool, err error) {
+	i, base := c.endpoints.pick()
 	var request *http.Request
 	if in != nil {
-		request, err = http.NewRequest(verb, c.urlStr(path), bytes.NewBuffer(in))
+		request, err = http.NewRequestWithContext(ctx, verb, base+c.apiPrefix(path)+path, bytes.NewReader(in))
 	} else {
-		request, err = http.NewRequest(verb, c.urlStr(path), nil)
+		request, err = http.NewRequestWithContext(ctx, verb, base+c.apiPrefix(path)+path, nil)
 	}
 	if err != nil {
 		return
 	}
 	request.Header.Set("Content-type", "application/json")
+	if reqId != "" {
+		request.Header.Set(requestIdHeader, reqId)
+	}
+	if token != "" {
+		request.Header.Set(sessionTokenHeader, token)
+	}
+	if err = applyCredentials(c.Credentials, request); err != nil {
+		return
+	}
 	resp, err := c.Do(request)
 	if err != nil {
-		return
+		// A cancelled call says nothing about the endpoint
+		if ctx.Err() != nil {
+			return false, err
+		}
+		c.endpoints.failed(i)
+		return true, err
 	}
 	code := resp.StatusCode
 	defer resp.Body.Close()
+	// If we were redirected to the leader, talk to it directly from now on
+	if leader := answeredBy(resp); leader != base {
+		c.endpoints.use(leader)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return
+		return ctx.Err() == nil, err
 	}
 	if code >= 300 {
-		err = newHttpError(code, fmt.Sprintf("HTTP %d = %s", code, string(body)))
+		herr := newHttpError(code, fmt.Sprintf("HTTP %d = %s", code, string(body)))
+		if code == http.StatusTooManyRequests {
+			herr.RetryAfter = retryAfter(resp)
+		}
+		err = herr
+		if isUnavailable(code) {
+			c.endpoints.failed(i)
+			return true, err
+		}
 	} else {
-		// fmt.Printf("%d\n%s", code, string(body))
+		c.endpoints.ok(i)
+		if respHeader != nil {
+			for k, v := range resp.Header {
+				respHeader[k] = v
+			}
+		}
 		err = json.Unmarshal(body, objOut)
 	}
 	return
 }
 
-func (c *Client) call(verb, path string, obj interface{}, objOut interface{}) (err error) {
+func (c *Client) call(ctx context.Context, verb, path string, obj interface{}, objOut interface{}) (err error) {
 	var requestBody []byte
 	if obj != nil {
 		requestBody, err = json.Marshal(obj)
@@ -111,7 +257,7 @@ func (c *Client) call(verb, path string, obj interface{}, objOut interface{}) (e
 			return
 		}
 	}
-	err = c.callBytes(verb, path, requestBody, objOut)
+	err = c.callBytes(ctx, verb, path, requestBody, objOut)
 	return
 }
 
@@ -119,22 +265,62 @@ func (c *Client) call(verb, path string, obj interface{}, objOut interface{}) (e
 // Open a new session. Sessions should not be shared across goroutines. The name need only be meaningfull to the client.
 // ttlMs is the session timeout in ms. Use RefreshSession to keep session alive
 func (c *Client) OpenSession(name string, ttlMs int) (session *Session, err error) {
+	return c.OpenSessionContext(context.Background(), name, ttlMs)
+}
+
+//
+// Same as OpenSession, but gives up when ctx is done
+func (c *Client) OpenSessionContext(ctx context.Context, name string, ttlMs int) (session *Session, err error) {
 	id := ""
 	name = url.QueryEscape(name)
-	err = c.call("POST", fmt.Sprintf("/sessions?name=%s&ttl=%d", name, ttlMs), nil, &id)
+	header := http.Header{}
+	err = c.callWith(ctx, "POST", fmt.Sprintf("/sessions?name=%s&ttl=%d", name, ttlMs), nil, &id, "", header)
 	if err != nil {
 		return
 	}
-	session = &Session{c, id, nil, sync.WaitGroup{}}
+	session = &Session{c: c, Id: id, Token: header.Get(sessionTokenHeader)}
+	return
+}
+
+//
+// Same as OpenSessionContext, but returns a ticket.ClientSession, so callers can be written against ticket.Client
+func (c *Client) NewSession(ctx context.Context, name string, ttlMs int) (session ticket.ClientSession, err error) {
+	sess, err := c.OpenSessionContext(ctx, name, ttlMs)
+	if err == nil {
+		session = sess
+	}
 	return
 }
 
+// Make a call on the session, presenting its token
+func (s *Session) call(ctx context.Context, verb, path string, obj interface{}, objOut interface{}) (err error) {
+	var requestBody []byte
+	if obj != nil {
+		if requestBody, err = json.Marshal(obj); err != nil {
+			return
+		}
+	}
+	return s.c.callWith(ctx, verb, path, requestBody, objOut, s.Token, nil)
+}
+
+//
+// Session id. Same as s.Id
+func (s *Session) SessionId() string {
+	return s.Id
+}
+
 //
 // Close this session. Cancels heartbeat goroutine if in use
 func (s *Session) Close() (err error) {
+	return s.CloseContext(context.Background())
+}
+
+//
+// Same as Close, but gives up when ctx is done
+func (s *Session) CloseContext(ctx context.Context) (err error) {
 	s.CancelHeartBeat()
 	errMsg := ""
-	err = s.c.call("DELETE", fmt.Sprintf("/sessions/%s", s.Id), nil, &errMsg)
+	err = s.call(ctx, "DELETE", fmt.Sprintf("/sessions/%s", s.Id), nil, &errMsg)
 	if err != nil {
 		return
 	}
@@ -144,8 +330,14 @@ func (s *Session) Close() (err error) {
 //
 // Refresh this session at server. Resets session expiration
 func (s *Session) Refresh() (err error) {
+	return s.RefreshContext(context.Background())
+}
+
+//
+// Same as Refresh, but gives up when ctx is done
+func (s *Session) RefreshContext(ctx context.Context) (err error) {
 	errMsg := ""
-	err = s.c.call("PUT", fmt.Sprintf("/sessions/%s", s.Id), nil, &errMsg)
+	err = s.call(ctx, "PUT", fmt.Sprintf("/sessions/%s", s.Id), nil, &errMsg)
 	if err != nil {
 		return
 	}
@@ -155,8 +347,14 @@ func (s *Session) Refresh() (err error) {
 //
 // Get a copy of this session from the server
 func (s *Session) Get() (sess *ticket.Session, err error) {
+	return s.GetContext(context.Background())
+}
+
+//
+// Same as Get, but gives up when ctx is done
+func (s *Session) GetContext(ctx context.Context) (sess *ticket.Session, err error) {
 	sess = &ticket.Session{}
-	err = s.c.call("GET", fmt.Sprintf("/sessions/%s", s.Id), nil, sess)
+	err = s.call(ctx, "GET", fmt.Sprintf("/sessions/%s", s.Id), nil, sess)
 	if err != nil {
 		return
 	}
@@ -165,14 +363,15 @@ func (s *Session) Get() (sess *ticket.Session, err error) {
 
 //
 // Run background "heartbeat" session refresh. Keeps session alive until he session is closed, an http error occurs or
-// any other error occurs, unless we specify to ignore these. The idea is to optionally ignore transient connection errorsa
+// any other error occurs, unless we specify to ignore these. The idea is to optionally ignore transient connection errorsa.
+// A 503 (no leader available) counts as a transient error, so heartbeats ride out a failover when errors are ignored
 //
 // You will pass in a notification function as well. This is called when the heartbeet loop ends
 func (s *Session) RunHeartbeat(interval time.Duration, timeout time.Duration, ignoreNonHttpErrors bool, notify func(err error)) {
-	s.heartBeatChan = make(chan interface{})
-	// Make a copy of the session and change the timeout
-	sessCopy := *s
-	sessCopy.c.Timeout = timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	s.heartBeatStop = cancel
+	// Make a copy of the session with its own timeout
+	sessCopy := &Session{c: s.c.withTimeout(timeout), Id: s.Id, Token: s.Token}
 	s.heartBeatWg.Add(1)
 	go func() {
 		defer s.heartBeatWg.Done()
@@ -180,13 +379,17 @@ func (s *Session) RunHeartbeat(interval time.Duration, timeout time.Duration, ig
 		defer ticker.Stop()
 		for {
 			select {
-			case <-s.heartBeatChan:
+			case <-ctx.Done():
 				go notify(nil)
 				return
 			case <-ticker.C:
-				err := sessCopy.Refresh()
+				err := sessCopy.RefreshContext(ctx)
+				if ctx.Err() != nil {
+					go notify(nil) // Cancelled mid refresh
+					return
+				}
 				code := HttpErrorCode(err)
-				if err != nil && (!ignoreNonHttpErrors || code != 0) {
+				if err != nil && (!ignoreNonHttpErrors || (code != 0 && !isUnavailable(code))) {
 					go notify(err)
 					return
 				}
@@ -198,10 +401,10 @@ func (s *Session) RunHeartbeat(interval time.Duration, timeout time.Duration, ig
 //
 // Cancel heartbeat goroutine if running, else a noop. Automatically called on session close
 func (s *Session) CancelHeartBeat() {
-	if s.heartBeatChan != nil {
-		close(s.heartBeatChan)
+	if s.heartBeatStop != nil {
+		s.heartBeatStop()
 		s.heartBeatWg.Wait()
-		s.heartBeatChan = nil
+		s.heartBeatStop = nil
 	}
 }
 
@@ -210,19 +413,50 @@ func (s *Session) CancelHeartBeat() {
 // The ticket name should be unique within this resource.
 // The issuer can pass in up to 1K of arbitrary byte data in the ticket. This data will be available to ticket claimants
 func (s *Session) IssueTicket(resource, name string, data []byte) (err error) {
+	return s.IssueTicketContext(context.Background(), resource, name, data)
+}
+
+//
+// Same as IssueTicket, but gives up when ctx is done
+func (s *Session) IssueTicketContext(ctx context.Context, resource, name string, data []byte) (err error) {
 	errMsg := ""
 	name = url.QueryEscape(name)
-	err = s.c.callBytes("POST", fmt.Sprintf("/tickets/%s?name=%s&sessid=%s", resource, name, s.Id), data, &errMsg)
+	err = s.c.callWith(ctx, "POST", fmt.Sprintf("/tickets/%s?name=%s&sessid=%s", resource, name, s.Id), data, &errMsg, s.Token, nil)
+	return
+}
+
+//
+// Bring a resource's tickets in line with a desired set (ticket name -> data) in one step. Tickets not in the set are
+// revoked, new tickets are issued by this session, and tickets that remain keep their claims. Returns the changes made
+func (s *Session) SyncTickets(resource string, tickets map[string][]byte) (res *ticket.SyncResult, err error) {
+	return s.SyncTicketsContext(context.Background(), resource, tickets)
+}
+
+//
+// Same as SyncTickets, but gives up when ctx is done
+func (s *Session) SyncTicketsContext(ctx context.Context, resource string, tickets map[string][]byte) (res *ticket.SyncResult, err error) {
+	list := make([]SyncTicket, 0, len(tickets))
+	for name, data := range tickets {
+		list = append(list, SyncTicket{name, data})
+	}
+	res = &ticket.SyncResult{}
+	err = s.call(ctx, "PUT", fmt.Sprintf("/tickets/%s?sessid=%s", resource, s.Id), list, res)
 	return
 }
 
 //
 // Remove  a ticket. Ticket will no longer be available for a resource. Any sessions claiming this ticket will no longer hold a valid ticket
 func (s *Session) RevokeTicket(resource, name string) (err error) {
+	return s.RevokeTicketContext(context.Background(), resource, name)
+}
+
+//
+// Same as RevokeTicket, but gives up when ctx is done
+func (s *Session) RevokeTicketContext(ctx context.Context, resource, name string) (err error) {
 	errMsg := ""
 	name = url.QueryEscape(name)
 	Debug("Revoking ticket. Url:  /tickets/%s?name=%s&sessid=%s", resource, name, s.Id)
-	err = s.c.call("DELETE", fmt.Sprintf("/tickets/%s?name=%s&sessid=%s", resource, name, s.Id), nil, &errMsg)
+	err = s.call(ctx, "DELETE", fmt.Sprintf("/tickets/%s?name=%s&sessid=%s", resource, name, s.Id), nil, &errMsg)
 	return
 }
 
@@ -232,8 +466,14 @@ func (s *Session) RevokeTicket(resource, name string) (err error) {
 // Note that err is nil if a ticket is simply not available (but ok will be false)
 // A client that fails to claim a ticket can retry in a loop until successful (ok == true)
 func (s *Session) ClaimTicket(resource string) (ok bool, ticket *ticket.Ticket, err error) {
+	return s.ClaimTicketContext(context.Background(), resource)
+}
+
+//
+// Same as ClaimTicket, but gives up when ctx is done
+func (s *Session) ClaimTicketContext(ctx context.Context, resource string) (ok bool, ticket *ticket.Ticket, err error) {
 	resp := &TicketResponse{}
-	err = s.c.call("POST", fmt.Sprintf("/claims/%s?sessid=%s", resource, s.Id), nil, resp)
+	err = s.call(ctx, "POST", fmt.Sprintf("/claims/%s?sessid=%s", resource, s.Id), nil, resp)
 	if err != nil {
 		return
 	}
@@ -249,17 +489,42 @@ func (s *Session) ClaimTicket(resource string) (ok bool, ticket *ticket.Ticket,
 // Release a ticket back to resource. The ticket will then be avalable to other clients. Closing a session or
 // session expirstion will release all claimed tickets
 func (s *Session) ReleaseTicket(resource, name string) (err error) {
+	return s.ReleaseTicketContext(context.Background(), resource, name)
+}
+
+//
+// Same as ReleaseTicket, but gives up when ctx is done
+func (s *Session) ReleaseTicketContext(ctx context.Context, resource, name string) (err error) {
 	errMsg := ""
 	name = url.QueryEscape(name)
-	err = s.c.call("DELETE", fmt.Sprintf("/claims/%s?name=%s&sessid=%s", resource, name, s.Id), nil, &errMsg)
+	err = s.call(ctx, "DELETE", fmt.Sprintf("/claims/%s?name=%s&sessid=%s", resource, name, s.Id), nil, &errMsg)
 	return
 }
 
 //
 // Verify that session has ticket
 func (s *Session) HasTicket(resource, name string) (ok bool, err error) {
+	return s.HasTicketContext(context.Background(), resource, name)
+}
+
+//
+// Same as HasTicket, but gives up when ctx is done
+func (s *Session) HasTicketContext(ctx context.Context, resource, name string) (ok bool, err error) {
 	name = url.QueryEscape(name)
-	err = s.c.call("GET", fmt.Sprintf("/claims/%s?name=%s&sessid=%s", resource, name, s.Id), nil, &ok)
+	err = s.call(ctx, "GET", fmt.Sprintf("/claims/%s?name=%s&sessid=%s", resource, name, s.Id), nil, &ok)
+	return
+}
+
+//
+// Verify that session holds the lock on a resource
+func (s *Session) HasLock(resource string) (ok bool, err error) {
+	return s.HasLockContext(context.Background(), resource)
+}
+
+//
+// Same as HasLock, but gives up when ctx is done
+func (s *Session) HasLockContext(ctx context.Context, resource string) (ok bool, err error) {
+	err = s.call(ctx, "GET", fmt.Sprintf("/locks/%s?sessid=%s", resource, s.Id), nil, &ok)
 	return
 }
 
@@ -267,32 +532,293 @@ func (s *Session) HasTicket(resource, name string) (ok bool, err error) {
 // Acquire exclusive lock on resource
 // ok will be true if acquired, else false
 func (s *Session) Lock(resource string) (ok bool, err error) {
-	err = s.c.call("POST", fmt.Sprintf("/locks/%s?sessid=%s", resource, s.Id), nil, &ok)
+	return s.LockContext(context.Background(), resource)
+}
+
+//
+// Same as Lock, but gives up when ctx is done
+func (s *Session) LockContext(ctx context.Context, resource string) (ok bool, err error) {
+	err = s.call(ctx, "POST", fmt.Sprintf("/locks/%s?sessid=%s", resource, s.Id), nil, &ok)
 	return
 }
 
 //
 // Release lock on resource
 func (s *Session) Unlock(resource string) (err error) {
+	return s.UnlockContext(context.Background(), resource)
+}
+
+//
+// Same as Unlock, but gives up when ctx is done
+func (s *Session) UnlockContext(ctx context.Context, resource string) (err error) {
 	errMsg := ""
-	err = s.c.call("DELETE", fmt.Sprintf("/locks/%s?sessid=%s", resource, s.Id), nil, &errMsg)
+	err = s.call(ctx, "DELETE", fmt.Sprintf("/locks/%s?sessid=%s", resource, s.Id), nil, &errMsg)
 	return
 }
 
 //
 // Get session table
 func (c *Client) GetSessions() (sessions map[string]*ticket.Session, err error) {
-	err = c.call("GET", "/dump/sessions", nil, &sessions)
+	return c.GetSessionsContext(context.Background())
+}
+
+//
+// Same as GetSessions, but gives up when ctx is done
+func (c *Client) GetSessionsContext(ctx context.Context) (sessions map[string]*ticket.Session, err error) {
+	err = c.call(ctx, "GET", "/dump/sessions", nil, &sessions)
 	return
 }
 
 //
 // Get resource table. Include optional resource name of interest. Leave empty for all resources
 func (c *Client) GetResources(name string) (resources map[string]*ticket.Resource, err error) {
+	return c.GetResourcesContext(context.Background(), name)
+}
+
+//
+// Same as GetResources, but gives up when ctx is done
+func (c *Client) GetResourcesContext(ctx context.Context, name string) (resources map[string]*ticket.Resource, err error) {
 	if name == "" {
-		err = c.call("GET", "/dump/resources", nil, &resources)
+		err = c.call(ctx, "GET", "/dump/resources", nil, &resources)
 	} else {
-		err = c.call("GET", fmt.Sprintf("/dump/resources/%s", name), nil, &resources)
+		err = c.call(ctx, "GET", fmt.Sprintf("/dump/resources/%s", name), nil, &resources)
+	}
+	return
+}
+
+//
+// Get server status
+func (c *Client) GetStatus() (status *ServerStatusResponse, err error) {
+	return c.GetStatusContext(context.Background())
+}
+
+//
+// Same as GetStatus, but gives up when ctx is done
+func (c *Client) GetStatusContext(ctx context.Context) (status *ServerStatusResponse, err error) {
+	status = &ServerStatusResponse{}
+	err = c.call(ctx, "GET", "/status", nil, status)
+	return
+}
+
+//
+// Promote the server to leader
+func (c *Client) Promote() (err error) {
+	return c.PromoteContext(context.Background())
+}
+
+//
+// Same as Promote, but gives up when ctx is done
+func (c *Client) PromoteContext(ctx context.Context) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "POST", "/replication/promote", nil, &errMsg)
+	return
+}
+
+//
+// Check the server's invariants. Returns a description of each violation found, or none if all is well
+func (c *Client) CheckInvariants() (violations []string, err error) {
+	return c.CheckInvariantsContext(context.Background())
+}
+
+//
+// Same as CheckInvariants, but gives up when ctx is done
+func (c *Client) CheckInvariantsContext(ctx context.Context) (violations []string, err error) {
+	resp := CheckResponse{}
+	err = c.call(ctx, "GET", "/admin/check", nil, &resp)
+	violations = resp.Violations
+	return
+}
+
+//
+// Get what each namespace on the server holds, and its quotas, keyed by namespace
+func (c *Client) GetUsage() (usage map[string]*ticket.Usage, err error) {
+	return c.GetUsageContext(context.Background())
+}
+
+//
+// Same as GetUsage, but gives up when ctx is done
+func (c *Client) GetUsageContext(ctx context.Context) (usage map[string]*ticket.Usage, err error) {
+	err = c.call(ctx, "GET", "/admin/usage", nil, &usage)
+	return
+}
+
+//
+// Get recent audit log entries matching a query, oldest first. The server must be keeping an audit log
+func (c *Client) GetAuditLog(q *ticket.AuditQuery) (entries []*ticket.AuditEntry, err error) {
+	return c.GetAuditLogContext(context.Background(), q)
+}
+
+//
+// Same as GetAuditLog, but gives up when ctx is done
+func (c *Client) GetAuditLogContext(ctx context.Context, q *ticket.AuditQuery) (entries []*ticket.AuditEntry, err error) {
+	v := url.Values{}
+	for name, val := range map[string]string{"namespace": q.Namespace, "resource": q.Resource, "session": q.SessId,
+		"name": q.SessName} {
+		if val != "" {
+			v.Set(name, val)
+		}
 	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339))
+	}
+	err = c.call(ctx, "GET", "/admin/audit?"+v.Encode(), nil, &entries)
+	return
+}
+
+//
+// Close a session, whoever owns it
+func (c *Client) ForceCloseSession(id string) (err error) {
+	return c.ForceCloseSessionContext(context.Background(), id)
+}
+
+//
+// Same as ForceCloseSession, but gives up when ctx is done
+func (c *Client) ForceCloseSessionContext(ctx context.Context, id string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "DELETE", fmt.Sprintf("/admin/sessions/%s", id), nil, &errMsg)
+	return
+}
+
+//
+// Close every session with a name, or from a source, or both. A source without a port matches any port on that
+// host. Returns the ids of the sessions closed
+func (c *Client) CloseSessions(name, src string) (closed []string, err error) {
+	return c.CloseSessionsContext(context.Background(), name, src)
+}
+
+//
+// Same as CloseSessions, but gives up when ctx is done
+func (c *Client) CloseSessionsContext(ctx context.Context, name, src string) (closed []string, err error) {
+	path := fmt.Sprintf("/admin/sessions?name=%s&src=%s", url.QueryEscape(name), url.QueryEscape(src))
+	err = c.call(ctx, "DELETE", path, nil, &closed)
+	return
+}
+
+//
+// Unlock a lock, whoever holds it
+func (c *Client) ForceUnlock(resource string) (err error) {
+	return c.ForceUnlockContext(context.Background(), resource)
+}
+
+//
+// Same as ForceUnlock, but gives up when ctx is done
+func (c *Client) ForceUnlockContext(ctx context.Context, resource string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "DELETE", fmt.Sprintf("/admin/locks/%s", resource), nil, &errMsg)
+	return
+}
+
+//
+// Release the claim on a ticket, whoever holds it
+func (c *Client) ForceRelease(resource, name string) (err error) {
+	return c.ForceReleaseContext(context.Background(), resource, name)
+}
+
+//
+// Same as ForceRelease, but gives up when ctx is done
+func (c *Client) ForceReleaseContext(ctx context.Context, resource, name string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "DELETE", fmt.Sprintf("/admin/claims/%s?name=%s", resource, url.QueryEscape(name)), nil, &errMsg)
+	return
+}
+
+//
+// Delete a resource and all its tickets
+func (c *Client) DeleteResource(resource string) (err error) {
+	return c.DeleteResourceContext(context.Background(), resource)
+}
+
+//
+// Same as DeleteResource, but gives up when ctx is done
+func (c *Client) DeleteResourceContext(ctx context.Context, resource string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "DELETE", fmt.Sprintf("/admin/resources/%s", resource), nil, &errMsg)
+	return
+}
+
+//
+// Freeze the server's clock for a maintenance window. Sessions on the server don't expire while its clock is frozen.
+// Fails with a 501 if the server's clock can't be frozen
+func (c *Client) FreezeClock() (err error) {
+	return c.FreezeClockContext(context.Background())
+}
+
+//
+// Same as FreezeClock, but gives up when ctx is done
+func (c *Client) FreezeClockContext(ctx context.Context) (err error) {
+	resp := ClockResponse{}
+	err = c.call(ctx, "POST", "/admin/clock/freeze", nil, &resp)
+	return
+}
+
+//
+// Restart the server's clock where it stopped
+func (c *Client) ThawClock() (err error) {
+	return c.ThawClockContext(context.Background())
+}
+
+//
+// Same as ThawClock, but gives up when ctx is done
+func (c *Client) ThawClockContext(ctx context.Context) (err error) {
+	resp := ClockResponse{}
+	err = c.call(ctx, "POST", "/admin/clock/thaw", nil, &resp)
+	return
+}
+
+//
+// Make the server follow a leader. leader is the leader's base url
+func (c *Client) Follow(leader string) (err error) {
+	return c.FollowContext(context.Background(), leader)
+}
+
+//
+// Same as Follow, but gives up when ctx is done
+func (c *Client) FollowContext(ctx context.Context, leader string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "POST", fmt.Sprintf("/replication/follow?leader=%s", url.QueryEscape(leader)), nil, &errMsg)
+	return
+}
+
+//
+// List cluster members
+func (c *Client) GetMembers() (members []ticket.Member, err error) {
+	return c.GetMembersContext(context.Background())
+}
+
+//
+// Same as GetMembers, but gives up when ctx is done
+func (c *Client) GetMembersContext(ctx context.Context) (members []ticket.Member, err error) {
+	err = c.call(ctx, "GET", "/cluster/members", nil, &members)
+	return
+}
+
+//
+// Add a member to the cluster. id is the new member's api base url, addr its raft address
+func (c *Client) AddMember(id, addr string) (err error) {
+	return c.AddMemberContext(context.Background(), id, addr)
+}
+
+//
+// Same as AddMember, but gives up when ctx is done
+func (c *Client) AddMemberContext(ctx context.Context, id, addr string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "POST", fmt.Sprintf("/cluster/members?id=%s&addr=%s", url.QueryEscape(id), url.QueryEscape(addr)), nil, &errMsg)
+	return
+}
+
+//
+// Remove a member from the cluster
+func (c *Client) RemoveMember(id string) (err error) {
+	return c.RemoveMemberContext(context.Background(), id)
+}
+
+//
+// Same as RemoveMember, but gives up when ctx is done
+func (c *Client) RemoveMemberContext(ctx context.Context, id string) (err error) {
+	errMsg := ""
+	err = c.call(ctx, "DELETE", fmt.Sprintf("/cluster/members?id=%s", url.QueryEscape(id)), nil, &errMsg)
 	return
 }
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/turbosquid/ticketd/ticket"
+	"net/http"
+)
+
+// A clock that can be stopped for maintenance (ticket.FreezableClock)
+type freezer interface {
+	Freeze()
+	Thaw()
+	Frozen() bool
+}
+
+// Clock state, as reported by the clock endpoints
+type ClockResponse struct {
+	Frozen bool
+}
+
+func getFreezer(td *ticket.TicketD, w http.ResponseWriter) (f freezer) {
+	f, ok := td.Clock().(freezer)
+	if !ok {
+		http.Error(w, "Clock can't be frozen", http.StatusNotImplemented)
+	}
+	return
+}
+
+//
+// Freeze the leader's clock. Sessions don't expire while it is frozen. Followers pass the call on to the leader, since
+// only the leader stamps and expires sessions
+func postClockFreeze(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if f := getFreezer(td, w); f != nil {
+		f.Freeze()
+		Debug("Clock frozen")
+		jsonResp(w, &ClockResponse{Frozen: true}, 200)
+	}
+}
+
+//
+// Restart the leader's clock where it stopped
+func postClockThaw(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if f := getFreezer(td, w); f != nil {
+		f.Thaw()
+		Debug("Clock thawed")
+		jsonResp(w, &ClockResponse{Frozen: false}, 200)
+	}
+}
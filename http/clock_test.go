@@ -0,0 +1,63 @@
+package http
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"testing"
+	"time"
+)
+
+func TestClockFreeze(t *testing.T) {
+	r := require.New(t)
+	// Wall clock can't be frozen
+	td, svr := startServer()
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	r.Equal(501, HttpErrorCode(cli.FreezeClock()))
+	stopServer(td, svr)
+	td = ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, ticket.NewFreezableClock(nil))
+	td.Start()
+	svr = StartServer("localhost:8080", td)
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+	r.NoError(cli.FreezeClock())
+	status, err := cli.GetStatus()
+	r.NoError(err)
+	r.True(status.ClockFrozen)
+	frozenAt := status.ClockTime
+	time.Sleep(50 * time.Millisecond)
+	r.True(td.Now().Equal(frozenAt))
+	r.NoError(cli.ThawClockContext(context.Background()))
+	status, err = cli.GetStatus()
+	r.NoError(err)
+	r.False(status.ClockFrozen)
+}
+
+func TestClockFreezeFollower(t *testing.T) {
+	r := require.New(t)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, ticket.NewFreezableClock(nil))
+	td.Start()
+	svr := StartServer("localhost:8080", td)
+	defer stopServer(td, svr)
+	ftd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, ticket.NewFreezableClock(nil))
+	ftd.Follow("http://localhost:8080")
+	ftd.Start()
+	fsvr := StartServer("localhost:8081", ftd)
+	defer stopServer(ftd, fsvr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	fcli := NewClient("http://localhost:8081", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// Freezing through a follower freezes the leader, which is the clock that stamps and expires sessions
+	r.NoError(fcli.FreezeClock())
+	status, err := cli.GetStatus()
+	r.NoError(err)
+	r.True(status.ClockFrozen)
+	status, err = fcli.GetStatus()
+	r.NoError(err)
+	r.False(status.ClockFrozen)
+	r.NoError(fcli.ThawClock())
+	status, err = cli.GetStatus()
+	r.NoError(err)
+	r.False(status.ClockFrozen)
+}
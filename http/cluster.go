@@ -0,0 +1,158 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/julienschmidt/httprouter"
+	"github.com/turbosquid/ticketd/ticket"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Headers describing the original caller of a request forwarded to the leader. They are taken off every request
+// before routing, and only believed from a cluster peer (a caller with RolePeer)
+const (
+	forwardedForHeader       = "X-Ticketd-Forwarded-For"       // Address of the caller
+	forwardedPrincipalHeader = "X-Ticketd-Forwarded-Principal" // Who the forwarding node authenticated the caller as
+)
+
+// Header listing the nodes a request has been forwarded through, by node id
+const forwardedByHeader = "X-Ticketd-Forwarded-By"
+
+// What a request says about the caller it was forwarded for
+type forwarded struct {
+	addr      string // Address of the original caller
+	principal string // Principal of the original caller. Empty if the forwarding node does not authenticate
+	trusted   bool   // Set by authorize if a cluster peer sent the request
+}
+
+type forwardedKeyType struct{}
+
+var forwardedKey forwardedKeyType
+
+// Random id for a server, so it can tell when a request it forwarded comes back to it
+func newNodeId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("Unable to make a node id: %s", err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Take the forwarding headers off a request before it is routed, so nothing believes what a caller says about itself.
+// authorize trusts them again if the request comes from a cluster peer
+func takeForwarded(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := &forwarded{addr: r.Header.Get(forwardedForHeader), principal: r.Header.Get(forwardedPrincipalHeader)}
+		if f.addr != "" || f.principal != "" {
+			r.Header.Del(forwardedForHeader)
+			r.Header.Del(forwardedPrincipalHeader)
+			r = r.WithContext(context.WithValue(r.Context(), forwardedKey, f))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Trust the forwarding headers on a request from p, if p is a cluster peer. Returns who the request acts for: the
+// caller the peer forwarded it for, if the peer says, else p. The peer authenticated that caller, and checked it has
+// role, before forwarding
+func trustForwarded(r *http.Request, p *Principal, role string) *Principal {
+	f, _ := r.Context().Value(forwardedKey).(*forwarded)
+	if f == nil || !p.IsPeer() {
+		return p
+	}
+	f.trusted = true
+	if f.principal != "" {
+		return newPrincipal(f.principal, "", []string{role})
+	}
+	return p
+}
+
+// Forward a request to the cluster leader. If the node we forward to is not the leader either, it forwards the
+// request on. A request that comes back to a node it has already been through gets a 503, and the client can retry
+func forwardToLeader(leader string, opts *ServerOptions, w http.ResponseWriter, r *http.Request) {
+	via := r.Header.Get(forwardedByHeader)
+	for _, id := range strings.Split(via, ",") {
+		if strings.TrimSpace(id) == opts.nodeId {
+			http.Error(w, "Not the leader", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	target, err := url.Parse(leader)
+	if err != nil {
+		http.Error(w, "Bad leader url: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if opts.peerTransport != nil {
+		proxy.Transport = opts.peerTransport
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Unable to forward request to leader %s: %s", leader, err.Error())
+		http.Error(w, "Unable to reach leader", http.StatusServiceUnavailable)
+	}
+	if via != "" {
+		via += ", "
+	}
+	r.Header.Set(forwardedByHeader, via+opts.nodeId)
+	r.Header.Set(forwardedForHeader, clientAddr(r))
+	if p := RequestPrincipal(r); p != nil {
+		r.Header.Set(forwardedPrincipalHeader, p.Name)
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// Address of the client that made a request, looking through forwarding by cluster peers
+func clientAddr(r *http.Request) string {
+	if f, _ := r.Context().Value(forwardedKey).(*forwarded); f != nil && f.trusted {
+		return f.addr
+	}
+	return r.RemoteAddr
+}
+
+// List cluster members
+func getClusterMembers(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	members, err := td.Members()
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
+	jsonResp(w, members, 200)
+}
+
+// Add a cluster member
+func postClusterMembers(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := getSingleQueryParam(r.URL, "id", "")
+	addr := getSingleQueryParam(r.URL, "addr", "")
+	if id == "" {
+		http.Error(w, "Missing member id", http.StatusUnprocessableEntity)
+		return
+	}
+	if addr == "" {
+		http.Error(w, "Missing member address", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := td.AddMember(id, addr); err != nil {
+		apiErr(w, err)
+		return
+	}
+	jsonResp(w, "Ok", 200)
+}
+
+// Remove a cluster member
+func deleteClusterMembers(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := getSingleQueryParam(r.URL, "id", "")
+	if id == "" {
+		http.Error(w, "Missing member id", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := td.RemoveMember(id); err != nil {
+		apiErr(w, err)
+		return
+	}
+	jsonResp(w, "Ok", 200)
+}
@@ -0,0 +1,128 @@
+package http
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A committer for a node that is never the leader
+type followerCommitter struct {
+	leader string
+}
+
+func (c *followerCommitter) Commit(cmd *ticket.Command) *ticket.Result {
+	return &ticket.Result{Err: fmt.Errorf("leader is %s (%w)", c.leader, ticket.ErrNotLeader)}
+}
+
+func (c *followerCommitter) IsLeader() bool {
+	return false
+}
+
+func (c *followerCommitter) Leader() string {
+	return c.leader
+}
+
+func TestLeaderForwarding(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	ftd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	ftd.Start()
+	ftd.SetCommitter(&followerCommitter{"http://localhost:8080"})
+	fsvr := StartServer("localhost:8081", ftd)
+	defer stopServer(ftd, fsvr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	fcli := NewClient("http://localhost:8081", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// Mutations are forwarded to the leader
+	sess, err := fcli.OpenSession("forwarded", 5000)
+	r.NoError(err)
+	ok, err := sess.Lock("lock")
+	r.NoError(err)
+	r.True(ok)
+	resources, err := cli.GetResources("lock")
+	r.NoError(err)
+	r.Equal(sess.Id, resources["lock"].Tickets["lock"].Issuer.Id)
+	// Dumps are answered locally
+	sessions, err := fcli.GetSessions()
+	r.NoError(err)
+	r.Empty(sessions)
+	status, err := fcli.GetStatus()
+	r.NoError(err)
+	r.True(status.Clustered)
+	r.Equal("follower", status.Role)
+	// Our stub committer does not support membership changes
+	_, err = fcli.GetMembers()
+	r.Equal(501, HttpErrorCode(err))
+}
+
+func TestLeaderForwardingLoop(t *testing.T) {
+	r := require.New(t)
+	// A node that thinks it is its own leader's follower must not forward forever
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	td.SetCommitter(&followerCommitter{"http://localhost:8080"})
+	svr := StartServer("localhost:8080", td)
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	_, err := cli.OpenSession("loop", 5000)
+	r.Equal(503, HttpErrorCode(err))
+	// Nor may two nodes that each think the other is the leader
+	otd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	otd.Start()
+	otd.SetCommitter(&followerCommitter{"http://localhost:8080"})
+	osvr := StartServer("localhost:8081", otd)
+	defer stopServer(otd, osvr)
+	td.SetCommitter(&followerCommitter{"http://localhost:8081"})
+	time.Sleep(10 * time.Millisecond)
+	_, err = cli.OpenSession("loop", 5000)
+	r.Equal(503, HttpErrorCode(err))
+}
+
+// Credentials that also say the request was forwarded for addr
+type forwardedFor struct {
+	Credentials
+	addr string
+}
+
+func (f *forwardedFor) Apply(req *http.Request) error {
+	req.Header.Set(forwardedForHeader, f.addr)
+	return applyCredentials(f.Credentials, req)
+}
+
+func TestForwardedFor(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath,
+		&Key{Id: "app", Secret: "app-secret", Roles: []string{RoleApi, RoleDump}},
+		&Key{Id: "ops", Secret: "ops-secret", Roles: []string{RoleAll}},
+		&Key{Id: "node", Secret: "node-secret", Roles: []string{RoleApi, RoleDump, RolePeer}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{Auth: auth})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	src := func(key string) string {
+		cli := NewClient("http://localhost:8080", 1*time.Second)
+		cli.Credentials = &forwardedFor{BearerToken(key + "-secret"), "10.1.2.3:4567"}
+		sess, err := cli.OpenSession(key, 5000)
+		r.NoError(err)
+		sessions, err := cli.GetSessions()
+		r.NoError(err)
+		return sessions[sess.Id].Src
+	}
+	// Callers can't choose their own address, even with every role
+	r.True(strings.HasPrefix(src("app"), "127.0.0.1:"))
+	r.True(strings.HasPrefix(src("ops"), "127.0.0.1:"))
+	// Cluster peers say who they forward for
+	r.Equal("10.1.2.3:4567", src("node"))
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+//
+// Credentials attach themselves to api requests
+type Credentials interface {
+	Apply(req *http.Request) error
+}
+
+//
+// Bearer token credentials. The token is the secret of a key in the server's key file
+type BearerToken string
+
+//
+// HMAC credentials. Requests are signed with the secret, which never goes over the wire. The signature covers the
+// method, uri, a timestamp, a random nonce, the Session-Token and Idempotency-Key headers, and the body. Sign a
+// request after setting those headers
+type HMACKey struct {
+	Id     string
+	Secret string
+}
+
+func (t BearerToken) Apply(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+func (k *HMACKey) Apply(req *http.Request) (err error) {
+	body := []byte{}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if body, err = ioutil.ReadAll(rc); err != nil {
+			return err
+		}
+	} else if req.Body != nil {
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signature([]byte(k.Secret), req, ts, hex.EncodeToString(nonce), body)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Key=%s, Timestamp=%s, Nonce=%s, Signature=%s", hmacScheme, k.Id,
+		ts, hex.EncodeToString(nonce), hex.EncodeToString(sig)))
+	return
+}
+
+//
+// Credentials from the environment: a bearer token in TICKETD_TOKEN, or a HMAC key in TICKETD_KEY_ID and
+// TICKETD_KEY_SECRET. Nil if neither is set
+func CredentialsFromEnv() Credentials {
+	if token := os.Getenv("TICKETD_TOKEN"); token != "" {
+		return BearerToken(token)
+	}
+	if id, secret := os.Getenv("TICKETD_KEY_ID"), os.Getenv("TICKETD_KEY_SECRET"); id != "" && secret != "" {
+		return &HMACKey{Id: id, Secret: secret}
+	}
+	return nil
+}
+
+// Attach credentials to a request, if we have any
+func applyCredentials(creds Credentials, req *http.Request) error {
+	if creds == nil {
+		return nil
+	}
+	return creds.Apply(req)
+}
+
+// Redirect policy for clients with credentials. Credentials are applied again on redirect (Go drops the
+// Authorization header when redirected to another host, and a signature only covers the original uri)
+func redirectWithCredentials(creds func() Credentials) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return applyCredentials(creds(), req)
+	}
+}
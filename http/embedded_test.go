@@ -0,0 +1,72 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"testing"
+	"time"
+)
+
+// Exercise a ticket.Client. Written once, run against both the http and the local client
+func exerciseClient(r *require.Assertions, c ticket.Client, resource string) {
+	ctx := context.Background()
+	issuer, err := c.NewSession(ctx, "issuer", 5000)
+	r.NoError(err)
+	defer issuer.Close()
+	claimant, err := c.NewSession(ctx, "claimant", 5000)
+	r.NoError(err)
+	defer claimant.Close()
+	sess, err := claimant.Get()
+	r.NoError(err)
+	r.Equal(claimant.SessionId(), sess.Id)
+	r.NoError(issuer.IssueTicket(resource, "ticket-1", []byte("FOO")))
+	ok, tick, err := claimant.ClaimTicket(resource)
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("ticket-1", tick.Name)
+	ok, err = claimant.HasTicket(resource, "ticket-1")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(claimant.ReleaseTicket(resource, "ticket-1"))
+	res, err := issuer.SyncTickets(resource, map[string][]byte{"ticket-2": nil})
+	r.NoError(err)
+	r.Equal([]string{"ticket-2"}, res.Issued)
+	r.Equal([]string{"ticket-1"}, res.Revoked)
+	ok, err = claimant.Lock(resource+"-lock")
+	r.NoError(err)
+	r.True(ok)
+	ok, err = issuer.Lock(resource+"-lock")
+	r.NoError(err)
+	r.False(ok)
+	r.NoError(claimant.Unlock(resource+"-lock"))
+	// A missing session looks the same from both clients
+	r.NoError(issuer.Close())
+	err = issuer.Refresh()
+	r.True(errors.Is(err, ticket.ErrNotFound), "got %v", err)
+}
+
+func TestClientInterface(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	t.Run("http", func(t *testing.T) {
+		exerciseClient(require.New(t), NewClient("http://localhost:8080", 1*time.Second), "http")
+	})
+	t.Run("local", func(t *testing.T) {
+		exerciseClient(require.New(t), ticket.NewLocalClient(td), "local")
+	})
+	violations, err := NewClient("http://localhost:8080", 1*time.Second).CheckInvariants()
+	r.NoError(err)
+	r.Empty(violations)
+	// Local heartbeats keep a session alive
+	c := ticket.NewLocalClient(td)
+	sess, err := c.OpenSession("beating", 200)
+	r.NoError(err)
+	sess.RunHeartbeat(50*time.Millisecond, 50*time.Millisecond, false, func(err error) {})
+	time.Sleep(500 * time.Millisecond)
+	r.NoError(sess.Refresh())
+	r.NoError(sess.Close())
+}
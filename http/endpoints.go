@@ -0,0 +1,84 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to steer clear of an endpoint after it fails
+const endpointDownTime = 5 * time.Second
+
+//
+// Server endpoints a client talks to. Calls go to the current endpoint; when it fails we move on to the next one
+// that has not failed recently. Shared by copies of a client (e.g. heartbeats)
+type endpoints struct {
+	sync.Mutex
+	urls      []string
+	current   int
+	downUntil []time.Time
+}
+
+func newEndpoints(urls []string) (e *endpoints) {
+	e = &endpoints{urls: make([]string, len(urls)), downUntil: make([]time.Time, len(urls))}
+	for i, u := range urls {
+		e.urls[i] = strings.TrimRight(u, "/")
+	}
+	return
+}
+
+// Get the endpoint to use. If every endpoint is down we use the current one anyway
+func (e *endpoints) pick() (i int, url string) {
+	e.Lock()
+	defer e.Unlock()
+	now := time.Now()
+	for n := 0; n < len(e.urls); n++ {
+		i = (e.current + n) % len(e.urls)
+		if e.downUntil[i].Before(now) {
+			e.current = i
+			return i, e.urls[i]
+		}
+	}
+	return e.current, e.urls[e.current]
+}
+
+// Mark an endpoint as failed, and move on from it
+func (e *endpoints) failed(i int) {
+	e.Lock()
+	defer e.Unlock()
+	e.downUntil[i] = time.Now().Add(endpointDownTime)
+	if e.current == i {
+		e.current = (i + 1) % len(e.urls)
+	}
+}
+
+// Mark an endpoint as working
+func (e *endpoints) ok(i int) {
+	e.Lock()
+	defer e.Unlock()
+	e.downUntil[i] = time.Time{}
+}
+
+// Switch to an endpoint by url (for instance, the leader we were redirected to), if it is one of ours
+func (e *endpoints) use(url string) {
+	e.Lock()
+	defer e.Unlock()
+	for i, u := range e.urls {
+		if u == url {
+			e.current = i
+			e.downUntil[i] = time.Time{}
+			return
+		}
+	}
+}
+
+// Base url of the server that actually answered a request, after any redirects
+func answeredBy(resp *http.Response) string {
+	return resp.Request.URL.Scheme + "://" + resp.Request.URL.Host
+}
+
+// Do the status code mean this node could not serve us, but another node may?
+func isUnavailable(code int) bool {
+	return code == http.StatusServiceUnavailable || code == http.StatusBadGateway || code == http.StatusGatewayTimeout
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"testing"
+	"time"
+)
+
+func TestFailoverUnreachable(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	// Nothing listens on 8089
+	cli := NewFailoverClient([]string{"http://localhost:8089", "http://localhost:8080"}, 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// Opening a session is not idempotent, but it is safe to retry when we could not connect
+	sess, err := cli.OpenSession("failover", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("test", "ticket-1", []byte("FOO")))
+	ok, tick, err := sess.ClaimTicket("test")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("ticket-1", tick.Name)
+	// A single endpoint client gives up right away
+	cli = NewClient("http://localhost:8089", 1*time.Second)
+	_, err = cli.OpenSession("nope", 5000)
+	r.Error(err)
+	r.Equal(0, HttpErrorCode(err))
+	// No endpoints at all is an error, not an empty success
+	cli = NewFailoverClient(nil, 1*time.Second)
+	_, err = cli.OpenSession("nope", 5000)
+	r.True(errors.Is(err, ErrNoEndpoints))
+	_, err = cli.GetSessions()
+	r.True(errors.Is(err, ErrNoEndpoints))
+}
+
+func TestFailoverHeartbeat(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	leaderStopped := false
+	defer func() {
+		if !leaderStopped {
+			stopServer(td, svr)
+		}
+	}()
+	ftd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	ftd.Follow("http://localhost:8080")
+	ftd.Start()
+	follower := StartFollower(ftd, 500*time.Millisecond)
+	fsvr := StartServer("localhost:8081", ftd)
+	defer func() {
+		stopServer(ftd, fsvr)
+	}()
+	defer follower.Stop()
+	cli := NewFailoverClient([]string{"http://localhost:8081", "http://localhost:8080"}, 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// The follower redirects us to the leader, and we stick with the leader after that
+	sess, err := cli.OpenSession("heartbeat", 1500)
+	r.NoError(err)
+	_, base := cli.endpoints.pick()
+	r.Equal("http://localhost:8080", base)
+	ok, err := sess.Lock("lock")
+	r.NoError(err)
+	r.True(ok)
+	hbErrChan := make(chan error, 1)
+	sess.RunHeartbeat(200*time.Millisecond, 200*time.Millisecond, true, func(err error) { hbErrChan <- err })
+	// Kill the leader. The follower takes over and our heartbeats keep the session alive well past its ttl
+	time.Sleep(300 * time.Millisecond)
+	stopServer(td, svr)
+	leaderStopped = true
+	time.Sleep(4 * time.Second)
+	_, base = cli.endpoints.pick()
+	r.Equal("http://localhost:8081", base)
+	ok, err = sess.Lock("lock")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(sess.Close())
+	r.NoError(<-hbErrChan)
+}
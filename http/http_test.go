@@ -2,11 +2,13 @@ package http
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"github.com/turbosquid/ticketd/ticket"
 	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -184,6 +186,37 @@ func TestTickets(t *testing.T) {
 	r.Nil(ticket)
 }
 
+func TestSyncTickets(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	claimant, err := cli.OpenSession("claimant", 5000)
+	r.NoError(err)
+	res, err := issuer.SyncTickets("test", map[string][]byte{"ticket-1": []byte("FOO"), "ticket-2": []byte("BAR")})
+	r.NoError(err)
+	r.Equal([]string{"ticket-1", "ticket-2"}, res.Issued)
+	ok, tick, err := claimant.ClaimTicket("test")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("ticket-1", tick.Name)
+	res, err = issuer.SyncTickets("test", map[string][]byte{"ticket-1": []byte("FOO"), "ticket-3": []byte("BAZ")})
+	r.NoError(err)
+	r.Equal([]string{"ticket-3"}, res.Issued)
+	r.Equal([]string{"ticket-2"}, res.Revoked)
+	r.Equal([]string{"ticket-1"}, res.Unchanged)
+	r.Empty(res.Updated)
+	ok, err = claimant.HasTicket("test", "ticket-1")
+	r.NoError(err)
+	r.True(ok)
+	// Ticket data is limited to 1K
+	_, err = issuer.SyncTickets("test", map[string][]byte{"ticket-1": make([]byte, 2048)})
+	r.Equal(413, HttpErrorCode(err))
+}
+
 func TestLocks(t *testing.T) {
 	r := require.New(t)
 	td, svr := startServer()
@@ -228,6 +261,8 @@ func TestDump(t *testing.T) {
 	r.NoError(err)
 	r.NotNil(sessions)
 	r.Equal(2, len(sessions))
+	r.False(sessions[session1.Id].CreatedAt.IsZero())
+	r.Equal(sessions[session1.Id].LastRefreshedAt.Add(100*time.Millisecond), sessions[session1.Id].ExpiresAt)
 	session1.IssueTicket("test", "ticket-1", []byte("FOO"))
 	session1.IssueTicket("test", "ticket-2", []byte("FOO"))
 	session2.IssueTicket("test2", "ticket-1", []byte("FOO"))
@@ -241,6 +276,7 @@ func TestDump(t *testing.T) {
 	r.NotNil(resources["test2"])
 	r.Equal(2, len(resources["test"].Tickets))
 	r.Equal(3, len(resources["test2"].Tickets))
+	r.False(resources["test"].Tickets["ticket-1"].CreatedAt.IsZero())
 	// Dump a specific resource
 	resource, err := cli.GetResources("test2")
 	r.NoError(err)
@@ -252,9 +288,222 @@ func TestDump(t *testing.T) {
 	dumpResources(t, resources)
 }
 
+func TestNamespaces(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	teamA, teamB := NewClient("http://localhost:8080", 1*time.Second), NewClient("http://localhost:8080", 1*time.Second)
+	teamA.Namespace, teamB.Namespace = "team-a", "team-b"
+	sessA, err := teamA.OpenSession("a", 5000)
+	r.NoError(err)
+	sessB, err := teamB.OpenSession("b", 5000)
+	r.NoError(err)
+	r.NoError(sessA.IssueTicket("db", "t1", []byte("a")))
+	r.NoError(sessB.IssueTicket("db", "t1", []byte("b")))
+	ok, tk, err := sessB.ClaimTicket("db")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("b", string(tk.Data))
+	// Resource names can't reach into another namespace
+	sess, err := NewClient("http://localhost:8080", 1*time.Second).OpenSession("default", 5000)
+	r.NoError(err)
+	_, _, err = sess.ClaimTicket("team-a%00db")
+	r.Equal(400, HttpErrorCode(err))
+
+	// Dumps are scoped to the namespace, and /api/v1 is the default namespace
+	resources, err := teamA.GetResources("db")
+	r.NoError(err)
+	r.Equal("a", string(resources["db"].Tickets["t1"].Data))
+	r.Equal("team-a", resources["db"].Namespace)
+	sessions, err := teamB.GetSessions()
+	r.NoError(err)
+	r.Len(sessions, 1)
+	r.NotNil(sessions[sessB.Id])
+	resources, err = NewClient("http://localhost:8080", 1*time.Second).GetResources("")
+	r.NoError(err)
+	r.Empty(resources)
+
+	// A session is not found outside its namespace
+	sessA.c = teamB
+	r.Equal(404, HttpErrorCode(sessA.Refresh()))
+	teamA.Namespace = "bad namespace!"
+	_, err = teamA.OpenSession("bad", 5000)
+	r.Equal(400, HttpErrorCode(err))
+}
+
+func TestQuotas(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	td.SetQuotas(&ticket.QuotaConfig{Default: &ticket.Quotas{SessionsPerOwner: 1}})
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	_, err := cli.OpenSession("first", 5000)
+	r.NoError(err)
+	_, err = cli.OpenSession("second", 5000)
+	r.Equal(429, HttpErrorCode(err))
+	r.True(errors.Is(err, ticket.ErrQuotaExceeded))
+	// Saying the request was forwarded for another host doesn't make it someone else's session
+	cli.Credentials = &forwardedFor{addr: "10.0.0.1:1234"}
+	_, err = cli.OpenSession("spoofed", 5000)
+	r.True(errors.Is(err, ticket.ErrQuotaExceeded))
+	cli.Credentials = nil
+	usage, err := cli.GetUsage()
+	r.NoError(err)
+	r.Equal(1, usage[ticket.DefaultNamespace].SessionsByOwner["127.0.0.1"])
+	r.Equal(1, usage[ticket.DefaultNamespace].Quotas.SessionsPerOwner)
+}
+
+func TestForcedOperations(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	cli.Namespace = "team-a"
+	stuck, err := cli.OpenSession("stuck", 5000)
+	r.NoError(err)
+	other, err := cli.OpenSession("other", 5000)
+	r.NoError(err)
+	ok, err := stuck.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(cli.ForceUnlock("leader"))
+	ok, err = other.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(other.IssueTicket("jobs", "t1", nil))
+	ok, _, err = stuck.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(cli.ForceRelease("jobs", "t1"))
+	held, err := stuck.HasTicket("jobs", "t1")
+	r.NoError(err)
+	r.False(held)
+	r.NoError(cli.DeleteResource("jobs"))
+	r.Equal(404, HttpErrorCode(cli.DeleteResource("jobs")))
+	r.NoError(cli.ForceCloseSession(stuck.Id))
+	r.Equal(404, HttpErrorCode(stuck.Refresh()))
+	closed, err := cli.CloseSessions("", "127.0.0.1")
+	r.NoError(err)
+	r.Equal([]string{other.Id}, closed)
+	_, err = cli.CloseSessions("", "")
+	r.Equal(400, HttpErrorCode(err))
+}
+
+func TestAuditLog(t *testing.T) {
+	r := require.New(t)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	l, err := ticket.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), 1024*1024, 1)
+	r.NoError(err)
+	defer l.Close()
+	td.SetAuditLog(l)
+	td.Start()
+	svr := StartServer("localhost:8080", td)
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	sess, err := cli.OpenSession("audited", 5000)
+	r.NoError(err)
+	ok, err := sess.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(sess.IssueTicket("jobs", "t1", nil))
+	entries, err := cli.GetAuditLog(&ticket.AuditQuery{Resource: "leader"})
+	r.NoError(err)
+	r.Len(entries, 1)
+	r.Equal(ticket.OpLock, entries[0].Op)
+	r.Equal(sess.Id, entries[0].SessId)
+	r.Equal("audited", entries[0].SessName)
+	r.Equal(ticket.AuditOk, entries[0].Outcome)
+	entries, err = cli.GetAuditLog(&ticket.AuditQuery{SessId: sess.Id, Limit: 2})
+	r.NoError(err)
+	r.Len(entries, 2)
+	r.Equal(ticket.OpIssueTicket, entries[1].Op)
+	// Without an audit log there is nothing to query
+	td.SetAuditLog(nil)
+	_, err = cli.GetAuditLog(&ticket.AuditQuery{})
+	r.Equal(501, HttpErrorCode(err))
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// A repeated request to open a session gets the same session
+	id1, id2 := "", ""
+	h1, h2 := http.Header{}, http.Header{}
+	_, err := cli.callEndpoint(context.Background(), "POST", "/sessions?name=retry&ttl=5000", nil, &id1, "open-1", "", h1)
+	r.NoError(err)
+	_, err = cli.callEndpoint(context.Background(), "POST", "/sessions?name=retry&ttl=5000", nil, &id2, "open-1", "", h2)
+	r.NoError(err)
+	r.Equal(id1, id2)
+	r.NotEmpty(h1.Get(sessionTokenHeader))
+	r.Equal(h1.Get(sessionTokenHeader), h2.Get(sessionTokenHeader))
+	sessions, err := cli.GetSessions()
+	r.NoError(err)
+	r.Len(sessions, 1)
+	// A repeated claim gets the same ticket, and does not claim a second one
+	sess := &Session{c: cli, Id: id1, Token: h1.Get(sessionTokenHeader)}
+	r.NoError(sess.IssueTicket("test", "ticket-1", []byte("FOO")))
+	r.NoError(sess.IssueTicket("test", "ticket-2", []byte("BAR")))
+	tr1, tr2 := &TicketResponse{}, &TicketResponse{}
+	_, err = cli.callEndpoint(context.Background(), "POST", fmt.Sprintf("/claims/test?sessid=%s", sess.Id), nil, tr1, "claim-1", sess.Token, nil)
+	r.NoError(err)
+	_, err = cli.callEndpoint(context.Background(), "POST", fmt.Sprintf("/claims/test?sessid=%s", sess.Id), nil, tr2, "claim-1", sess.Token, nil)
+	r.NoError(err)
+	r.True(tr1.Claimed)
+	r.Equal(tr1.Ticket.Name, tr2.Ticket.Name)
+	ts, err := sess.Get()
+	r.NoError(err)
+	r.Len(ts.Tickets, 1)
+	// Reusing a request id for something else is an error
+	ok := false
+	_, err = cli.callEndpoint(context.Background(), "POST", fmt.Sprintf("/locks/lock?sessid=%s", sess.Id), nil, &ok, "claim-1", sess.Token, nil)
+	r.Equal(422, HttpErrorCode(err))
+}
+
+func TestClientContext(t *testing.T) {
+	r := require.New(t)
+	// A server that never answers in time
+	hung := &http.Server{Addr: "localhost:8082", Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})}
+	go hung.ListenAndServe()
+	defer hung.Shutdown(context.Background())
+	cli := NewClient("http://localhost:8082", 10*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cli.OpenSessionContext(ctx, "hung", 5000)
+	r.True(errors.Is(err, context.DeadlineExceeded))
+	r.Less(time.Since(start), 1*time.Second)
+	// The endpoint is not marked down because we gave up on it
+	_, base := cli.endpoints.pick()
+	r.Equal("http://localhost:8082", base)
+	r.True(cli.endpoints.downUntil[0].IsZero())
+	// A stopped ticketd is unavailable
+	td, svr := startServer()
+	defer svr.Shutdown(context.Background())
+	cli = NewClient("http://localhost:8080", 1*time.Second)
+	cli.Retries = 0
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	td.Quit()
+	_, err = cli.OpenSession("stopped", 5000)
+	r.Equal(503, HttpErrorCode(err))
+}
+
 func startServer() (td *ticket.TicketD, svr *http.Server) {
 	DebugFlag(true)
-	td = ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{*logLevel})
+	td = ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.SetCheckMode(ticket.CheckPanic)
 	td.Start()
 	svr = StartServer("localhost:8080", td)
 	return
@@ -0,0 +1,172 @@
+package http
+
+import (
+	"context"
+	"github.com/turbosquid/ticketd/ticket"
+	"sync"
+	"time"
+)
+
+// How often a lease checks that its claim or lock is still held, unless the session says otherwise
+const defaultLeaseWatchInterval = 1 * time.Second
+
+//
+// A claimed ticket or held lock. The lease's context is cancelled as soon as we notice the claim or lock is gone:
+// the ticket was revoked or re-issued, the session expired, or the lease was released. Leases are checked with the
+// server every Session.LeaseWatchInterval. Release and Close are idempotent and safe to call from any goroutine
+type Lease struct {
+	s        *Session
+	Resource string
+	Name     string         // Ticket name. Same as the resource for locks
+	IsLock   bool           // Lease on a lock rather than a ticket claim
+	Ticket   *ticket.Ticket // Claimed ticket. nil for locks
+	ctx      context.Context
+	cancel   context.CancelFunc
+	watchWg  sync.WaitGroup
+	once     sync.Once
+	err      error
+}
+
+// Create a lease and start watching it. sessLost (optional) is closed if the session is known to be lost
+func newLease(s *Session, resource, name string, isLock bool, tick *ticket.Ticket, sessLost chan interface{}) (l *Lease) {
+	l = &Lease{s: s, Resource: resource, Name: name, IsLock: isLock, Ticket: tick}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	interval := s.LeaseWatchInterval
+	if interval == 0 {
+		interval = defaultLeaseWatchInterval
+	}
+	l.watchWg.Add(1)
+	go l.watch(interval, sessLost)
+	return
+}
+
+//
+// Claim a ticket and hold it as a lease. lease is nil if no ticket is available
+func (s *Session) ClaimLease(resource string) (lease *Lease, err error) {
+	return s.ClaimLeaseContext(context.Background(), resource)
+}
+
+//
+// Same as ClaimLease, but gives up when ctx is done. ctx only bounds the claim, not the lease
+func (s *Session) ClaimLeaseContext(ctx context.Context, resource string) (lease *Lease, err error) {
+	return s.claimLease(ctx, resource, nil)
+}
+
+func (s *Session) claimLease(ctx context.Context, resource string, sessLost chan interface{}) (lease *Lease, err error) {
+	ok, tick, err := s.ClaimTicketContext(ctx, resource)
+	if err != nil || !ok {
+		return
+	}
+	lease = newLease(s, resource, tick.Name, false, tick, sessLost)
+	return
+}
+
+//
+// Lock a resource and hold the lock as a lease. lease is nil if the resource is locked by another session
+func (s *Session) LockLease(resource string) (lease *Lease, err error) {
+	return s.LockLeaseContext(context.Background(), resource)
+}
+
+//
+// Same as LockLease, but gives up when ctx is done. ctx only bounds the lock call, not the lease
+func (s *Session) LockLeaseContext(ctx context.Context, resource string) (lease *Lease, err error) {
+	ok, err := s.LockContext(ctx, resource)
+	if err != nil || !ok {
+		return
+	}
+	lease = newLease(s, resource, resource, true, nil, nil)
+	return
+}
+
+//
+// Context that is cancelled when the lease is lost or released
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+//
+// Release the claim (or unlock the lock). Only the first call does anything; later calls return the first
+// call's result
+func (l *Lease) Release() (err error) {
+	return l.ReleaseContext(context.Background())
+}
+
+//
+// Same as Release, but gives up when ctx is done
+func (l *Lease) ReleaseContext(ctx context.Context) (err error) {
+	l.once.Do(func() {
+		lost := l.ctx.Err() != nil
+		l.cancel()
+		l.watchWg.Wait()
+		if l.IsLock {
+			l.err = l.s.UnlockContext(ctx, l.Resource)
+		} else {
+			l.err = l.s.ReleaseTicketContext(ctx, l.Resource, l.Name)
+		}
+		if lost && HttpErrorCode(l.err) == 404 {
+			l.err = nil // Nothing left to release
+		}
+	})
+	return l.err
+}
+
+//
+// Same as Release. Lets a lease be used as an io.Closer
+func (l *Lease) Close() error {
+	return l.Release()
+}
+
+// Check that the lease is still ours until it is released. Cancels the lease context when it is lost
+func (l *Lease) watch(interval time.Duration, sessLost chan interface{}) {
+	defer l.watchWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-sessLost:
+			Debug("Session %s lost. Lease on %s (%s) lost", l.s.Id, l.Resource, l.Name)
+			l.cancel()
+			return
+		case <-ticker.C:
+			held, err := l.held()
+			if err == nil && !held {
+				Debug("Lease on %s (%s) lost", l.Resource, l.Name)
+				l.cancel()
+				return
+			}
+		}
+	}
+}
+
+// Is the lease still ours? Errors are only returned for transient failures
+func (l *Lease) held() (held bool, err error) {
+	if l.IsLock {
+		return lockHeld(l.ctx, l.s, l.Resource)
+	}
+	held, err = l.s.HasTicketContext(l.ctx, l.Resource, l.Name)
+	if lostHold(err) {
+		return false, nil
+	}
+	return
+}
+
+// Does the session hold the lock on a resource? Errors are only returned for transient failures
+func lockHeld(ctx context.Context, s *Session, resource string) (held bool, err error) {
+	held, err = s.HasLockContext(ctx, resource)
+	if lostHold(err) {
+		return false, nil
+	}
+	return
+}
+
+// Does an error checking a claim or lock mean it is gone for good? The session or resource is gone (404), or we
+// may no longer ask (401, 403)
+func lostHold(err error) bool {
+	switch HttpErrorCode(err) {
+	case 404, 401, 403:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	defer issuer.Close()
+	claimant, err := cli.OpenSession("claimant", 5000)
+	r.NoError(err)
+	defer claimant.Close()
+	claimant.LeaseWatchInterval = 50 * time.Millisecond
+	// Nothing to claim
+	lease, err := claimant.ClaimLease("test")
+	r.NoError(err)
+	r.Nil(lease)
+	r.NoError(issuer.IssueTicket("test", "ticket-1", []byte("FOO")))
+	lease, err = claimant.ClaimLease("test")
+	r.NoError(err)
+	r.NotNil(lease)
+	r.Equal("ticket-1", lease.Name)
+	r.Equal([]byte("FOO"), lease.Ticket.Data)
+	// Released leases are cancelled, and releasing again is harmless
+	r.NoError(lease.Release())
+	r.Error(lease.Context().Err())
+	r.NoError(lease.Close())
+	ok, err := claimant.HasTicket("test", "ticket-1")
+	r.NoError(err)
+	r.False(ok)
+	// Revoking the ticket cancels the lease
+	lease, err = claimant.ClaimLease("test")
+	r.NoError(err)
+	r.NoError(issuer.RevokeTicket("test", "ticket-1"))
+	select {
+	case <-lease.Context().Done():
+	case <-time.After(2 * time.Second):
+		r.Fail("revoked lease not cancelled")
+	}
+	r.NoError(lease.Release())
+}
+
+func TestLockLease(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// No heartbeat, so the session expires while we hold the lock
+	sess, err := cli.OpenSession("locker", 200)
+	r.NoError(err)
+	sess.LeaseWatchInterval = 50 * time.Millisecond
+	other, err := cli.OpenSession("other", 5000)
+	r.NoError(err)
+	defer other.Close()
+	lease, err := sess.LockLease("lock")
+	r.NoError(err)
+	r.NotNil(lease)
+	r.True(lease.IsLock)
+	otherLease, err := other.LockLease("lock")
+	r.NoError(err)
+	r.Nil(otherLease)
+	select {
+	case <-lease.Context().Done():
+	case <-time.After(3 * time.Second):
+		r.Fail("lease not cancelled when session expired")
+	}
+	// Nothing left to unlock
+	r.NoError(lease.Release())
+	otherLease, err = other.LockLease("lock")
+	r.NoError(err)
+	r.NotNil(otherLease)
+	r.NoError(otherLease.Close())
+}
@@ -0,0 +1,169 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//
+// A distributed mutex on a ticketd lock resource, held by a session. Mutex satisfies sync.Locker, and may be shared
+// by goroutines: Lock calls from the same process are queued locally before they go to the server (the server lets a
+// session take a lock it already holds).
+//
+// Lock and Unlock exist for sync.Locker. Prefer LockContext and UnlockContext, which report errors. While the mutex is
+// held it is checked every WatchInterval, and the channel returned by Lost is closed if the lock (or its session)
+// is lost. The session should be kept alive with a heartbeat while the mutex is held
+type Mutex struct {
+	s             *Session
+	resource      string
+	MinBackoff    time.Duration // First wait between lock attempts
+	MaxBackoff    time.Duration // Longest wait between lock attempts
+	WatchInterval time.Duration // How often we check that a held lock is still ours
+	sem           chan interface{}
+	mu            sync.Mutex
+	lost          chan interface{}
+	stopWatch     context.CancelFunc
+	watchWg       sync.WaitGroup
+}
+
+//
+// Create a mutex on a lock resource for a session
+func NewMutex(s *Session, resource string) (m *Mutex) {
+	m = &Mutex{s: s, resource: resource, MinBackoff: 10 * time.Millisecond, MaxBackoff: 1 * time.Second,
+		WatchInterval: 1 * time.Second, sem: make(chan interface{}, 1)}
+	return
+}
+
+//
+// Acquire the lock, waiting as long as it takes. Panics if the lock can't be acquired (for instance, because the
+// session is gone). Use LockContext to get errors instead
+func (m *Mutex) Lock() {
+	if err := m.LockContext(context.Background()); err != nil {
+		panic(fmt.Sprintf("ticketd: unable to lock %s: %s", m.resource, err.Error()))
+	}
+}
+
+//
+// Acquire the lock, retrying with backoff until we get it or ctx is done. Transient errors (the server is
+// unreachable or has no leader) are retried too
+func (m *Mutex) LockContext(ctx context.Context) (err error) {
+	select {
+	case m.sem <- nil:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	backoff := m.MinBackoff
+	for {
+		ok := false
+		ok, err = m.s.LockContext(ctx, m.resource)
+		if err == nil && ok {
+			m.held()
+			return
+		}
+		if code := HttpErrorCode(err); err != nil && ctx.Err() == nil && code != 0 && !isUnavailable(code) {
+			<-m.sem
+			return
+		}
+		// Jitter, so waiters don't all retry at once
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			<-m.sem
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > m.MaxBackoff {
+			backoff = m.MaxBackoff
+		}
+	}
+}
+
+//
+// Try to acquire the lock once, without waiting. ok is true if we got it
+func (m *Mutex) TryLock() (ok bool, err error) {
+	return m.TryLockContext(context.Background())
+}
+
+//
+// Same as TryLock, but gives up when ctx is done
+func (m *Mutex) TryLockContext(ctx context.Context) (ok bool, err error) {
+	select {
+	case m.sem <- nil:
+	default:
+		return false, nil // Held by another goroutine
+	}
+	if ok, err = m.s.LockContext(ctx, m.resource); err != nil || !ok {
+		<-m.sem
+		return
+	}
+	m.held()
+	return
+}
+
+//
+// Release the lock. Panics if the mutex is not locked, like sync.Mutex. Server errors are ignored: the server
+// releases the lock anyway when the session ends. Use UnlockContext to get errors
+func (m *Mutex) Unlock() {
+	m.UnlockContext(context.Background())
+}
+
+//
+// Release the lock. Panics if the mutex is not locked. The mutex is unlocked locally even if the server call fails
+func (m *Mutex) UnlockContext(ctx context.Context) (err error) {
+	m.mu.Lock()
+	stop := m.stopWatch
+	m.stopWatch = nil
+	m.lost = nil
+	m.mu.Unlock()
+	if stop == nil {
+		panic("ticketd: unlock of unlocked mutex")
+	}
+	stop()
+	m.watchWg.Wait()
+	err = m.s.UnlockContext(ctx, m.resource)
+	<-m.sem
+	return
+}
+
+//
+// Channel that is closed if the lock is lost while we hold it -- the session expired, or the lock was taken from us.
+// Returns nil if the mutex is not locked
+func (m *Mutex) Lost() <-chan interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lost
+}
+
+// We hold the lock. Start watching it
+func (m *Mutex) held() {
+	ctx, cancel := context.WithCancel(context.Background())
+	lost := make(chan interface{})
+	m.mu.Lock()
+	m.lost = lost
+	m.stopWatch = cancel
+	m.mu.Unlock()
+	m.watchWg.Add(1)
+	go m.watch(ctx, lost)
+}
+
+// Check that we still hold the lock until cancelled. Close lost if we don't
+func (m *Mutex) watch(ctx context.Context, lost chan interface{}) {
+	defer m.watchWg.Done()
+	ticker := time.NewTicker(m.WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if held, err := lockHeld(ctx, m.s, m.resource); err == nil && !held {
+				Debug("Lost lock %s held by session %s", m.resource, m.s.Id)
+				close(lost)
+				return
+			}
+		}
+	}
+}
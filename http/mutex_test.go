@@ -0,0 +1,157 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMutex(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	sess1, err := cli.OpenSession("mutex 1", 5000)
+	r.NoError(err)
+	defer sess1.Close()
+	sess2, err := cli.OpenSession("mutex 2", 5000)
+	r.NoError(err)
+	defer sess2.Close()
+	m1 := NewMutex(sess1, "mutex")
+	m2 := NewMutex(sess2, "mutex")
+	var locker sync.Locker = m1
+	locker.Lock()
+	r.NotNil(m1.Lost())
+	ok, err := m2.TryLock()
+	r.NoError(err)
+	r.False(ok)
+	// Waiting gives up with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r.True(errors.Is(m2.LockContext(ctx), context.DeadlineExceeded))
+	// A waiter gets the lock once it is released
+	lockedChan := make(chan error)
+	go func() {
+		lockedChan <- m2.LockContext(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	locker.Unlock()
+	r.Nil(m1.Lost())
+	r.NoError(<-lockedChan)
+	r.NoError(m2.UnlockContext(context.Background()))
+	r.Panics(func() { m2.Unlock() })
+}
+
+func TestMutexGoroutines(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	sess, err := cli.OpenSession("mutex", 5000)
+	r.NoError(err)
+	defer sess.Close()
+	// Goroutines sharing a mutex (and a session) still exclude each other
+	m := NewMutex(sess, "mutex")
+	inside := 0
+	maxInside := 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				m.Lock()
+				inside++
+				if inside > maxInside {
+					maxInside = inside
+				}
+				time.Sleep(time.Millisecond)
+				inside--
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.Equal(1, maxInside)
+}
+
+func TestMutexLost(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	// No heartbeat, so the session expires while we hold the lock
+	sess, err := cli.OpenSession("mutex", 200)
+	r.NoError(err)
+	m := NewMutex(sess, "mutex")
+	m.WatchInterval = 50 * time.Millisecond
+	r.NoError(m.LockContext(context.Background()))
+	select {
+	case <-m.Lost():
+	case <-time.After(3 * time.Second):
+		r.Fail("lost lock not detected")
+	}
+	// Unlocking a lost lock fails at the server, but the mutex is unlocked
+	r.Error(m.UnlockContext(context.Background()))
+	r.Nil(m.Lost())
+}
+
+func TestMutexLostWithAuth(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath,
+		&Key{Id: "app", Secret: "app-secret", Roles: []string{RoleApi}},
+		&Key{Id: "ops", Secret: "ops-secret", Roles: []string{RoleAll}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{Auth: auth})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+	// The app key can't dump resources, but can still watch its locks
+	app := NewClient("http://localhost:8080", 1*time.Second)
+	app.Credentials = BearerToken("app-secret")
+	ops := NewClient("http://localhost:8080", 1*time.Second)
+	ops.Credentials = BearerToken("ops-secret")
+	sess, err := app.OpenSession("mutex", 5000)
+	r.NoError(err)
+	defer sess.Close()
+	sess.LeaseWatchInterval = 50 * time.Millisecond
+	m := NewMutex(sess, "mutex")
+	m.WatchInterval = 50 * time.Millisecond
+	r.NoError(m.LockContext(context.Background()))
+	lease, err := sess.LockLease("lease")
+	r.NoError(err)
+	r.NotNil(lease)
+	time.Sleep(200 * time.Millisecond)
+	r.NotNil(m.Lost())
+	select {
+	case <-m.Lost():
+		r.Fail("held lock reported lost")
+	case <-lease.Context().Done():
+		r.Fail("held lease cancelled")
+	default:
+	}
+	// Taking the locks away is noticed
+	r.NoError(ops.ForceUnlock("mutex"))
+	r.NoError(ops.ForceUnlock("lease"))
+	select {
+	case <-m.Lost():
+	case <-time.After(3 * time.Second):
+		r.Fail("lost lock not detected")
+	}
+	select {
+	case <-lease.Context().Done():
+	case <-time.After(3 * time.Second):
+		r.Fail("lost lease not cancelled")
+	}
+}
@@ -0,0 +1,211 @@
+package http
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//
+// Keeps a desired set of tickets issued on a resource. The publisher issues tickets from its own session, kept alive
+// by a heartbeat. If the session is lost (and ticketd drops its tickets), the publisher opens a new session and issues
+// them again. Changes to the desired set are synced to the resource in one call: new tickets are issued, changed tickets
+// are updated and tickets not in the set are revoked, whoever issued them. The publisher also syncs every ResyncInterval,
+// in case its tickets were taken over or revoked by someone else. Set the exported fields before calling Start
+type Publisher struct {
+	c                 *Client
+	resource          string
+	Name              string          // Session name
+	SessionTtl        time.Duration   // Ttl of the publisher session
+	HeartbeatInterval time.Duration   // How often the session is refreshed
+	ResyncInterval    time.Duration   // How often we check the resource even when nothing changed
+	RetryInterval     time.Duration   // Wait after a failed reconcile
+	OnError           func(err error) // Optional. Called when a reconcile fails
+	mu                sync.Mutex
+	desired           map[string][]byte
+	version           int              // Bumped on every change to desired
+	syncedChan        chan interface{} // Closed when what is issued matches desired. Replaced on change
+	wakeChan          chan interface{}
+	stopChan          chan interface{}
+	stopOnce          sync.Once
+	wg                sync.WaitGroup
+}
+
+//
+// Create a publisher for a resource. The desired set starts out empty
+func NewPublisher(c *Client, resource string) (p *Publisher) {
+	p = &Publisher{c: c, resource: resource, Name: resource + " publisher", SessionTtl: 5 * time.Second,
+		HeartbeatInterval: 1 * time.Second, ResyncInterval: 5 * time.Second, RetryInterval: 1 * time.Second,
+		desired: make(map[string][]byte), syncedChan: make(chan interface{}), wakeChan: make(chan interface{}, 1),
+		stopChan: make(chan interface{})}
+	return
+}
+
+//
+// Replace the desired set of tickets. tickets maps ticket names to ticket data
+func (p *Publisher) Set(tickets map[string][]byte) {
+	p.mu.Lock()
+	p.desired = make(map[string][]byte, len(tickets))
+	for name, data := range tickets {
+		p.desired[name] = append([]byte{}, data...)
+	}
+	p.changed()
+	p.mu.Unlock()
+}
+
+//
+// Add a ticket to the desired set, or change its data
+func (p *Publisher) Add(name string, data []byte) {
+	p.mu.Lock()
+	p.desired[name] = append([]byte{}, data...)
+	p.changed()
+	p.mu.Unlock()
+}
+
+//
+// Remove a ticket from the desired set
+func (p *Publisher) Remove(name string) {
+	p.mu.Lock()
+	delete(p.desired, name)
+	p.changed()
+	p.mu.Unlock()
+}
+
+// The desired set changed. Must be called with p.mu held
+func (p *Publisher) changed() {
+	p.version++
+	if isClosed(p.syncedChan) {
+		p.syncedChan = make(chan interface{})
+	}
+	select {
+	case p.wakeChan <- nil:
+	default:
+	}
+}
+
+//
+// Wait until the issued tickets match the desired set, or ctx is done
+func (p *Publisher) WaitSynced(ctx context.Context) (err error) {
+	p.mu.Lock()
+	synced := p.syncedChan
+	p.mu.Unlock()
+	select {
+	case <-synced:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+//
+// Start publishing
+func (p *Publisher) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+//
+// Stop publishing, and close the publisher session. ticketd drops the session's tickets
+func (p *Publisher) Stop() {
+	p.stopOnce.Do(func() { close(p.stopChan) })
+	p.wg.Wait()
+}
+
+func (p *Publisher) report(err error) {
+	Debug("Publisher on %s: %s", p.resource, err.Error())
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+func (p *Publisher) run() {
+	defer p.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var sess *Session
+	var sessLost chan interface{}
+	defer func() {
+		if sess != nil {
+			sess.CloseContext(context.Background())
+		}
+	}()
+	ticker := time.NewTicker(p.ResyncInterval)
+	defer ticker.Stop()
+	for {
+		if sess != nil && isClosed(sessLost) {
+			sess.CloseContext(ctx) // Most likely gone already
+			sess = nil
+		}
+		wait := p.ResyncInterval
+		if sess == nil {
+			var err error
+			if sess, sessLost, err = p.openSession(ctx); err != nil {
+				p.report(err)
+				wait = p.RetryInterval
+			}
+		}
+		if sess != nil {
+			if err := p.reconcile(ctx, sess); err != nil {
+				p.report(err)
+				wait = p.RetryInterval
+				if HttpErrorCode(err) == 404 {
+					sess.CancelHeartBeat()
+					sess = nil
+				}
+			}
+		}
+		ticker.Reset(wait)
+		select {
+		case <-p.stopChan:
+			return
+		case <-sessLost:
+		case <-p.wakeChan:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Open a publisher session with a heartbeat. lost is closed if the heartbeat fails
+func (p *Publisher) openSession(ctx context.Context) (sess *Session, lost chan interface{}, err error) {
+	sess, err = p.c.OpenSessionContext(ctx, p.Name, int(p.SessionTtl/time.Millisecond))
+	if err != nil {
+		return
+	}
+	lost = make(chan interface{})
+	sess.RunHeartbeat(p.HeartbeatInterval, p.HeartbeatInterval, true, func(err error) {
+		if err != nil {
+			p.report(err)
+			close(lost)
+		}
+	})
+	return
+}
+
+// Bring the resource in line with the desired set in one sync: missing or changed tickets are issued, and tickets that
+// are no longer wanted are revoked
+func (p *Publisher) reconcile(ctx context.Context, sess *Session) (err error) {
+	p.mu.Lock()
+	desired := make(map[string][]byte, len(p.desired))
+	for name, data := range p.desired {
+		desired[name] = data
+	}
+	version := p.version
+	p.mu.Unlock()
+	if _, err = sess.SyncTicketsContext(ctx, p.resource, desired); err != nil {
+		return
+	}
+	// Only report in sync if the desired set did not change while we worked
+	p.mu.Lock()
+	if p.version == version && !isClosed(p.syncedChan) {
+		close(p.syncedChan)
+	}
+	p.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Names of the tickets on a resource issued by live sessions
+func issuedTickets(cli *Client, resource string) (names []string, issuer string) {
+	names = []string{}
+	resources, err := cli.GetResources(resource)
+	if err != nil {
+		return
+	}
+	for name, tick := range resources[resource].Tickets {
+		if tick.Issuer != nil {
+			names = append(names, name)
+			issuer = tick.Issuer.Id
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestPublisher(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	p := NewPublisher(cli, "jobs")
+	p.HeartbeatInterval = 50 * time.Millisecond
+	p.RetryInterval = 50 * time.Millisecond
+	p.Set(map[string][]byte{"job-a": []byte("A"), "job-b": []byte("B")})
+	p.Start()
+	defer p.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r.NoError(p.WaitSynced(ctx))
+	names, issuer := issuedTickets(cli, "jobs")
+	r.Equal([]string{"job-a", "job-b"}, names)
+	// Changes to the desired set are reconciled
+	p.Add("job-c", []byte("C"))
+	p.Remove("job-a")
+	r.NoError(p.WaitSynced(ctx))
+	names, _ = issuedTickets(cli, "jobs")
+	r.Equal([]string{"job-b", "job-c"}, names)
+	resources, err := cli.GetResources("jobs")
+	r.NoError(err)
+	r.Equal([]byte("C"), resources["jobs"].Tickets["job-c"].Data)
+	// Tickets someone else issued on the resource are revoked on the next sync
+	other, err := cli.OpenSession("other", 5000)
+	r.NoError(err)
+	defer other.Close()
+	r.NoError(other.IssueTicket("jobs", "stray", nil))
+	p.Add("job-c", []byte("C2"))
+	r.NoError(p.WaitSynced(ctx))
+	names, _ = issuedTickets(cli, "jobs")
+	r.Equal([]string{"job-b", "job-c"}, names)
+	// Lose the publisher session. The tickets come back under a new session
+	r.NoError(td.CloseSession(issuer))
+	deadline := time.Now().Add(3 * time.Second)
+	newIssuer := issuer
+	for time.Now().Before(deadline) {
+		if names, newIssuer = issuedTickets(cli, "jobs"); len(names) == 2 && newIssuer != issuer {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	r.Equal([]string{"job-b", "job-c"}, names)
+	r.NotEqual(issuer, newIssuer)
+	// Stopping closes the session
+	p.Stop()
+	names, _ = issuedTickets(cli, "jobs")
+	r.Empty(names)
+}
+
+func TestPublisherWithoutDump(t *testing.T) {
+	r := require.New(t)
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(r, keyPath, &Key{Id: "app", Secret: "app-secret", Roles: []string{RoleApi}})
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.SetPolicy(&ticket.Policy{Grants: []*ticket.Grant{
+		{Principal: "app", Verbs: []ticket.Verb{ticket.VerbIssue, ticket.VerbRevoke}, Resources: []string{"jobs"}},
+	}})
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{Auth: auth})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	cli.Credentials = BearerToken("app-secret")
+	_, err = cli.GetResources("jobs")
+	r.Equal(http.StatusForbidden, HttpErrorCode(err))
+	// The publisher only needs to issue and revoke
+	p := NewPublisher(cli, "jobs")
+	p.Set(map[string][]byte{"job-a": []byte("A")})
+	p.Start()
+	defer p.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r.NoError(p.WaitSynced(ctx))
+	r.Contains(td.GetResources()["jobs"].Tickets, "job-a")
+}
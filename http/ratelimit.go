@@ -0,0 +1,195 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/turbosquid/ticketd/ticket"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiting
+//
+// Everything a server does goes through one ticket loop, so one client calling in a tight loop slows everyone down.
+// A RateLimiter gives each caller a token bucket per route class. The caller is the principal, if the request is
+// authenticated, else the host it came from. Session ids in the request aren't used: they haven't been checked yet,
+// and a caller could name a new one with every request to get a fresh bucket. A request that finds its bucket
+// empty gets a 429 with a Retry-After header saying when to come back, and the Go client waits that long before it
+// retries. Route classes without a rate are not limited.
+
+// Routes that share a rate
+type RouteClass string
+
+const (
+	ClassSessions RouteClass = "sessions" // Opening, refreshing, closing and reading sessions
+	ClassTickets  RouteClass = "tickets"  // Issuing, revoking and syncing tickets
+	ClassClaims   RouteClass = "claims"   // Claiming, releasing and checking tickets
+	ClassLocks    RouteClass = "locks"    // Locking and unlocking
+	ClassDumps    RouteClass = "dumps"    // Dumping sessions and resources
+)
+
+var routeClasses = map[RouteClass]bool{ClassSessions: true, ClassTickets: true, ClassClaims: true, ClassLocks: true,
+	ClassDumps: true}
+
+const retryAfterHeader = "Retry-After"
+
+//
+// Returned (wrapped in an HttpError) for calls that were still rate limited after the client ran out of retries
+var ErrRateLimited = errors.New("rate limited")
+
+//
+// A token bucket rate
+type Rate struct {
+	PerSecond float64 // Requests per second, on average
+	Burst     int     // Requests that can be made at once. At least 1
+}
+
+//
+// Rates for route classes
+type RateLimits map[RouteClass]*Rate
+
+// A caller's bucket for one route class
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//
+// Rate limits requests. Safe for concurrent use
+type RateLimiter struct {
+	mu        sync.Mutex
+	limits    RateLimits
+	buckets   map[string]*bucket // Keyed by route class and caller
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+//
+// Load rate limits from a json file
+func LoadRateLimits(file string) (limits RateLimits, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &limits); err != nil {
+		return nil, fmt.Errorf("rate limits %s: %w", file, err)
+	}
+	if err = limits.Validate(); err != nil {
+		return nil, fmt.Errorf("rate limits %s: %w", file, err)
+	}
+	return
+}
+
+//
+// Check rate limits for unknown route classes and rates that would never let anything through
+func (limits RateLimits) Validate() error {
+	for class, rate := range limits {
+		if !routeClasses[class] {
+			return fmt.Errorf("unknown route class %q", class)
+		}
+		if rate != nil && (rate.PerSecond <= 0 || rate.Burst < 1) {
+			return fmt.Errorf("rate for %s needs a positive PerSecond and a Burst of at least 1", class)
+		}
+	}
+	return nil
+}
+
+//
+// Create a rate limiter
+func NewRateLimiter(limits RateLimits) (l *RateLimiter) {
+	l = &RateLimiter{limits: limits, buckets: make(map[string]*bucket), now: time.Now}
+	return
+}
+
+//
+// Change the rates. Callers keep the tokens they have, up to the new burst
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// Take a token from a caller's bucket for a route class. If there is none, wait says how long until there will be
+func (l *RateLimiter) take(class RouteClass, caller string) (ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.limits[class]
+	if rate == nil {
+		return true, 0
+	}
+	now := l.now()
+	l.sweep(now)
+	key := string(class) + " " + caller
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate.PerSecond * float64(time.Second))
+}
+
+// Forget buckets that have been idle long enough to fill up again. They are the same as new ones. Runs at most once
+// a minute
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= time.Minute {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Who a request counts against: its principal, else the host it came from. That is the host at the other end of the
+// connection, unless a cluster peer forwarded the request for someone else (see clientAddr)
+func rateLimitCaller(r *http.Request) string {
+	if principal, ok := ticket.ContextPrincipal(r.Context()); ok {
+		return "principal " + principal
+	}
+	addr := clientAddr(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "host " + addr
+}
+
+// Rate limit a route class. Limited requests get a 429 with a Retry-After header, in whole seconds
+func rateLimited(opts *ServerOptions, class RouteClass, handler handlerFunc) handlerFunc {
+	if opts.RateLimiter == nil {
+		return handler
+	}
+	return func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		caller := rateLimitCaller(r)
+		if ok, wait := opts.RateLimiter.take(class, caller); !ok {
+			Debug("Rate limited %s %s for %s", r.Method, r.URL.Path, caller)
+			w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too many %s requests from %s", class, caller), http.StatusTooManyRequests)
+			return
+		}
+		handler(td, w, r, params)
+	}
+}
+
+// How long a response asks us to wait before trying again. Zero if it doesn't say
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get(retryAfterHeader))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
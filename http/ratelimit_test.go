@@ -0,0 +1,86 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := require.New(t)
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(RateLimits{ClassClaims: {PerSecond: 2, Burst: 2}})
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		ok, _ := l.take(ClassClaims, "a")
+		r.True(ok)
+	}
+	ok, wait := l.take(ClassClaims, "a")
+	r.False(ok)
+	r.Equal(500*time.Millisecond, wait)
+	// Callers and route classes have buckets of their own, and classes without a rate are not limited
+	ok, _ = l.take(ClassClaims, "b")
+	r.True(ok)
+	for i := 0; i < 10; i++ {
+		ok, _ = l.take(ClassLocks, "a")
+		r.True(ok)
+	}
+	// Buckets refill over time
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.take(ClassClaims, "a")
+	r.True(ok)
+	ok, _ = l.take(ClassClaims, "a")
+	r.False(ok)
+	r.Error(RateLimits{"bogus": {PerSecond: 1, Burst: 1}}.Validate())
+	r.Error(RateLimits{ClassClaims: {PerSecond: 1}}.Validate())
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	r := require.New(t)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	limiter := NewRateLimiter(RateLimits{ClassClaims: {PerSecond: 1, Burst: 1}})
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{RateLimiter: limiter})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	sess, err := cli.OpenSession("limited", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("limited", "t1", nil))
+
+	// Out of retries, the 429 comes back
+	cli.Retries = 0
+	_, _, err = sess.ClaimTicket("limited")
+	r.NoError(err)
+	_, _, err = sess.ClaimTicket("limited")
+	r.Equal(429, HttpErrorCode(err))
+	r.True(errors.Is(err, ErrRateLimited))
+	r.Equal(time.Second, err.(*HttpError).RetryAfter)
+	// With retries, the client waits as long as it is told to
+	cli.Retries = 1
+	start := time.Now()
+	ok, _, err := sess.ClaimTicket("limited")
+	r.NoError(err)
+	r.True(ok)
+	r.True(time.Since(start) >= 900*time.Millisecond)
+	// Other route classes are not limited
+	for i := 0; i < 5; i++ {
+		r.NoError(sess.Refresh())
+	}
+	// Naming a different session with each request doesn't get a fresh bucket
+	cli.Retries = 0
+	for i := 0; i < 3; i++ {
+		bogus := &Session{c: cli, Id: fmt.Sprintf("bogus-%d", i), Token: "bogus"}
+		_, _, err = bogus.ClaimTicket("limited")
+		r.Equal(429, HttpErrorCode(err))
+	}
+	// Nor does claiming to be forwarded for a different address
+	for i := 0; i < 3; i++ {
+		cli.Credentials = &forwardedFor{addr: fmt.Sprintf("10.0.0.%d:1234", i)}
+		_, _, err = sess.ClaimTicket("limited")
+		r.Equal(429, HttpErrorCode(err))
+	}
+}
@@ -0,0 +1,266 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/turbosquid/ticketd/ticket"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replicationPingInterval = 250 * time.Millisecond
+	replicationTimeout      = 2 * time.Second // Drop the leader connection if we hear nothing for this long
+	replicationRetry        = 250 * time.Millisecond
+)
+
+//
+// Message sent on the replication stream. The stream is a series of json encoded messages, one per line.
+// The first message is always a "state" message, followed by "entry" messages for each applied command.
+// "ping" messages are sent when there is nothing else to send so followers can spot a dead leader
+type ReplicationMessage struct {
+	Type  string
+	State *ticket.ReplicaState
+	Entry *ticket.ReplicaEntry
+}
+
+// Stream state changes to a follower
+func getReplicationStream(shutdownChan chan interface{}) handlerFunc {
+	return func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		sub, err := td.SubscribeContext(r.Context())
+		if err != nil {
+			apiErr(w, err)
+			return
+		}
+		defer td.Unsubscribe(sub)
+		log.Printf("Follower %s subscribed at seq %d", r.RemoteAddr, sub.State.Seq)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(200)
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(&ReplicationMessage{Type: "state", State: sub.State}); err != nil {
+			return
+		}
+		flusher.Flush()
+		ticker := time.NewTicker(replicationPingInterval)
+		defer ticker.Stop()
+		for {
+			var msg *ReplicationMessage
+			select {
+			case entry, ok := <-sub.C:
+				if !ok {
+					log.Printf("Replication stream to %s closed", r.RemoteAddr)
+					return
+				}
+				msg = &ReplicationMessage{Type: "entry", Entry: entry}
+			case <-ticker.C:
+				msg = &ReplicationMessage{Type: "ping"}
+			case <-r.Context().Done():
+				return
+			case <-shutdownChan:
+				return
+			}
+			if err := enc.Encode(msg); err != nil {
+				log.Printf("Replication stream to %s failed: %s", r.RemoteAddr, err.Error())
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Promote this node to leader
+func postReplicationPromote(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if td.Clustered() {
+		http.Error(w, "Leadership is managed by the cluster", http.StatusConflict)
+		return
+	}
+	td.Promote()
+	jsonResp(w, "Ok", 200)
+}
+
+// Follow another leader
+func postReplicationFollow(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	leader := strings.TrimRight(getSingleQueryParam(r.URL, "leader", ""), "/")
+	if leader == "" {
+		http.Error(w, "Missing leader", http.StatusUnprocessableEntity)
+		return
+	}
+	if td.Clustered() {
+		http.Error(w, "Leadership is managed by the cluster", http.StatusConflict)
+		return
+	}
+	td.Follow(leader)
+	jsonResp(w, "Ok", 200)
+}
+
+//
+// Send requests to the leader when this node is not the leader. Followers of a leader redirect; members of a cluster
+// forward the request to the leader themselves
+func leaderOnly(opts *ServerOptions, handler handlerFunc) handlerFunc {
+	return func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if td.IsLeader() {
+			handler(td, w, r, params)
+			return
+		}
+		leader := td.Leader()
+		if leader == "" {
+			http.Error(w, "No leader available", http.StatusServiceUnavailable)
+			return
+		}
+		if !td.Clustered() {
+			http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		forwardToLeader(leader, opts, w, r)
+	}
+}
+
+//
+// Follower keeps a TicketD in sync with the leader it follows. It idles while the TicketD is the leader, so a node
+// can be pointed at a new leader (or promoted) at any time. If promoteAfter is non-zero, the follower promotes
+// its TicketD once the leader has been unreachable for that long. We only promote after a successful sync, so a
+// fresh follower never takes over with empty state. Followers do nothing for members of a cluster. If the leader
+// authenticates requests, the follower presents the credentials in its environment (see CredentialsFromEnv)
+type Follower struct {
+	td           *ticket.TicketD
+	promoteAfter time.Duration
+	client       http.Client
+	creds        Credentials
+	quitChan     chan interface{}
+	wg           sync.WaitGroup
+}
+
+//
+// Start a follower loop for td. Use td.Follow to set the leader
+func StartFollower(td *ticket.TicketD, promoteAfter time.Duration) (f *Follower) {
+	return StartFollowerWithTLS(td, promoteAfter, nil)
+}
+
+//
+// Start a follower loop for td that reaches https leaders with tlsConfig. Nil tlsConfig uses the defaults
+func StartFollowerWithTLS(td *ticket.TicketD, promoteAfter time.Duration, tlsConfig *tls.Config) (f *Follower) {
+	f = &Follower{td: td, promoteAfter: promoteAfter, creds: CredentialsFromEnv(), quitChan: make(chan interface{})}
+	if tlsConfig != nil {
+		f.client.Transport = tlsTransport(tlsConfig)
+	}
+	f.client.CheckRedirect = redirectWithCredentials(func() Credentials { return f.creds })
+	f.wg.Add(1)
+	go f.run()
+	return
+}
+
+//
+// Stop the follower loop
+func (f *Follower) Stop() {
+	close(f.quitChan)
+	f.wg.Wait()
+}
+
+func (f *Follower) run() {
+	defer f.wg.Done()
+	synced := false
+	lastContact := time.Now()
+	for {
+		if leader := f.td.Leader(); leader != "" && !f.td.Clustered() {
+			err := f.follow(leader, func() {
+				synced = true
+				lastContact = time.Now()
+			})
+			if err != nil && !f.td.IsLeader() {
+				log.Printf("Replication from %s: %s", leader, err.Error())
+			}
+			if f.promoteAfter > 0 && synced && time.Since(lastContact) > f.promoteAfter && f.td.Leader() == leader {
+				log.Printf("Leader %s unreachable for %s. Promoting self", leader, time.Since(lastContact))
+				f.td.Promote()
+			}
+		} else {
+			lastContact = time.Now()
+		}
+		select {
+		case <-f.quitChan:
+			return
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+// Stream from leader until the stream breaks, we are told to quit, or we stop following this leader.
+// contact is called on every message received
+func (f *Follower) follow(leader string, contact func()) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s/replication/stream", leader, apiPath), nil)
+	if err != nil {
+		return
+	}
+	if err = applyCredentials(f.creds, req); err != nil {
+		return
+	}
+	// Watchdog -- cancel the request if we stop hearing from the leader, are told to quit or the leader changes
+	contactChan := make(chan interface{}, 1)
+	go func() {
+		ticker := time.NewTicker(replicationPingInterval)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.quitChan:
+				cancel()
+				return
+			case <-contactChan:
+				last = time.Now()
+			case <-ticker.C:
+				if time.Since(last) > replicationTimeout || f.td.Leader() != leader {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("HTTP %d from leader", resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		msg := ReplicationMessage{}
+		if err = json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "state":
+			err = f.td.LoadReplicaStateContext(ctx, msg.State)
+		case "entry":
+			err = f.td.ApplyReplicatedContext(ctx, msg.Entry)
+		}
+		if err != nil {
+			return
+		}
+		contact()
+		select {
+		case contactChan <- nil:
+		default:
+		}
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	leaderStopped := false
+	defer func() {
+		if !leaderStopped {
+			stopServer(td, svr)
+		}
+	}()
+	ftd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	ftd.Follow("http://localhost:8080")
+	ftd.Start()
+	follower := StartFollower(ftd, 1*time.Second)
+	fsvr := StartServer("localhost:8081", ftd)
+	defer func() {
+		stopServer(ftd, fsvr)
+	}()
+	defer follower.Stop()
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	fcli := NewClient("http://localhost:8081", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	r.NoError(issuer.IssueTicket("test", "ticket-1", []byte("FOO")))
+	// Writes against the follower are redirected to the leader
+	claimant, err := fcli.OpenSession("claimant", 5000)
+	r.NoError(err)
+	ok, tick, err := claimant.ClaimTicket("test")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("ticket-1", tick.Name)
+	// Follower answers dumps from its own copy
+	time.Sleep(300 * time.Millisecond)
+	sessions, err := fcli.GetSessions()
+	r.NoError(err)
+	r.Len(sessions, 2)
+	resources, err := fcli.GetResources("test")
+	r.NoError(err)
+	r.Equal(claimant.Id, resources["test"].Tickets["ticket-1"].Claimant.Id)
+	status, err := fcli.GetStatus()
+	r.NoError(err)
+	r.Equal("follower", status.Role)
+	r.Equal("http://localhost:8080", status.Leader)
+	// Kill the leader. The follower promotes itself and keeps our sessions and claims
+	stopServer(td, svr)
+	leaderStopped = true
+	time.Sleep(2 * time.Second)
+	status, err = fcli.GetStatus()
+	r.NoError(err)
+	r.Equal("leader", status.Role)
+	claimant.c = fcli
+	ok, err = claimant.HasTicket("test", "ticket-1")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(claimant.Refresh())
+}
+
+func TestManualPromotion(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	ftd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	ftd.Start()
+	follower := StartFollower(ftd, 0)
+	fsvr := StartServer("localhost:8081", ftd)
+	defer func() {
+		stopServer(ftd, fsvr)
+	}()
+	defer follower.Stop()
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	fcli := NewClient("http://localhost:8081", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	sess, err := cli.OpenSession("locker", 5000)
+	r.NoError(err)
+	ok, err := sess.Lock("lock")
+	r.NoError(err)
+	r.True(ok)
+	// Point the second server at the first
+	r.NoError(fcli.Follow("http://localhost:8080"))
+	time.Sleep(300 * time.Millisecond)
+	resources, err := fcli.GetResources("")
+	r.NoError(err)
+	r.NotNil(resources["lock"])
+	// Promote it by hand, then check that the old leader's session holds the lock there
+	r.NoError(fcli.Promote())
+	sess.c = fcli
+	r.NoError(sess.Unlock("lock"))
+	ok, err = sess.Lock("lock")
+	r.NoError(err)
+	r.True(ok)
+}
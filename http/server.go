@@ -1,6 +1,7 @@
 package http
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,16 +10,24 @@ import (
 	"github.com/turbosquid/ticketd/version"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var timeStarted time.Time = time.Now()
 
+// Header carrying the client's request id (idempotency key)
+const requestIdHeader = "Idempotency-Key"
+
+// Header carrying a session's token. Returned when a session is opened, and required on calls that change a session
+const sessionTokenHeader = "Session-Token"
+
 // Ticket response -- adds a "claimed" bool to the base Ticket struct
 type TicketResponse struct {
 	Claimed bool
@@ -40,12 +49,31 @@ type ServerStatusResponse struct {
 	StackAllocMB  float64
 	SysAllocMB    float64
 	HeapObjects   uint64
+	Role          string    // "leader" or "follower"
+	Leader        string    // Leader url, if we are a follower
+	Clustered     bool      // Are we a member of a raft cluster?
+	Seq           uint64    // Sequence number of last applied command
+	ClockTime     time.Time // Time on the ticketd clock
+	ClockFrozen   bool      // Is the ticketd clock frozen for maintenance?
 }
 
+// Signature of our api handlers
+type handlerFunc func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params)
+
 func apiErr(w http.ResponseWriter, err error) {
 	code := http.StatusInternalServerError
 	if errors.Is(err, ticket.ErrNotFound) {
 		code = http.StatusNotFound
+	} else if errors.Is(err, ticket.ErrNotLeader) || errors.Is(err, ticket.ErrStopped) {
+		code = http.StatusServiceUnavailable
+	} else if errors.Is(err, ticket.ErrNotClustered) {
+		code = http.StatusNotImplemented
+	} else if errors.Is(err, ticket.ErrRequestIdReused) {
+		code = http.StatusUnprocessableEntity
+	} else if errors.Is(err, ticket.ErrForbidden) {
+		code = http.StatusForbidden
+	} else if errors.Is(err, ticket.ErrQuotaExceeded) {
+		code = http.StatusTooManyRequests
 	}
 	http.Error(w, err.Error(), code)
 }
@@ -64,6 +92,23 @@ func panicHandler(msg string, w http.ResponseWriter, r *http.Request) {
 	http.Error(w, msg, 500)
 }
 
+//
+// Get the client's request id, if any. Mutating calls with a request id can be retried: a repeat of a recent
+// request gets the original result back
+func requestId(r *http.Request) string {
+	return r.Header.Get(requestIdHeader)
+}
+
+//
+// Get the session token a request presents. Fails the request if there is none
+func sessionToken(w http.ResponseWriter, r *http.Request) (token string, ok bool) {
+	if token = r.Header.Get(sessionTokenHeader); token == "" {
+		apiErr(w, fmt.Errorf("missing %s header (%w)", sessionTokenHeader, ticket.ErrForbidden))
+		return
+	}
+	return token, true
+}
+
 func getSingleQueryParam(url *url.URL, qp string, defaultValue string) (ret string) {
 	ret = defaultValue
 	if vals, ok := url.Query()[qp]; ok {
@@ -87,19 +132,24 @@ func postSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, pa
 	name := getSingleQueryParam(r.URL, "name", "")
 	ttl := getSingleQueryParamInt(r.URL, "ttl", 5000)
 
-	id, err := td.OpenSession(name, r.RemoteAddr, ttl)
-	if err != nil {
-		apiErr(w, err)
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpOpenSession, RequestId: requestId(r), Name: name, Src: clientAddr(r), Ttl: ttl})
+	if res.Err != nil {
+		apiErr(w, res.Err)
 		return
 	}
-	jsonResp(w, id, 200)
+	w.Header().Set(sessionTokenHeader, res.Token)
+	jsonResp(w, res.SessId, 200)
 }
 
 // Refresh a session
 func putSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
 
-	err := td.RefreshSession(id)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	err := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpRefreshSession, RequestId: requestId(r), Token: token, SessId: id}).Err
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -111,7 +161,11 @@ func putSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, par
 func deleteSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
 
-	err := td.CloseSession(id)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	err := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpCloseSession, RequestId: requestId(r), Token: token, SessId: id}).Err
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -123,7 +177,7 @@ func deleteSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request,
 func getSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
 
-	sess, err := td.GetSession(id)
+	sess, err := td.GetSessionContext(r.Context(), id)
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -151,7 +205,12 @@ func postTickets(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, par
 		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 		return
 	}
-	err = td.IssueTicket(sessid, resource, name, body)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	err = td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpIssueTicket, RequestId: requestId(r), Token: token, SessId: sessid, Resource: resource,
+		Name: name, Data: body}).Err
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -159,6 +218,53 @@ func postTickets(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, par
 	jsonResp(w, "Ok", 200)
 }
 
+//
+// Ticket in a sync request
+type SyncTicket struct {
+	Name string
+	Data []byte
+}
+
+// Sync a resource's tickets with a desired list
+func putTickets(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	resource := params.ByName("resource")
+	sessid := getSingleQueryParam(r.URL, "sessid", "")
+	if sessid == "" {
+		http.Error(w, "Missing session id", http.StatusUnprocessableEntity)
+		return
+	}
+	// 1K of data per ticket, plus room for names and encoding
+	r.Body = http.MaxBytesReader(w, r.Body, 4*1024*1024)
+	list := []SyncTicket{}
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, fmt.Sprintf("Bad ticket list: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	tickets := make(map[string][]byte, len(list))
+	for _, t := range list {
+		if t.Name == "" {
+			http.Error(w, "Missing ticket name", http.StatusUnprocessableEntity)
+			return
+		}
+		if len(t.Data) > 1024 {
+			http.Error(w, fmt.Sprintf("Ticket data for %s is too large", t.Name), http.StatusRequestEntityTooLarge)
+			return
+		}
+		tickets[t.Name] = t.Data
+	}
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpSyncTickets, RequestId: requestId(r), Token: token, SessId: sessid,
+		Resource: resource, Tickets: tickets})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, res.Sync, 200)
+}
+
 // Revoke  a tickwt
 func deleteTickets(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	resource := params.ByName("resource")
@@ -172,7 +278,12 @@ func deleteTickets(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, p
 		http.Error(w, "Missing ticket name", http.StatusUnprocessableEntity)
 		return
 	}
-	err := td.RevokeTicket(sessid, resource, name)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	err := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpRevokeTicket, RequestId: requestId(r), Token: token, SessId: sessid, Resource: resource,
+		Name: name}).Err
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -188,15 +299,19 @@ func postClaims(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, para
 		http.Error(w, "Missing session id", http.StatusUnprocessableEntity)
 		return
 	}
-	ok, ticket, err := td.ClaimTicket(sessid, resource)
-	if err != nil {
-		apiErr(w, err)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpClaimTicket, RequestId: requestId(r), Token: token, SessId: sessid, Resource: resource})
+	if res.Err != nil {
+		apiErr(w, res.Err)
 		return
 	}
 	tr := &TicketResponse{}
-	tr.Claimed = ok
-	if ok {
-		tr.Ticket = *ticket
+	tr.Claimed = res.Ok
+	if res.Ok {
+		tr.Ticket = *res.Ticket
 	}
 	jsonResp(w, tr, 200)
 }
@@ -215,7 +330,12 @@ func deleteClaims(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, pa
 		http.Error(w, "Missing ticket name", http.StatusUnprocessableEntity)
 		return
 	}
-	err := td.ReleaseTicket(sessid, resource, name)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	err := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpReleaseTicket, RequestId: requestId(r), Token: token, SessId: sessid, Resource: resource,
+		Name: name}).Err
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -236,7 +356,11 @@ func getClaims(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, param
 		http.Error(w, "Missing ticket name", http.StatusUnprocessableEntity)
 		return
 	}
-	ok, err := td.HasTicket(sessid, resource, name)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	ok, err := td.HasTicketContext(ticket.WithSessionToken(r.Context(), token), sessid, resource, name)
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -251,12 +375,35 @@ func postLocks(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, param
 		http.Error(w, "Missing session id", http.StatusUnprocessableEntity)
 		return
 	}
-	ok, err := td.Lock(sessid, resource)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	res := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpLock, RequestId: requestId(r), Token: token, SessId: sessid, Resource: resource})
+	if res.Err != nil {
+		apiErr(w, res.Err)
+		return
+	}
+	jsonResp(w, res.Ok, 200)
+}
+
+func getLocks(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	resource := params.ByName("resource")
+	sessid := getSingleQueryParam(r.URL, "sessid", "")
+	if sessid == "" {
+		http.Error(w, "Missing session id", http.StatusUnprocessableEntity)
+		return
+	}
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	held, err := td.HasLockContext(r.Context(), sessid, token, resource)
 	if err != nil {
 		apiErr(w, err)
 		return
 	}
-	jsonResp(w, ok, 200)
+	jsonResp(w, held, 200)
 }
 
 func deleteLocks(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -266,7 +413,11 @@ func deleteLocks(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, par
 		http.Error(w, "Missing session id", http.StatusUnprocessableEntity)
 		return
 	}
-	err := td.Unlock(sessid, resource)
+	token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	err := td.SubmitContext(r.Context(), &ticket.Command{Op: ticket.OpUnlock, RequestId: requestId(r), Token: token, SessId: sessid, Resource: resource}).Err
 	if err != nil {
 		apiErr(w, err)
 		return
@@ -275,13 +426,27 @@ func deleteLocks(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, par
 }
 
 func getDumpSessions(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	sessions := td.GetSessions()
+	sessions, err := td.GetSessionsContext(r.Context())
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
 	jsonResp(w, sessions, 200)
 }
 
 func getDumpResources(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	resourceName := params.ByName("resource")
-	resources := td.GetResources()
+	if resourceName != "" {
+		if err := td.Authorize(r.Context(), ticket.VerbDump, resourceName); err != nil {
+			apiErr(w, err)
+			return
+		}
+	}
+	resources, err := td.GetResourcesContext(r.Context())
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
 	if resourceName != "" {
 		r := resources[resourceName]
 		if r != nil {
@@ -297,6 +462,11 @@ func getDumpResources(td *ticket.TicketD, w http.ResponseWriter, r *http.Request
 }
 
 func getStatus(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	seq, err := td.SeqContext(r.Context())
+	if err != nil {
+		apiErr(w, err)
+		return
+	}
 	m := runtime.MemStats{}
 	runtime.ReadMemStats(&m)
 	resp := ServerStatusResponse{
@@ -310,6 +480,17 @@ func getStatus(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, param
 		SysAllocMB:    float64(m.Sys) / 1048576.0,
 		StackAllocMB:  float64(m.StackInuse) / 1048576.0,
 		HeapObjects:   m.HeapObjects,
+		Role:          "leader",
+		Leader:        td.Leader(),
+		Clustered:     td.Clustered(),
+		Seq:           seq,
+		ClockTime:     td.Now(),
+	}
+	if f, ok := td.Clock().(freezer); ok {
+		resp.ClockFrozen = f.Frozen()
+	}
+	if !td.IsLeader() {
+		resp.Role = "follower"
 	}
 	resp.Uptime = fmtDuration(resp.Uptime_t)
 	// Format start and uptime
@@ -317,32 +498,102 @@ func getStatus(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, param
 	jsonResp(w, resp, 200)
 }
 
+//
+// Api server options
+type ServerOptions struct {
+	Auth          *Authenticator // Checks request credentials. Nil to let anyone in
+	PublicStatus  bool           // Let anyone read /status, even when requests are authenticated
+	TLS           *ServerTLS     // Serve https. Nil for plain http
+	PeerTLS       *tls.Config    // Client TLS settings for requests forwarded to the leader. Nil for the defaults
+	RateLimiter   *RateLimiter   // Limits request rates per caller. Nil for no limits
+	peerTransport http.RoundTripper
+	nodeId        string
+}
+
 //
 // Start ticketd api server
 func StartServer(listenOn string, td *ticket.TicketD) (svr *http.Server) {
+	return StartServerWithOptions(listenOn, td, nil)
+}
+
+//
+// Start ticketd api server with options. Nil opts are the same as StartServer
+func StartServerWithOptions(listenOn string, td *ticket.TicketD, opts *ServerOptions) (svr *http.Server) {
+	ln, err := net.Listen("tcp", listenOn)
+	if err != nil {
+		log.Fatalf("Unable to start http server on %s -> %s", listenOn, err.Error())
+	}
+	return StartServerListener(ln, td, opts)
+}
+
+//
+// Start ticketd api server on a listener. Listen on port 0 to get an ephemeral port, and find it with ln.Addr()
+func StartServerListener(ln net.Listener, td *ticket.TicketD, opts *ServerOptions) (svr *http.Server) {
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+	o := *opts
+	opts = &o
+	if opts.PeerTLS != nil {
+		opts.peerTransport = tlsTransport(opts.PeerTLS)
+	}
+	opts.nodeId = newNodeId()
+	listenOn := ln.Addr().String()
+	if opts.TLS != nil {
+		ln = tls.NewListener(ln, opts.TLS.config(opts.Auth != nil))
+		log.Printf("Serving https")
+	}
 	log.Printf("Starting ticked API server on: %s", listenOn)
 	router := httprouter.New()
 	svr = &http.Server{
 		Addr:    listenOn,
-		Handler: router,
-	}
-	router.POST("/api/v1/sessions", middleWare(td, postSessions))
-	router.PUT("/api/v1/sessions/:id", middleWare(td, putSessions))
-	router.DELETE("/api/v1/sessions/:id", middleWare(td, deleteSessions))
-	router.GET("/api/v1/sessions/:id", middleWare(td, getSessions))
-	router.POST("/api/v1/tickets/:resource", middleWare(td, postTickets))
-	router.DELETE("/api/v1/tickets/:resource", middleWare(td, deleteTickets))
-	router.POST("/api/v1/claims/:resource", middleWare(td, postClaims))
-	router.DELETE("/api/v1/claims/:resource", middleWare(td, deleteClaims))
-	router.GET("/api/v1/claims/:resource", middleWare(td, getClaims))
-	router.POST("/api/v1/locks/:resource", middleWare(td, postLocks))
-	router.DELETE("/api/v1/locks/:resource", middleWare(td, deleteLocks))
-	router.GET("/api/v1/dump/sessions", middleWare(td, getDumpSessions))
-	router.GET("/api/v1/dump/resources", middleWare(td, getDumpResources))
-	router.GET("/api/v1/dump/resources/:resource", middleWare(td, getDumpResources))
-	router.GET("/api/v1/status", middleWare(td, getStatus))
+		Handler: takeForwarded(router),
+	}
+	shutdownChan := make(chan interface{})
+	svr.RegisterOnShutdown(func() { close(shutdownChan) })
+	// Session, ticket and dump routes are served for the default namespace, and under /ns/<namespace> for every
+	// namespace
+	api := func(method func(string, httprouter.Handle), path string, h httprouter.Handle) {
+		method(apiPath+path, h)
+		method(apiPath+"/ns/:namespace"+path, h)
+	}
+	// Followers answer dumps and status themselves, and redirect everything else to the leader
+	api(router.POST, "/sessions", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassSessions, leaderOnly(opts, postSessions)))))
+	api(router.PUT, "/sessions/:id", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassSessions, leaderOnly(opts, putSessions)))))
+	api(router.DELETE, "/sessions/:id", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassSessions, leaderOnly(opts, deleteSessions)))))
+	api(router.GET, "/sessions/:id", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassSessions, leaderOnly(opts, getSessions)))))
+	api(router.POST, "/tickets/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassTickets, leaderOnly(opts, postTickets)))))
+	api(router.DELETE, "/tickets/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassTickets, leaderOnly(opts, deleteTickets)))))
+	api(router.PUT, "/tickets/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassTickets, leaderOnly(opts, putTickets)))))
+	api(router.POST, "/claims/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassClaims, leaderOnly(opts, postClaims)))))
+	api(router.DELETE, "/claims/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassClaims, leaderOnly(opts, deleteClaims)))))
+	api(router.GET, "/claims/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassClaims, leaderOnly(opts, getClaims)))))
+	api(router.POST, "/locks/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassLocks, leaderOnly(opts, postLocks)))))
+	api(router.DELETE, "/locks/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassLocks, leaderOnly(opts, deleteLocks)))))
+	api(router.GET, "/locks/:resource", middleWare(td, authorize(opts, RoleApi, rateLimited(opts, ClassLocks, leaderOnly(opts, getLocks)))))
+	api(router.GET, "/dump/sessions", middleWare(td, authorize(opts, RoleDump, rateLimited(opts, ClassDumps, getDumpSessions))))
+	api(router.GET, "/dump/resources", middleWare(td, authorize(opts, RoleDump, rateLimited(opts, ClassDumps, getDumpResources))))
+	api(router.GET, "/dump/resources/:resource", middleWare(td, authorize(opts, RoleDump, rateLimited(opts, ClassDumps, getDumpResources))))
+	// Forced operations are checked against the policy by the ticket layer, with the resource they act on
+	api(router.DELETE, "/admin/sessions", middleWare(td, authorize(opts, RoleAdmin, leaderOnly(opts, deleteAdminSessions))))
+	api(router.DELETE, "/admin/sessions/:id", middleWare(td, authorize(opts, RoleAdmin, leaderOnly(opts, deleteAdminSession))))
+	api(router.DELETE, "/admin/locks/:resource", middleWare(td, authorize(opts, RoleAdmin, leaderOnly(opts, deleteAdminLock))))
+	api(router.DELETE, "/admin/claims/:resource", middleWare(td, authorize(opts, RoleAdmin, leaderOnly(opts, deleteAdminClaim))))
+	api(router.DELETE, "/admin/resources/:resource", middleWare(td, authorize(opts, RoleAdmin, leaderOnly(opts, deleteAdminResource))))
+	router.GET("/api/v1/status", middleWare(td, authorize(opts, RoleStatus, getStatus)))
+	router.GET("/api/v1/replication/stream", middleWare(td, authorize(opts, RoleReplication, getReplicationStream(shutdownChan))))
+	router.POST("/api/v1/replication/promote", middleWare(td, authorize(opts, RoleAdmin, adminOnly(postReplicationPromote))))
+	router.POST("/api/v1/replication/follow", middleWare(td, authorize(opts, RoleAdmin, adminOnly(postReplicationFollow))))
+	router.GET("/api/v1/admin/check", middleWare(td, authorize(opts, RoleAdmin, adminOnly(getAdminCheck))))
+	router.GET("/api/v1/admin/usage", middleWare(td, authorize(opts, RoleAdmin, adminOnly(getAdminUsage))))
+	router.GET("/api/v1/admin/audit", middleWare(td, authorize(opts, RoleAdmin, adminOnly(getAdminAudit))))
+	router.POST("/api/v1/admin/clock/freeze", middleWare(td, authorize(opts, RoleAdmin, adminOnly(leaderOnly(opts, postClockFreeze)))))
+	router.POST("/api/v1/admin/clock/thaw", middleWare(td, authorize(opts, RoleAdmin, adminOnly(leaderOnly(opts, postClockThaw)))))
+	router.GET("/api/v1/cluster/members", middleWare(td, authorize(opts, RoleAdmin, adminOnly(getClusterMembers))))
+	router.POST("/api/v1/cluster/members", middleWare(td, authorize(opts, RoleAdmin, adminOnly(leaderOnly(opts, postClusterMembers)))))
+	router.DELETE("/api/v1/cluster/members", middleWare(td, authorize(opts, RoleAdmin, adminOnly(leaderOnly(opts, deleteClusterMembers)))))
 	go func() {
-		if err := svr.ListenAndServe(); err != http.ErrServerClosed {
+		if err := svr.Serve(ln); err != http.ErrServerClosed {
 			log.Fatalf("Unable to start http server on %s -> %s", listenOn, err.Error())
 		}
 		log.Printf("Stopped ticketd API server by request.")
@@ -350,7 +601,7 @@ func StartServer(listenOn string, td *ticket.TicketD) (svr *http.Server) {
 	return
 }
 
-func middleWare(td *ticket.TicketD, handler func(td *ticket.TicketD, w http.ResponseWriter, r *http.Request, params httprouter.Params)) httprouter.Handle {
+func middleWare(td *ticket.TicketD, handler handlerFunc) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -366,10 +617,33 @@ func middleWare(td *ticket.TicketD, handler func(td *ticket.TicketD, w http.Resp
 				panicHandler(msg, w, req)
 			}
 		}()
+		if ns := params.ByName("namespace"); ns != "" {
+			if !ticket.ValidNamespace(ns) {
+				http.Error(w, fmt.Sprintf("bad namespace %q", ns), http.StatusBadRequest)
+				return
+			}
+			req = req.WithContext(ticket.WithNamespace(req.Context(), ns))
+		}
+		if res := params.ByName("resource"); !ticket.ValidResourceName(res) {
+			http.Error(w, fmt.Sprintf("bad resource name %q", res), http.StatusBadRequest)
+			return
+		}
 		handler(td, w, req, params)
 	}
 }
 
+//
+// Is this api path one of the routes served per namespace?
+func namespacedPath(path string) bool {
+	for _, prefix := range []string{"/sessions", "/tickets/", "/claims/", "/locks/", "/dump/", "/admin/sessions",
+		"/admin/locks/", "/admin/claims/", "/admin/resources/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func fmtDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	days := d / (time.Hour * 24)
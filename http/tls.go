@@ -0,0 +1,147 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// TLS
+//
+// The api server can serve https, and can ask clients for certificates (mutual TLS). A client certificate signed by
+// the client CA identifies its holder: the principal is the certificate subject's common name. With a key file, the
+// subject's roles come from the key file's Subjects. Without one, every certificate holder gets ClientRoles, which
+// are none unless set. The server certificate and the client CA are re-read by ServerTLS.Reload, so they can be
+// rotated without a restart.
+
+//
+// Server TLS settings
+type ServerTLS struct {
+	CertFile     string   // Server certificate (PEM). Intermediates may follow the leaf
+	KeyFile      string   // Server key (PEM)
+	ClientCAFile string   // CA certificates (PEM) for client certificates. Empty to not ask for client certificates
+	ClientRoles  []string // Roles of every client certificate holder when there is no key file. None if empty
+	mu           sync.RWMutex
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+}
+
+//
+// Client TLS settings
+type ClientTLS struct {
+	CAFile     string // Only trust servers with certificates from these CAs (PEM). Empty to use the system roots
+	CertFile   string // Client certificate (PEM), for servers that ask for one. Re-read on every handshake
+	KeyFile    string // Client key (PEM)
+	ServerName string // Name to check the server certificate against. Defaults to the host in the url
+}
+
+//
+// Load server TLS settings
+func NewServerTLS(certFile, keyFile, clientCAFile string) (t *ServerTLS, err error) {
+	t = &ServerTLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}
+	if err = t.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+//
+// Re-read the server certificate, key and client CA. On error, the ones we had are kept. Connections already made
+// are not affected
+func (t *ServerTLS) Reload() (err error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("server certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if t.ClientCAFile != "" {
+		if clientCAs, err = loadCertPool(t.ClientCAFile); err != nil {
+			return fmt.Errorf("client CA: %w", err)
+		}
+	}
+	t.mu.Lock()
+	t.cert, t.clientCAs = &cert, clientCAs
+	t.mu.Unlock()
+	log.Printf("Loaded TLS certificate from %s", t.CertFile)
+	return
+}
+
+// Build a tls config for the server. Each handshake picks up the current certificate and client CA. Client
+// certificates are required, unless clients can authenticate with keys instead
+func (t *ServerTLS) config(keysAllowed bool) *tls.Config {
+	clientAuth := tls.NoClientCert
+	if t.ClientCAFile != "" {
+		clientAuth = tls.RequireAndVerifyClientCert
+		if keysAllowed {
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*t.cert},
+				ClientAuth: clientAuth, ClientCAs: t.clientCAs}, nil
+		},
+	}
+}
+
+//
+// Build a tls config from client settings
+func (o *ClientTLS) Config() (cfg *tls.Config, err error) {
+	cfg = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: o.ServerName}
+	if o.CAFile != "" {
+		if cfg.RootCAs, err = loadCertPool(o.CAFile); err != nil {
+			return nil, fmt.Errorf("CA: %w", err)
+		}
+	}
+	if o.CertFile != "" {
+		certFile, keyFile := o.CertFile, o.KeyFile
+		if _, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+	return
+}
+
+//
+// Talk to servers over https with these settings. Not safe to call while the client is in use
+func (c *Client) UseTLS(o *ClientTLS) (err error) {
+	cfg, err := o.Config()
+	if err != nil {
+		return
+	}
+	c.Transport = tlsTransport(cfg)
+	return
+}
+
+// An http transport using a tls config
+func tlsTransport(cfg *tls.Config) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = cfg
+	return tr
+}
+
+func loadCertPool(file string) (pool *x509.CertPool, err error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return
+}
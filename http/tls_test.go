@@ -0,0 +1,224 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A test certificate authority
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	file   string
+	serial int64
+}
+
+func newTestCA(r *require.Assertions, dir, name string) (ca *testCA) {
+	ca = &testCA{file: filepath.Join(dir, name+".pem"), serial: 1}
+	var err error
+	ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign, BasicConstraintsValid: true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	r.NoError(err)
+	ca.cert, err = x509.ParseCertificate(der)
+	r.NoError(err)
+	r.NoError(ioutil.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return
+}
+
+// Issue a certificate, and write it and its key to <dir>/<name>.pem and <dir>/<name>-key.pem. Returns the serial
+func (ca *testCA) issue(r *require.Assertions, dir, name string, server bool) (certFile, keyFile string, serial int64) {
+	ca.serial++
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(ca.serial), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		tmpl.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	r.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	r.NoError(err)
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	r.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	r.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile, ca.serial
+}
+
+// Serial number of the certificate a server presents
+func serverSerial(r *require.Assertions, addr, caFile string) int64 {
+	cfg, err := (&ClientTLS{CAFile: caFile}).Config()
+	r.NoError(err)
+	conn, err := tls.Dial("tcp", addr, cfg)
+	r.NoError(err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLS(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	ca := newTestCA(r, dir, "ca")
+	other := newTestCA(r, dir, "other-ca")
+	certFile, keyFile, serial := ca.issue(r, dir, "server", true)
+	serverTLS, err := NewServerTLS(certFile, keyFile, "")
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{TLS: serverTLS})
+	defer stopServer(td, svr)
+	time.Sleep(10 * time.Millisecond)
+
+	// Pinned to our CA
+	cli := NewClient("https://localhost:8080", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: ca.file}))
+	_, err = cli.GetStatus()
+	r.NoError(err)
+	// Pinned to another CA, or using the system roots
+	cli = NewClient("https://localhost:8080", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: other.file}))
+	_, err = cli.GetStatus()
+	r.Error(err)
+	_, err = NewClient("https://localhost:8080", 1*time.Second).GetStatus()
+	r.Error(err)
+
+	// Reload picks up a new certificate without a restart
+	r.Equal(serial, serverSerial(r, "localhost:8080", ca.file))
+	_, _, serial = ca.issue(r, dir, "server", true)
+	r.NoError(serverTLS.Reload())
+	r.Equal(serial, serverSerial(r, "localhost:8080", ca.file))
+	// A bad certificate leaves the old one in place
+	r.NoError(ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	r.Error(serverTLS.Reload())
+	r.Equal(serial, serverSerial(r, "localhost:8080", ca.file))
+}
+
+func TestMutualTLS(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	ca := newTestCA(r, dir, "ca")
+	certFile, keyFile, _ := ca.issue(r, dir, "server", true)
+	appCert, appKey, _ := ca.issue(r, dir, "app", false)
+	monitorCert, monitorKey, _ := ca.issue(r, dir, "monitor", false)
+	serverTLS, err := NewServerTLS(certFile, keyFile, ca.file)
+	r.NoError(err)
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.SetPolicy(&ticket.Policy{Grants: []*ticket.Grant{
+		{Principal: "app", Verbs: []ticket.Verb{ticket.VerbIssue}, Resources: []string{"tls-"}},
+	}})
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{TLS: serverTLS})
+	defer func() { stopServer(td, svr) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// No client certificate, no connection
+	cli := NewClient("https://localhost:8080", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: ca.file}))
+	_, err = cli.GetStatus()
+	r.Error(err)
+	r.Zero(HttpErrorCode(err))
+
+	// Without a key file, certificates only get the roles they are given
+	cli = NewClient("https://localhost:8080", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: ca.file, CertFile: appCert, KeyFile: appKey}))
+	_, err = cli.OpenSession("app", 5000)
+	r.Equal(403, HttpErrorCode(err))
+	r.NoError(svr.Shutdown(context.Background()))
+	serverTLS.ClientRoles = []string{RoleAll}
+	svr = StartServerWithOptions("localhost:8080", td, &ServerOptions{TLS: serverTLS})
+	time.Sleep(10 * time.Millisecond)
+
+	// The certificate subject is the principal the access control policy sees
+	sess, err := cli.OpenSession("app", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("tls-test", "t1", nil))
+	r.Equal(403, HttpErrorCode(sess.IssueTicket("other", "t1", nil)))
+
+	// With a key file, subjects get the roles it lists
+	keyPath := filepath.Join(dir, "keys.json")
+	r.NoError(ioutil.WriteFile(keyPath, []byte(`{"Subjects": [{"Name": "monitor", "Roles": ["status"]}]}`), 0600))
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	r.NoError(svr.Shutdown(context.Background()))
+	svr = StartServerWithOptions("localhost:8080", td, &ServerOptions{TLS: serverTLS, Auth: auth})
+	time.Sleep(10 * time.Millisecond)
+	cli = NewClient("https://localhost:8080", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: ca.file, CertFile: monitorCert, KeyFile: monitorKey}))
+	_, err = cli.GetStatus()
+	r.NoError(err)
+	_, err = cli.OpenSession("monitor", 5000)
+	r.Equal(403, HttpErrorCode(err))
+	// Unknown subjects fall back to keys
+	cli = NewClient("https://localhost:8080", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: ca.file, CertFile: appCert, KeyFile: appKey}))
+	_, err = cli.GetStatus()
+	r.Equal(401, HttpErrorCode(err))
+}
+
+func TestPeerForwarding(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	ca := newTestCA(r, dir, "ca")
+	certFile, keyFile, _ := ca.issue(r, dir, "server", true)
+	nodeCert, nodeKey, _ := ca.issue(r, dir, "node", false)
+	serverTLS, err := NewServerTLS(certFile, keyFile, ca.file)
+	r.NoError(err)
+	keyPath := filepath.Join(dir, "keys.json")
+	r.NoError(ioutil.WriteFile(keyPath, []byte(`{"Keys": [{"Id": "app", "Secret": "app-secret", "Roles": ["api"]}],
+		"Subjects": [{"Name": "node", "Roles": ["peer"]}]}`), 0600))
+	auth, err := NewAuthenticator(keyPath)
+	r.NoError(err)
+	policy := &ticket.Policy{Grants: []*ticket.Grant{
+		{Principal: "app", Verbs: []ticket.Verb{ticket.VerbIssue}, Resources: []string{"tls-"}},
+	}}
+	td := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	td.SetPolicy(policy)
+	td.Start()
+	svr := StartServerWithOptions("localhost:8080", td, &ServerOptions{TLS: serverTLS, Auth: auth})
+	defer stopServer(td, svr)
+	// The follower forwards to the leader with its own certificate
+	peerTLS, err := (&ClientTLS{CAFile: ca.file, CertFile: nodeCert, KeyFile: nodeKey}).Config()
+	r.NoError(err)
+	ftd := ticket.NewTicketD(500, "", 0, &ticket.DefaultLogger{Level: *logLevel}, nil)
+	ftd.SetPolicy(policy)
+	ftd.Start()
+	ftd.SetCommitter(&followerCommitter{"https://localhost:8080"})
+	fsvr := StartServerWithOptions("localhost:8081", ftd, &ServerOptions{TLS: serverTLS, Auth: auth, PeerTLS: peerTLS})
+	defer stopServer(ftd, fsvr)
+	time.Sleep(10 * time.Millisecond)
+
+	// The leader acts for the caller, not the node that forwarded the call
+	cli := NewClient("https://localhost:8081", 1*time.Second)
+	r.NoError(cli.UseTLS(&ClientTLS{CAFile: ca.file}))
+	cli.Credentials = BearerToken("app-secret")
+	sess, err := cli.OpenSession("app", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("tls-test", "t1", nil))
+	r.Equal(403, HttpErrorCode(sess.IssueTicket("other", "t1", nil)))
+	s, err := td.GetSession(sess.Id)
+	r.NoError(err)
+	r.Equal("app", s.Principal)
+	r.True(strings.HasPrefix(s.Src, "127.0.0.1:"))
+}
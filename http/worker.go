@@ -0,0 +1,223 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"github.com/turbosquid/ticketd/ticket"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+//
+// Work done for a claimed ticket. ctx is cancelled if the claim is lost (the ticket was revoked, or our session
+// expired) or the worker is stopped without waiting for work to finish. The ticket is released when the function
+// returns, whatever the outcome
+type WorkFunc func(ctx context.Context, t *ticket.Ticket) error
+
+//
+// A pool of goroutines that claim tickets for a resource, do work for each ticket, then release it. Each goroutine has
+// its own session, kept alive by a heartbeat, and opens a new one if its session is lost. Set the exported fields
+// before calling Start
+type TicketWorker struct {
+	c                 *Client
+	resource          string
+	work              WorkFunc
+	Workers           int                               // Number of goroutines
+	SessionTtl        time.Duration                     // Ttl of worker sessions
+	HeartbeatInterval time.Duration                     // How often sessions are refreshed
+	WatchInterval     time.Duration                     // How often we check that a claim is still ours
+	MinBackoff        time.Duration                     // First wait when there is no ticket to claim, or a call fails
+	MaxBackoff        time.Duration                     // Longest wait between claim attempts
+	OnError           func(t *ticket.Ticket, err error) // Optional. Called for failed work (t is set) and api errors
+	ctx               context.Context                   // Cancelled to abandon work in progress
+	cancel            context.CancelFunc
+	stopChan          chan interface{} // Closed to stop claiming tickets
+	stopOnce          sync.Once
+	wg                sync.WaitGroup
+}
+
+//
+// Create a worker pool running work for tickets claimed on resource
+func NewTicketWorker(c *Client, resource string, workers int, work WorkFunc) (w *TicketWorker) {
+	w = &TicketWorker{c: c, resource: resource, work: work, Workers: workers, SessionTtl: 5 * time.Second,
+		HeartbeatInterval: 1 * time.Second, WatchInterval: 1 * time.Second, MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 1 * time.Second, stopChan: make(chan interface{})}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return
+}
+
+//
+// Start the worker goroutines
+func (w *TicketWorker) Start() {
+	for n := 0; n < w.Workers; n++ {
+		w.wg.Add(1)
+		go w.run(n)
+	}
+}
+
+//
+// Stop claiming tickets, wait for work in progress to finish, then close worker sessions
+func (w *TicketWorker) Stop() {
+	w.StopContext(context.Background())
+}
+
+//
+// Stop claiming tickets and wait for work in progress to finish. If ctx is done first, work in progress is cancelled
+// (and we still wait for it to return). Returns the context error if we had to cancel work
+func (w *TicketWorker) StopContext(ctx context.Context) (err error) {
+	w.stopOnce.Do(func() { close(w.stopChan) })
+	done := make(chan interface{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		w.cancel()
+		<-done
+	}
+	w.cancel()
+	return
+}
+
+func (w *TicketWorker) stopping() bool {
+	select {
+	case <-w.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait before trying again, doubling backoff. Returns false if we are stopped while waiting
+func (w *TicketWorker) wait(backoff *time.Duration) bool {
+	wait := *backoff/2 + time.Duration(rand.Int63n(int64(*backoff/2)+1))
+	if *backoff *= 2; *backoff > w.MaxBackoff {
+		*backoff = w.MaxBackoff
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-w.stopChan:
+		return false
+	}
+}
+
+func (w *TicketWorker) report(t *ticket.Ticket, err error) {
+	Debug("Ticket worker on %s: %s", w.resource, err.Error())
+	if w.OnError != nil {
+		w.OnError(t, err)
+	}
+}
+
+// Worker goroutine
+func (w *TicketWorker) run(n int) {
+	defer w.wg.Done()
+	var sess *Session
+	var sessLost chan interface{}
+	defer func() {
+		if sess != nil {
+			sess.CloseContext(context.Background())
+		}
+	}()
+	backoff := w.MinBackoff
+	for !w.stopping() {
+		if sess != nil && isClosed(sessLost) {
+			sess.CloseContext(context.Background()) // Most likely gone already
+			sess = nil
+		}
+		if sess == nil {
+			var err error
+			if sess, sessLost, err = w.openSession(n); err != nil {
+				w.report(nil, err)
+				if !w.wait(&backoff) {
+					return
+				}
+				continue
+			}
+		}
+		lease, err := sess.claimLease(w.ctx, w.resource, sessLost)
+		if err != nil {
+			w.report(nil, err)
+			if HttpErrorCode(err) == 404 {
+				sess.CancelHeartBeat()
+				sess = nil
+			}
+		}
+		if err != nil || lease == nil {
+			if !w.wait(&backoff) {
+				return
+			}
+			continue
+		}
+		backoff = w.MinBackoff
+		if w.stopping() {
+			// Stopped while we were claiming. Hand the ticket back
+			lease.Release()
+			return
+		}
+		w.process(lease)
+	}
+}
+
+// Open a worker session with a heartbeat. lost is closed if the heartbeat fails
+func (w *TicketWorker) openSession(n int) (sess *Session, lost chan interface{}, err error) {
+	sess, err = w.c.OpenSessionContext(w.ctx, fmt.Sprintf("%s worker %d", w.resource, n), int(w.SessionTtl/time.Millisecond))
+	if err != nil {
+		return
+	}
+	sess.LeaseWatchInterval = w.WatchInterval
+	lost = make(chan interface{})
+	sess.RunHeartbeat(w.HeartbeatInterval, w.HeartbeatInterval, true, func(err error) {
+		if err != nil {
+			w.report(nil, err)
+			close(lost)
+		}
+	})
+	return
+}
+
+// Do the work for a claimed ticket, then release it. Work is cancelled if the lease is lost, or we are stopped
+// without waiting
+func (w *TicketWorker) process(lease *Lease) {
+	ctx, cancel := context.WithCancel(w.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lease.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := w.safeWork(ctx, lease.Ticket)
+	if err != nil {
+		w.report(lease.Ticket, err)
+	}
+	if err = lease.Release(); err != nil {
+		Debug("Unable to release ticket %s on %s: %s", lease.Name, w.resource, err.Error())
+	}
+}
+
+// Run work, turning a panic into an error
+func (w *TicketWorker) safeWork(ctx context.Context, tick *ticket.Ticket) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in ticket worker: %v", r)
+			Debug("Stack trace:\n%s", debug.Stack())
+		}
+	}()
+	return w.work(ctx, tick)
+}
+
+func isClosed(c chan interface{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
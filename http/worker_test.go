@@ -0,0 +1,107 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/turbosquid/ticketd/ticket"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTicketWorker(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	defer issuer.Close()
+	for i := 1; i <= 3; i++ {
+		r.NoError(issuer.IssueTicket("jobs", fmt.Sprintf("job-%d", i), []byte("work")))
+	}
+	lock := sync.Mutex{}
+	done := map[string]int{}
+	failed := map[string]error{}
+	w := NewTicketWorker(cli, "jobs", 3, func(ctx context.Context, tick *ticket.Ticket) error {
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		done[tick.Name]++
+		switch tick.Name {
+		case "job-2":
+			return errors.New("job 2 failed")
+		case "job-3":
+			panic("job 3 panicked")
+		}
+		return nil
+	})
+	w.OnError = func(tick *ticket.Ticket, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if tick != nil {
+			failed[tick.Name] = err
+		}
+	}
+	w.Start()
+	time.Sleep(300 * time.Millisecond)
+	w.Stop()
+	// Every ticket was worked on, and failed tickets were released for another try
+	lock.Lock()
+	r.Len(done, 3)
+	r.Greater(done["job-2"], 1)
+	r.Greater(done["job-3"], 1)
+	r.NotContains(failed, "job-1")
+	r.EqualError(failed["job-2"], "job 2 failed")
+	r.Contains(failed["job-3"].Error(), "job 3 panicked")
+	lock.Unlock()
+	// Stopping released every ticket and closed worker sessions
+	resources, err := cli.GetResources("jobs")
+	r.NoError(err)
+	for _, tick := range resources["jobs"].Tickets {
+		r.Nil(tick.Claimant)
+	}
+	sessions, err := cli.GetSessions()
+	r.NoError(err)
+	r.Len(sessions, 1)
+}
+
+func TestTicketWorkerClaimLost(t *testing.T) {
+	r := require.New(t)
+	td, svr := startServer()
+	defer stopServer(td, svr)
+	cli := NewClient("http://localhost:8080", 1*time.Second)
+	time.Sleep(10 * time.Millisecond) // We have to allow server time to start
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	defer issuer.Close()
+	r.NoError(issuer.IssueTicket("jobs", "job-1", []byte("work")))
+	startedChan := make(chan interface{}, 1)
+	cancelledChan := make(chan interface{}, 1)
+	w := NewTicketWorker(cli, "jobs", 1, func(ctx context.Context, tick *ticket.Ticket) error {
+		startedChan <- nil
+		<-ctx.Done()
+		cancelledChan <- nil
+		return ctx.Err()
+	})
+	w.WatchInterval = 50 * time.Millisecond
+	w.Start()
+	<-startedChan
+	// Revoking the ticket cancels the work
+	r.NoError(issuer.RevokeTicket("jobs", "job-1"))
+	select {
+	case <-cancelledChan:
+	case <-time.After(2 * time.Second):
+		r.Fail("work not cancelled when claim was lost")
+	}
+	r.NoError(issuer.IssueTicket("jobs", "job-1", []byte("work")))
+	<-startedChan
+	// Stopping without waiting for work cancels it too
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r.True(errors.Is(w.StopContext(ctx), context.DeadlineExceeded))
+	<-cancelledChan
+}
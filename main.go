@@ -1,34 +1,284 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"flag"
+	"github.com/turbosquid/ticketd/cluster"
 	"github.com/turbosquid/ticketd/http"
 	"github.com/turbosquid/ticketd/ticket"
 	"github.com/turbosquid/ticketd/version"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
 	log.Printf("TicketD v%s starts...", version.VERSION)
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	// Flags
 	listenOn := flag.String("l", "0.0.0.0:8001", "Address/port to listen on")
 	snapshotPath := flag.String("snappath", "", "Snapshot path")
 	expireInterval := flag.Int("expire", 500, "Expiration interval in ms")
 	snapshotInterval := flag.Int("snapshot", 1000, "Snapshot interval in ms")
 	logLevel := flag.Int("loglevel", 1, "Numeric log level")
+	follow := flag.String("follow", "", "Base url of leader to follow (e.g. http://leader:8001). Empty to run as leader")
+	promoteAfter := flag.Int("promote-after", 0, "Promote follower to leader after leader is unreachable for this many ms. 0 to only promote by hand")
+	raftAddr := flag.String("raft", "", "Address/port for raft traffic. Set to run as a member of a raft cluster")
+	raftDir := flag.String("raft-dir", "raft", "Directory for the raft log and snapshots")
+	advertise := flag.String("advertise", "", "Base url other cluster members use to reach this node's api. Defaults to http://<listen address>")
+	bootstrap := flag.Bool("bootstrap", false, "Bootstrap a new cluster with this node as its only member")
+	join := flag.String("join", "", "Base url of a cluster member to join through")
+	record := flag.String("record", "", "Record the workload to this file, for replay")
+	check := flag.String("check", "off", "Check invariants after every operation (debug): off, log or panic")
+	keys := flag.String("keys", "", "Key file. Set to require authenticated requests. Re-read on SIGHUP")
+	acl := flag.String("acl", "", "Access control policy file. Applies to authenticated requests (see -keys). Re-read on SIGHUP")
+	quotas := flag.String("quotas", "", "Quota file, with limits per namespace. Re-read on SIGHUP")
+	rateLimits := flag.String("rate-limits", "", "Rate limit file, with request rates per route class. Re-read on SIGHUP")
+	auditLog := flag.String("audit-log", "", "Audit log file. Set to record every change as a line of json")
+	auditMaxMB := flag.Int("audit-max-mb", 100, "Rotate the audit log when it would grow past this many MB")
+	auditKeep := flag.Int("audit-keep", 5, "Rotated audit log files to keep")
+	revokeIssuerOnly := flag.Bool("revoke-issuer-only", false, "Only let the session that issued a ticket revoke it")
+	tlsCert := flag.String("tls-cert", "", "Server certificate (PEM). Set with -tls-key to serve https. Re-read on SIGHUP")
+	tlsKey := flag.String("tls-key", "", "Server key (PEM)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA (PEM) for client certificates. Set to ask clients for certificates (mutual TLS)")
+	tlsClientRoles := flag.String("tls-client-roles", "", "Comma separated roles for every client certificate when there is no -keys file. Empty for none")
+	tlsCA := flag.String("tls-ca", "", "CA (PEM) to trust when talking to other nodes. Empty for the system roots")
+	publicStatus := flag.Bool("public-status", false, "Let anyone read /status when requests are authenticated")
+	replay := flag.String("replay", "", "Replay a recorded workload from this file on a simulated clock, then serve the result")
 	flag.Parse()
-	td := ticket.NewTicketD(*expireInterval, *snapshotPath, *snapshotInterval, &ticket.DefaultLogger{*logLevel})
+	logger := &ticket.DefaultLogger{Level: *logLevel}
+	if *raftAddr != "" && *snapshotPath != "" {
+		log.Printf("Snapshots are handled by raft in cluster mode. Ignoring snappath")
+		*snapshotPath = ""
+	}
+	var clock ticket.Clock = ticket.NewFreezableClock(nil)
+	if *replay != "" {
+		if *follow != "" || *raftAddr != "" {
+			log.Fatalf("Can't replay as a follower or cluster member")
+		}
+		clock = ticket.NewManualClock(time.Time{})
+	}
+	td := ticket.NewTicketD(*expireInterval, *snapshotPath, *snapshotInterval, logger, clock)
+	switch *check {
+	case "off":
+	case "log":
+		td.SetCheckMode(ticket.CheckLog)
+	case "panic":
+		td.SetCheckMode(ticket.CheckPanic)
+	default:
+		log.Fatalf("Unknown check mode %s", *check)
+	}
+	if *revokeIssuerOnly {
+		td.SetRevokePolicy(ticket.RevokeIssuerOnly)
+	}
+	if *follow != "" {
+		td.Follow(*follow)
+	}
+	if *auditLog != "" {
+		l, err := ticket.OpenAuditLog(*auditLog, int64(*auditMaxMB)*1024*1024, *auditKeep)
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %s", err.Error())
+		}
+		defer l.Close()
+		td.SetAuditLog(l)
+	}
 	td.Start()
-	svr := http.StartServer(*listenOn, td)
-	sig := <-sigs
-	log.Printf("Received signal %#v", sig)
+	if *replay != "" {
+		replayFile(td, clock.(*ticket.ManualClock), *replay)
+	}
+	recordCtx, stopRecording := context.WithCancel(context.Background())
+	recordDone := make(chan interface{})
+	if *record != "" {
+		go recordFile(recordCtx, td, *record, recordDone)
+	} else {
+		close(recordDone)
+	}
+	var peerTLS *http.ClientTLS
+	var peerConfig *tls.Config
+	if *tlsCert != "" || *tlsCA != "" {
+		// We present our own certificate to other nodes
+		peerTLS = &http.ClientTLS{CAFile: *tlsCA, CertFile: *tlsCert, KeyFile: *tlsKey}
+		var err error
+		if peerConfig, err = peerTLS.Config(); err != nil {
+			log.Fatalf("Unable to set up TLS for other nodes: %s", err.Error())
+		}
+	}
+	var node *cluster.Node
+	if *raftAddr != "" {
+		if *advertise == "" && *tlsCert != "" {
+			*advertise = "https://" + *listenOn
+		} else if *advertise == "" {
+			*advertise = "http://" + *listenOn
+		}
+		var err error
+		cfg := &cluster.Config{Id: *advertise, RaftAddr: *raftAddr, DataDir: *raftDir, Bootstrap: *bootstrap, Logger: logger}
+		if node, err = cluster.NewNode(cfg, td); err != nil {
+			log.Fatalf("Unable to start cluster node: %s", err.Error())
+		}
+	}
+	follower := http.StartFollowerWithTLS(td, time.Duration(*promoteAfter)*time.Millisecond, peerConfig)
+	opts := &http.ServerOptions{PublicStatus: *publicStatus, PeerTLS: peerConfig}
+	if *tlsCert != "" {
+		var err error
+		if opts.TLS, err = http.NewServerTLS(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			log.Fatalf("Unable to load TLS certificate: %s", err.Error())
+		}
+		if *tlsClientRoles != "" {
+			opts.TLS.ClientRoles = strings.Split(*tlsClientRoles, ",")
+		} else if *tlsClientCA != "" && *keys == "" {
+			log.Printf("Warning: -tls-client-ca without -keys or -tls-client-roles. Client certificates get no roles")
+		}
+	} else if *tlsClientCA != "" {
+		log.Fatalf("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	if *keys != "" {
+		var err error
+		if opts.Auth, err = http.NewAuthenticator(*keys); err != nil {
+			log.Fatalf("Unable to load keys: %s", err.Error())
+		}
+	}
+	if *rateLimits != "" {
+		limits, err := http.LoadRateLimits(*rateLimits)
+		if err != nil {
+			log.Fatalf("Unable to load rate limits: %s", err.Error())
+		}
+		opts.RateLimiter = http.NewRateLimiter(limits)
+	}
+	if *acl != "" {
+		if *keys == "" && *tlsClientCA == "" {
+			log.Printf("Warning: -acl without -keys or -tls-client-ca. Requests are not authenticated, so the policy never applies")
+		}
+		policy, err := ticket.LoadPolicy(*acl)
+		if err != nil {
+			log.Fatalf("Unable to load access control policy: %s", err.Error())
+		}
+		td.SetPolicy(policy)
+	}
+	if *quotas != "" {
+		q, err := ticket.LoadQuotas(*quotas)
+		if err != nil {
+			log.Fatalf("Unable to load quotas: %s", err.Error())
+		}
+		td.SetQuotas(q)
+	}
+	svr := http.StartServerWithOptions(*listenOn, td, opts)
+	if node != nil && *join != "" {
+		go joinCluster(*join, *advertise, *raftAddr, peerTLS)
+	}
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received signal %#v", sig)
+			break
+		}
+		if opts.Auth != nil {
+			if err := opts.Auth.Reload(); err != nil {
+				log.Printf("Unable to reload keys, keeping the old ones: %s", err.Error())
+			}
+		}
+		if opts.TLS != nil {
+			if err := opts.TLS.Reload(); err != nil {
+				log.Printf("Unable to reload TLS certificate, keeping the old one: %s", err.Error())
+			}
+		}
+		if *acl != "" {
+			if policy, err := ticket.LoadPolicy(*acl); err != nil {
+				log.Printf("Unable to reload access control policy, keeping the old one: %s", err.Error())
+			} else {
+				td.SetPolicy(policy)
+				log.Printf("Loaded access control policy from %s", *acl)
+			}
+		}
+		if opts.RateLimiter != nil {
+			if limits, err := http.LoadRateLimits(*rateLimits); err != nil {
+				log.Printf("Unable to reload rate limits, keeping the old ones: %s", err.Error())
+			} else {
+				opts.RateLimiter.SetLimits(limits)
+				log.Printf("Loaded rate limits from %s", *rateLimits)
+			}
+		}
+		if *quotas != "" {
+			if q, err := ticket.LoadQuotas(*quotas); err != nil {
+				log.Printf("Unable to reload quotas, keeping the old ones: %s", err.Error())
+			} else {
+				td.SetQuotas(q)
+				log.Printf("Loaded quotas from %s", *quotas)
+			}
+		}
+	}
 	svr.Shutdown(context.Background())
+	follower.Stop()
+	stopRecording()
+	<-recordDone
+	if node != nil {
+		node.Shutdown()
+	}
 	td.Quit()
 	log.Printf("Done.")
 }
+
+// Ask an existing cluster member to add us. Retries until it works
+func joinCluster(member, id, raftAddr string, peerTLS *http.ClientTLS) {
+	cli := http.NewClient(member, 10*time.Second)
+	if peerTLS != nil {
+		if err := cli.UseTLS(peerTLS); err != nil {
+			log.Fatalf("Unable to set up TLS for joining: %s", err.Error())
+		}
+	}
+	for {
+		err := cli.AddMember(id, raftAddr)
+		if err == nil {
+			log.Printf("Joined cluster through %s", member)
+			return
+		}
+		log.Printf("Unable to join cluster through %s: %s. Retrying...", member, err.Error())
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Replay a recorded workload as fast as we can
+func replayFile(td *ticket.TicketD, clock *ticket.ManualClock, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Unable to open recording: %s", err.Error())
+	}
+	defer f.Close()
+	rec, err := ticket.ReadRecording(f)
+	if err != nil {
+		log.Fatalf("Unable to read recording: %s", err.Error())
+	}
+	start := time.Now()
+	results, err := ticket.Replay(context.Background(), td, clock, rec)
+	if err != nil {
+		log.Fatalf("Unable to replay recording: %s", err.Error())
+	}
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+	log.Printf("Replayed %d commands (%d failed) covering %s in %s", len(results), failed, clock.Now().Sub(rec.Time),
+		time.Since(start))
+}
+
+// Record the workload until ctx is done
+func recordFile(ctx context.Context, td *ticket.TicketD, path string, done chan interface{}) {
+	defer close(done)
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Unable to create recording: %s", err.Error())
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+	if err = ticket.Record(ctx, td, w); err != nil {
+		log.Printf("Recording stopped: %s", err.Error())
+	}
+}
@@ -0,0 +1,226 @@
+package ticket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Access control
+//
+// A Policy grants principals verbs on resources. Resources are named by patterns: a pattern with glob characters
+// (*, ? or [) is matched against the whole resource name with path.Match, so * does not match across a /. Any other
+// pattern is a prefix, and the pattern "*" on its own matches every resource. Verbs that are not about a resource
+// (admin calls like promotion) are checked against the empty resource name, which only "*" and the empty prefix match.
+// Grants apply in one namespace, the default namespace unless they name another, or in every namespace with "*".
+//
+// The principal making a call travels in its context (see WithPrincipal). Calls without a principal come from the
+// embedding program itself and are not checked, and nothing is checked until a policy is set with SetPolicy.
+
+// Things a principal can be allowed to do
+type Verb string
+
+const (
+	VerbIssue  Verb = "issue"  // Issue tickets (and sync them, with revoke)
+	VerbRevoke Verb = "revoke" // Revoke tickets
+	VerbClaim  Verb = "claim"  // Claim, release and check tickets
+	VerbLock   Verb = "lock"   // Lock and unlock
+	VerbDump   Verb = "dump"   // Read the resources and sessions tables
+	VerbAdmin  Verb = "admin"  // Administrative calls
+	VerbAll    Verb = "*"      // Every verb
+)
+
+var verbs = map[Verb]bool{VerbIssue: true, VerbRevoke: true, VerbClaim: true, VerbLock: true, VerbDump: true,
+	VerbAdmin: true, VerbAll: true}
+
+// A grant of verbs on resources to a principal
+type Grant struct {
+	Principal string   // Principal name, or "*" for everyone
+	Verbs     []Verb   // Verbs granted
+	Resources []string // Resource name prefixes or globs
+	Namespace string   // Namespace the grant applies in. Empty for the default namespace, "*" for every namespace
+}
+
+// An access control policy. Anything not granted is denied
+type Policy struct {
+	Grants []*Grant
+}
+
+type principalKeyType struct{}
+
+var principalKey principalKeyType
+
+// Get a context for calls made on behalf of a principal
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// Get the principal a context carries. ok is false if there is none
+func ContextPrincipal(ctx context.Context) (principal string, ok bool) {
+	principal, ok = ctx.Value(principalKey).(string)
+	return
+}
+
+// Load a policy from a json file
+func LoadPolicy(file string) (p *Policy, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	p = &Policy{}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", file, err)
+	}
+	if err = p.Validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", file, err)
+	}
+	return
+}
+
+// Check a policy for unknown verbs and bad patterns
+func (p *Policy) Validate() error {
+	for i, g := range p.Grants {
+		if g.Principal == "" {
+			return fmt.Errorf("grant %d has no principal", i)
+		}
+		if g.Namespace != "" && g.Namespace != "*" && !ValidNamespace(g.Namespace) {
+			return fmt.Errorf("grant %d has bad namespace %q", i, g.Namespace)
+		}
+		for _, v := range g.Verbs {
+			if !verbs[v] {
+				return fmt.Errorf("grant %d has unknown verb %q", i, v)
+			}
+		}
+		for _, pattern := range g.Resources {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("grant %d has bad resource pattern %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Is principal allowed verb on resource in the default namespace?
+func (p *Policy) Allowed(principal string, verb Verb, resource string) bool {
+	return p.AllowedIn(DefaultNamespace, principal, verb, resource)
+}
+
+// Is principal allowed verb on resource in a namespace?
+func (p *Policy) AllowedIn(namespace, principal string, verb Verb, resource string) bool {
+	for _, g := range p.Grants {
+		if g.grants(namespace, principal, verb) {
+			for _, pattern := range g.Resources {
+				if matchResource(pattern, resource) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Is principal allowed verb on any resource at all in the default namespace?
+func (p *Policy) AllowedAny(principal string, verb Verb) bool {
+	return p.AllowedAnyIn(DefaultNamespace, principal, verb)
+}
+
+// Is principal allowed verb on any resource at all in a namespace?
+func (p *Policy) AllowedAnyIn(namespace, principal string, verb Verb) bool {
+	for _, g := range p.Grants {
+		if g.grants(namespace, principal, verb) && len(g.Resources) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Grant) grants(namespace, principal string, verb Verb) bool {
+	if g.Principal != principal && g.Principal != "*" {
+		return false
+	}
+	if g.Namespace != "*" && normalNamespace(g.Namespace) != namespace {
+		return false
+	}
+	for _, v := range g.Verbs {
+		if v == verb || v == VerbAll {
+			return true
+		}
+	}
+	return false
+}
+
+func matchResource(pattern, resource string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, resource)
+		return ok
+	}
+	return strings.HasPrefix(resource, pattern)
+}
+
+// Set the access control policy. Nil turns access control off. Safe to call at any time
+func (td *TicketD) SetPolicy(p *Policy) {
+	td.policy.Store(p)
+}
+
+// Get the access control policy. Nil if there is none
+func (td *TicketD) Policy() *Policy {
+	return td.policy.Load()
+}
+
+// Check that the principal in ctx (if any) may do verb on resource, in the namespace of ctx. Fails with ErrForbidden
+// if not
+func (td *TicketD) Authorize(ctx context.Context, verb Verb, resource string) error {
+	p := td.Policy()
+	if p == nil {
+		return nil
+	}
+	principal, ok := ContextPrincipal(ctx)
+	if !ok || p.AllowedIn(ContextNamespace(ctx), principal, verb, resource) {
+		return nil
+	}
+	if resource == "" {
+		return fmt.Errorf("%s may not %s (%w)", principal, verb, ErrForbidden)
+	}
+	return fmt.Errorf("%s may not %s %s (%w)", principal, verb, resource, ErrForbidden)
+}
+
+// Check that the principal in ctx (if any) may do verb on some resource
+func (td *TicketD) authorizeAny(ctx context.Context, verb Verb) error {
+	p := td.Policy()
+	if p == nil {
+		return nil
+	}
+	principal, ok := ContextPrincipal(ctx)
+	if !ok || p.AllowedAnyIn(ContextNamespace(ctx), principal, verb) {
+		return nil
+	}
+	return fmt.Errorf("%s may not %s anything (%w)", principal, verb, ErrForbidden)
+}
+
+// Check a command against the policy. Session commands are open to everyone, and forced operations need admin
+func (td *TicketD) authorizeCommand(ctx context.Context, cmd *Command) (err error) {
+	switch cmd.Op {
+	case OpIssueTicket:
+		return td.Authorize(ctx, VerbIssue, cmd.Resource)
+	case OpRevokeTicket:
+		return td.Authorize(ctx, VerbRevoke, cmd.Resource)
+	case OpSyncTickets:
+		if err = td.Authorize(ctx, VerbIssue, cmd.Resource); err != nil {
+			return
+		}
+		return td.Authorize(ctx, VerbRevoke, cmd.Resource)
+	case OpClaimTicket, OpReleaseTicket:
+		return td.Authorize(ctx, VerbClaim, cmd.Resource)
+	case OpLock, OpUnlock:
+		return td.Authorize(ctx, VerbLock, cmd.Resource)
+	case OpForceCloseSession, OpCloseSessions, OpForceUnlock, OpForceRelease, OpDeleteResource:
+		return td.Authorize(ctx, VerbAdmin, cmd.Resource)
+	}
+	return nil
+}
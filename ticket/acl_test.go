@@ -0,0 +1,88 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyMatching(t *testing.T) {
+	r := require.New(t)
+	p := &Policy{Grants: []*Grant{
+		{Principal: "app", Verbs: []Verb{VerbIssue, VerbClaim}, Resources: []string{"jobs/"}},
+		{Principal: "app", Verbs: []Verb{VerbLock}, Resources: []string{"locks/*/leader"}},
+		{Principal: "ops", Verbs: []Verb{VerbAll}, Resources: []string{"*"}},
+		{Principal: "*", Verbs: []Verb{VerbDump}, Resources: []string{"public-"}},
+	}}
+	r.NoError(p.Validate())
+	r.True(p.Allowed("app", VerbIssue, "jobs/a/b"))
+	r.False(p.Allowed("app", VerbRevoke, "jobs/a"))
+	r.False(p.Allowed("app", VerbIssue, "other"))
+	r.True(p.Allowed("app", VerbLock, "locks/db/leader"))
+	r.False(p.Allowed("app", VerbLock, "locks/db/x/leader"))
+	r.True(p.Allowed("ops", VerbAdmin, ""))
+	r.False(p.Allowed("app", VerbAdmin, ""))
+	r.True(p.Allowed("anyone", VerbDump, "public-stuff"))
+	r.True(p.AllowedAny("app", VerbDump))
+	r.False(p.AllowedAny("app", VerbRevoke))
+	r.Error((&Policy{Grants: []*Grant{{Principal: "x", Verbs: []Verb{"fly"}}}}).Validate())
+	r.Error((&Policy{Grants: []*Grant{{Principal: "x", Resources: []string{"["}}}}).Validate())
+
+	// Policy files
+	file := filepath.Join(t.TempDir(), "acl.json")
+	r.NoError(ioutil.WriteFile(file, []byte(`{"Grants":[{"Principal":"app","Verbs":["issue"],"Resources":["jobs/"]}]}`), 0600))
+	p, err := LoadPolicy(file)
+	r.NoError(err)
+	r.True(p.Allowed("app", VerbIssue, "jobs/1"))
+	r.NoError(ioutil.WriteFile(file, []byte(`{"Grants":[{"Principal":"app","Verbs":["issue"],"Resources":["["]}]}`), 0600))
+	_, err = LoadPolicy(file)
+	r.Error(err)
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	td.SetPolicy(&Policy{Grants: []*Grant{
+		{Principal: "app", Verbs: []Verb{VerbIssue, VerbRevoke, VerbClaim, VerbLock, VerbDump}, Resources: []string{"app/"}},
+	}})
+	app := NewLocalClient(td)
+	app.Principal = "app"
+	sess, err := app.OpenSession("app", 5000)
+	r.NoError(err)
+	r.NoError(sess.IssueTicket("app/jobs", "t1", []byte("data")))
+	ok, _, err := sess.ClaimTicket("app/jobs")
+	r.NoError(err)
+	r.True(ok)
+	ok, err = sess.Lock("app/lock")
+	r.NoError(err)
+	r.True(ok)
+	r.True(errors.Is(sess.IssueTicket("other", "t1", nil), ErrForbidden))
+	_, err = sess.Lock("other-lock")
+	r.True(errors.Is(err, ErrForbidden))
+	_, err = sess.HasTicket("other", "t1")
+	r.True(errors.Is(err, ErrForbidden))
+
+	// The embedding program itself is not checked
+	r.NoError(td.IssueTicket(sess.Id, "other", "t1", nil))
+
+	// Dumps only show what the principal may see
+	ctx := WithPrincipal(context.Background(), "app")
+	resources, err := td.GetResourcesContext(ctx)
+	r.NoError(err)
+	r.Contains(resources, "app/jobs")
+	r.NotContains(resources, "other")
+	sessions, err := td.GetSessionsContext(ctx)
+	r.NoError(err)
+	r.Len(sessions[sess.Id].Issuances, 2) // app/jobs and app/lock, but not other
+	_, err = td.GetResourcesContext(WithPrincipal(context.Background(), "stranger"))
+	r.True(errors.Is(err, ErrForbidden))
+	r.True(errors.Is(td.Authorize(ctx, VerbAdmin, ""), ErrForbidden))
+
+	// No policy, no checks
+	td.SetPolicy(nil)
+	r.NoError(sess.IssueTicket("other", "t2", nil))
+}
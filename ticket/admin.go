@@ -0,0 +1,184 @@
+package ticket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Forced operations
+//
+// Forced operations let an operator clear up after a stuck client without waiting out its session ttl: closing
+// sessions, unlocking locks, releasing claims and deleting resources, whoever holds them. They need the admin verb,
+// are not bound to a session (so no session token is needed), and act in the namespace of the call. Every forced
+// operation is audited, whether it succeeds or not.
+
+const (
+	OpForceCloseSession Op = "force-close-session"
+	OpForceUnlock       Op = "force-unlock"
+	OpForceRelease      Op = "force-release"
+	OpDeleteResource    Op = "delete-resource"
+	OpCloseSessions     Op = "close-sessions"
+)
+
+// Is this a forced operation?
+func (op Op) forced() bool {
+	switch op {
+	case OpForceCloseSession, OpForceUnlock, OpForceRelease, OpDeleteResource, OpCloseSessions:
+		return true
+	}
+	return false
+}
+
+// Close a session, whoever owns it
+func (td *TicketD) ForceCloseSession(id string) (err error) {
+	return td.ForceCloseSessionContext(context.Background(), id)
+}
+
+// Close a session, whoever owns it, giving up when ctx is done
+func (td *TicketD) ForceCloseSessionContext(ctx context.Context, id string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpForceCloseSession, SessId: id}).Err
+	return
+}
+
+// Close every session with a name, or from a source, or both. A source without a port matches sessions from any
+// port on that host. Returns the ids of the sessions closed, sorted
+func (td *TicketD) CloseSessions(name, src string) (closed []string, err error) {
+	return td.CloseSessionsContext(context.Background(), name, src)
+}
+
+// Close every session with a name, or from a source, or both, giving up when ctx is done
+func (td *TicketD) CloseSessionsContext(ctx context.Context, name, src string) (closed []string, err error) {
+	res := td.execute(ctx, &Command{Op: OpCloseSessions, Name: name, Src: src})
+	closed, err = res.Closed, res.Err
+	return
+}
+
+// Unlock a lock, whoever holds it
+func (td *TicketD) ForceUnlock(resource string) (err error) {
+	return td.ForceUnlockContext(context.Background(), resource)
+}
+
+// Unlock a lock, whoever holds it, giving up when ctx is done
+func (td *TicketD) ForceUnlockContext(ctx context.Context, resource string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpForceUnlock, Resource: resource}).Err
+	return
+}
+
+// Release the claim on a ticket, whoever holds it. Releasing an unclaimed ticket is not an error
+func (td *TicketD) ForceRelease(resource, name string) (err error) {
+	return td.ForceReleaseContext(context.Background(), resource, name)
+}
+
+// Release the claim on a ticket, whoever holds it, giving up when ctx is done
+func (td *TicketD) ForceReleaseContext(ctx context.Context, resource, name string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpForceRelease, Resource: resource, Name: name}).Err
+	return
+}
+
+// Delete a resource and all its tickets, revoking them from their issuers and claimants
+func (td *TicketD) DeleteResource(resource string) (err error) {
+	return td.DeleteResourceContext(context.Background(), resource)
+}
+
+// Delete a resource and all its tickets, giving up when ctx is done
+func (td *TicketD) DeleteResourceContext(ctx context.Context, resource string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpDeleteResource, Resource: resource}).Err
+	return
+}
+
+func (td *TicketD) applyForceCloseSession(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	s := sessions[cmd.SessId]
+	if s == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	td.logger.Log(3, "Force closing session %s (%s)", s.Id, s.Name)
+	s.clearClaims(resources)
+	delete(sessions, s.Id)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyCloseSessions(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	if cmd.Name == "" && cmd.Src == "" {
+		return &Result{Err: fmt.Errorf("closing sessions needs a name or a source")}
+	}
+	closed := []string{}
+	for id, s := range sessions {
+		if normalNamespace(s.Namespace) != cmd.namespace() || (cmd.Name != "" && s.Name != cmd.Name) {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(s.Src); cmd.Src != "" && s.Src != cmd.Src && (err != nil || host != cmd.Src) {
+			continue
+		}
+		td.logger.Log(3, "Force closing session %s (%s)", s.Id, s.Name)
+		s.clearClaims(resources)
+		delete(sessions, id)
+		closed = append(closed, id)
+	}
+	sort.Strings(closed)
+	return &Result{Ok: true, Closed: closed}
+}
+
+func (td *TicketD) applyForceUnlock(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		return &Result{Err: fmt.Errorf("could not find lock resource %s (%w)", cmd.Resource, ErrNotFound)}
+	} else if !r.IsLock {
+		return &Result{Err: fmt.Errorf("cannot lock/unlock a non-lock  resource (%s) - %w", cmd.Resource, ErrResourceType)}
+	}
+	ticket := r.Tickets[cmd.Resource]
+	if ticket == nil {
+		return &Result{Err: fmt.Errorf("Resource %s is not locked (%w)", cmd.Resource, ErrNotFound)}
+	}
+	td.logger.Log(3, "Force unlocking %s", r.Name)
+	revoke(r, ticket)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyForceRelease(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		return &Result{Err: fmt.Errorf("unknown resource: %s (%w)", cmd.Resource, ErrNotFound)}
+	} else if r.IsLock {
+		return &Result{Err: fmt.Errorf("cannot release a ticket on a lock resource (%s) - %w", cmd.Resource, ErrResourceType)}
+	}
+	ticket := r.Tickets[cmd.Name]
+	if ticket == nil {
+		return &Result{Err: fmt.Errorf("unknown ticket for resource %s -> : %s (%w)", cmd.Resource, cmd.Name, ErrNotFound)}
+	}
+	if ticket.Claimant != nil {
+		td.logger.Log(3, "Force releasing ticket %s (%s) from session %s", r.Name, ticket.Name, ticket.Claimant.Id)
+		ticket.Claimant.Tickets = ticketRemove(ticket.Claimant.Tickets, ticket)
+		ticket.Claimant, ticket.ClaimedAt = nil, time.Time{}
+	}
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyDeleteResource(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	key := resourceKey(cmd.namespace(), cmd.Resource)
+	r := resources[key]
+	if r == nil {
+		return &Result{Err: fmt.Errorf("unknown resource: %s (%w)", cmd.Resource, ErrNotFound)}
+	}
+	td.logger.Log(3, "Deleting resource %s with %d tickets", r.Name, len(r.Tickets))
+	for _, ticket := range r.Tickets {
+		revoke(r, ticket)
+	}
+	delete(resources, key)
+	return &Result{Ok: true}
+}
+
+// Take a ticket off its resource, and out of its issuer's and claimant's lists
+func revoke(r *Resource, ticket *Ticket) {
+	if ticket.Issuer != nil {
+		ticket.Issuer.Issuances = ticketRemove(ticket.Issuer.Issuances, ticket)
+		ticket.Issuer = nil
+	}
+	if ticket.Claimant != nil {
+		ticket.Claimant.Tickets = ticketRemove(ticket.Claimant.Tickets, ticket)
+		ticket.Claimant = nil
+	}
+	delete(r.Tickets, ticket.Name)
+}
@@ -0,0 +1,82 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestForcedOperations(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	cli := NewLocalClient(td)
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	stuck, err := cli.OpenSession("stuck", 5000)
+	r.NoError(err)
+	r.NoError(issuer.IssueTicket("jobs", "t1", nil))
+	r.NoError(issuer.IssueTicket("jobs", "t2", nil))
+	ok, tk, err := stuck.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+	ok, err = stuck.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+
+	// Release a claim and unlock a lock from under the stuck session
+	r.NoError(td.ForceRelease("jobs", tk.Name))
+	sess, err := td.GetSession(stuck.Id)
+	r.NoError(err)
+	r.Empty(sess.Tickets)
+	r.NoError(td.ForceUnlock("leader"))
+	ok, err = issuer.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+	r.True(errors.Is(td.ForceUnlock("jobs"), ErrResourceType))
+	r.True(errors.Is(td.ForceRelease("jobs", "nope"), ErrNotFound))
+
+	// Delete a resource with claimed tickets
+	ok, _, err = stuck.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(td.DeleteResource("jobs"))
+	r.Nil(td.GetResources()["jobs"])
+	for _, id := range []string{issuer.Id, stuck.Id} {
+		sess, err = td.GetSession(id)
+		r.NoError(err)
+		r.Empty(sess.Tickets)
+		for _, t := range sess.Issuances {
+			r.NotEqual("jobs", t.ResourceName)
+		}
+	}
+	r.True(errors.Is(td.DeleteResource("jobs"), ErrNotFound))
+
+	// Close sessions, one at a time or in bulk, without their tokens
+	r.NoError(td.ForceCloseSession(stuck.Id))
+	_, err = td.GetSession(stuck.Id)
+	r.True(errors.Is(err, ErrNotFound))
+	for i := 0; i < 3; i++ {
+		_, err = cli.OpenSession("worker", 5000)
+		r.NoError(err)
+	}
+	closed, err := td.CloseSessions("worker", "")
+	r.NoError(err)
+	r.Len(closed, 3)
+	closed, err = td.CloseSessions("", "local")
+	r.NoError(err)
+	r.Equal([]string{issuer.Id}, closed)
+	r.Nil(td.GetResources()["leader"].Tickets["leader"].Issuer) // Cleared away by the next expiry, as with any close
+	_, err = td.CloseSessions("", "")
+	r.Error(err)
+
+	// Forced operations need the admin verb
+	td.SetPolicy(&Policy{Grants: []*Grant{{Principal: "ops", Verbs: []Verb{VerbAdmin}, Resources: []string{"ops-"}}}})
+	defer td.SetPolicy(nil)
+	ctx := WithPrincipal(context.Background(), "app")
+	r.True(errors.Is(td.ForceUnlockContext(ctx, "ops-leader"), ErrForbidden))
+	ctx = WithPrincipal(context.Background(), "ops")
+	r.True(errors.Is(td.ForceUnlockContext(ctx, "ops-leader"), ErrNotFound))
+	r.True(errors.Is(td.DeleteResourceContext(ctx, "other"), ErrForbidden))
+}
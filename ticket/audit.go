@@ -0,0 +1,377 @@
+package ticket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit log
+//
+// The audit log records every change to ticketd state as a line of json: who did what to which resource and ticket,
+// from where, when, and how it went. Entries are written as commands are committed, so a leader writes them all, and
+// in a cluster every member keeps a full log of its own. Followers don't write entries until they are promoted.
+// Session refreshes are left out; there are far too many of them to be useful. Commands refused by the access
+// control policy never get to be committed, and are audited as they are refused.
+//
+// The log rotates by size: when the file would grow past its limit it is renamed to <file>.1, older files move up
+// one, and the oldest is dropped.
+//
+// Entries for committed commands carry the command's sequence number. When a cluster member restarts, raft applies
+// the commands after its last snapshot again. Those were audited before the restart, so commands at or below the
+// highest sequence number in the log are not audited again. Outside a cluster sequence numbers start again from
+// zero on restart, so every command is audited.
+
+// Outcomes of audited operations
+const (
+	AuditOk      = "ok"      // Done
+	AuditRefused = "refused" // Nothing to claim, or the lock is held by another session
+	AuditFailed  = "failed"  // Failed with an error, in Error
+)
+
+// An audit log entry
+type AuditEntry struct {
+	Seq       uint64 `json:",omitempty"` // Sequence number of the command. Zero for commands that were refused
+	Time      time.Time
+	Op        Op
+	Namespace string
+	SessId    string `json:",omitempty"`
+	SessName  string `json:",omitempty"` // Name of the session
+	Src       string `json:",omitempty"` // Source of the session, or the source sessions were closed for
+	Principal string `json:",omitempty"`
+	Resource  string `json:",omitempty"`
+	Ticket    string `json:",omitempty"`
+	Outcome   string
+	Error     string `json:",omitempty"`
+}
+
+// What to look for in the audit log. Empty fields match everything
+type AuditQuery struct {
+	Namespace string
+	Resource  string
+	SessId    string
+	SessName  string
+	Since     time.Time
+	Limit     int // Most recent entries to return. 0 for 100
+}
+
+// An append only, size rotated, json lines audit log. Safe for concurrent use
+type AuditLog struct {
+	path     string
+	maxBytes int64
+	keep     int
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	lastSeq  uint64 // Highest sequence number written
+}
+
+// Open an audit log, appending to the file if it exists. The file is rotated when it would grow past maxBytes, and
+// keep rotated files are kept
+func OpenAuditLog(path string, maxBytes int64, keep int) (l *AuditLog, err error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("audit log size limit must be positive")
+	}
+	l = &AuditLog{path: path, maxBytes: maxBytes, keep: keep}
+	if err = l.open(); err != nil {
+		return nil, err
+	}
+	if err = l.findLastSeq(); err != nil {
+		l.f.Close()
+		return nil, err
+	}
+	return
+}
+
+// Find the highest sequence number written, from the newest file that has any entries
+func (l *AuditLog) findLastSeq() (err error) {
+	files, err := l.openAll()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		entries, err := queryFile(files[i], &AuditQuery{}, nil, math.MaxInt)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Seq > l.lastSeq {
+				l.lastSeq = e.Seq
+			}
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+	}
+	return
+}
+
+// Has a command been audited already?
+func (l *AuditLog) written(seq uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return seq <= l.lastSeq
+}
+
+func (l *AuditLog) open() (err error) {
+	if l.f, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return
+	}
+	info, err := l.f.Stat()
+	if err != nil {
+		l.f.Close()
+		return
+	}
+	l.size = info.Size()
+	return
+}
+
+// Append an entry
+func (l *AuditLog) Write(e *AuditEntry) (err error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err = l.rotate(); err != nil {
+			return
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err == nil && e.Seq > l.lastSeq {
+		l.lastSeq = e.Seq
+	}
+	return
+}
+
+// Move the current file to <path>.1, and older files up one. Must be called with the lock held
+func (l *AuditLog) rotate() (err error) {
+	l.f.Close()
+	l.f = nil
+	os.Remove(l.rotated(l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(l.rotated(i), l.rotated(i+1))
+	}
+	if l.keep > 0 {
+		err = os.Rename(l.path, l.rotated(1))
+	} else {
+		err = os.Remove(l.path)
+	}
+	if err != nil {
+		return
+	}
+	return l.open()
+}
+
+func (l *AuditLog) rotated(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// Close the log
+func (l *AuditLog) Close() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		err = l.f.Close()
+		l.f = nil
+	}
+	return
+}
+
+// Find the most recent entries matching a query, oldest first. Rotated files are searched too. The files are only
+// opened with the lock held, so writes (which the ticket loop waits on) aren't held up while we search
+func (l *AuditLog) Query(q *AuditQuery) (entries []*AuditEntry, err error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	l.mu.Lock()
+	files, err := l.openAll()
+	l.mu.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return
+	}
+	entries = []*AuditEntry{}
+	for _, f := range files {
+		if entries, err = queryFile(f, q, entries, limit); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// An audit file opened for a query, and how much of it had been written when it was opened
+type auditFile struct {
+	*os.File
+	size int64
+}
+
+// Open the current and rotated files, oldest first. Open files are not affected by rotation, and writes after the
+// files are opened are left out. Must be called with the lock held
+func (l *AuditLog) openAll() (files []*auditFile, err error) {
+	for i := l.keep; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotated(i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return files, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return files, err
+		}
+		files = append(files, &auditFile{File: f, size: info.Size()})
+	}
+	return
+}
+
+// Add the entries in a file that match a query, keeping at most limit
+func queryFile(f *auditFile, q *AuditQuery, entries []*AuditEntry, limit int) ([]*AuditEntry, error) {
+	scanner := bufio.NewScanner(io.LimitReader(f, f.size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if json.Unmarshal(scanner.Bytes(), e) != nil || !q.matches(e) {
+			continue
+		}
+		if entries = append(entries, e); len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (q *AuditQuery) matches(e *AuditEntry) bool {
+	return (q.Namespace == "" || e.Namespace == q.Namespace) && (q.Resource == "" || e.Resource == q.Resource) &&
+		(q.SessId == "" || e.SessId == q.SessId) && (q.SessName == "" || e.SessName == q.SessName) &&
+		!e.Time.Before(q.Since)
+}
+
+// Write audit entries to l. Nil to stop
+func (td *TicketD) SetAuditLog(l *AuditLog) {
+	td.auditLog.Store(l)
+}
+
+// Get the audit log. Nil if there is none
+func (td *TicketD) AuditLog() *AuditLog {
+	return td.auditLog.Load()
+}
+
+// Work out the audit entries for a command, before it is applied. Commands that change nothing worth auditing get
+// none. Must only be called from the ticket loop
+func auditEntries(sessions map[string]*Session, cmd *Command) (entries []*AuditEntry) {
+	entry := func(s *Session) *AuditEntry {
+		e := &AuditEntry{Time: cmd.Time, Op: cmd.Op, Namespace: cmd.namespace(), SessId: cmd.SessId,
+			Principal: cmd.Principal, Resource: cmd.Resource, Ticket: cmd.Name}
+		if s != nil {
+			e.SessId, e.SessName, e.Src = s.Id, s.Name, s.Src
+			if e.Principal == "" {
+				e.Principal = s.Principal
+			}
+		}
+		return e
+	}
+	switch cmd.Op {
+	case OpRefreshSession:
+		return nil
+	case OpExpire:
+		for _, s := range sessions {
+			if s.ExpiresAt.Before(cmd.Time) {
+				e := entry(s)
+				e.Namespace = normalNamespace(s.Namespace)
+				entries = append(entries, e)
+			}
+		}
+		return
+	case OpOpenSession:
+		e := entry(nil)
+		e.SessName, e.Src, e.Ticket = cmd.Name, cmd.Src, ""
+		return []*AuditEntry{e}
+	case OpCloseSessions:
+		e := entry(nil)
+		e.SessName, e.Src, e.Ticket = cmd.Name, cmd.Src, ""
+		return []*AuditEntry{e}
+	case OpLock, OpUnlock, OpForceUnlock:
+		e := entry(sessions[cmd.SessId])
+		e.Ticket = cmd.Resource
+		return []*AuditEntry{e}
+	}
+	return []*AuditEntry{entry(sessions[cmd.SessId])}
+}
+
+// Fill in how the command with sequence number seq went, and write its entries. Commands raft applies again after a
+// restart are skipped
+func (td *TicketD) audit(seq uint64, replayed bool, entries []*AuditEntry, res *Result) {
+	if l := td.AuditLog(); len(entries) > 0 && l != nil && td.Clustered() && l.written(seq) {
+		return
+	}
+	for _, e := range entries {
+		e.Seq = seq
+		switch {
+		case res.Err != nil:
+			e.Outcome, e.Error = AuditFailed, res.Err.Error()
+		case res.Ok || e.Op == OpExpire:
+			e.Outcome = AuditOk
+		default:
+			e.Outcome = AuditRefused
+		}
+		if e.Op == OpClaimTicket && res.Ticket != nil {
+			e.Ticket = res.Ticket.Name
+		}
+		td.writeAudit(e, replayed)
+	}
+}
+
+// Audit a command the access control policy refused
+func (td *TicketD) auditRefused(ctx context.Context, cmd *Command, err error) {
+	if td.AuditLog() == nil && !cmd.Op.forced() {
+		return
+	}
+	principal, _ := ContextPrincipal(ctx)
+	td.writeAudit(&AuditEntry{Time: td.clock.Now(), Op: cmd.Op, Namespace: ContextNamespace(ctx), SessId: cmd.SessId,
+		Principal: principal, Resource: cmd.Resource, Ticket: cmd.Name, Outcome: AuditFailed, Error: err.Error()}, false)
+}
+
+// Write an audit entry. Forced operations are logged too, so they are seen even without an audit log, unless they
+// are being replayed
+func (td *TicketD) writeAudit(e *AuditEntry, replayed bool) {
+	if e.Op.forced() && !replayed {
+		td.logger.Log(0, "AUDIT: %s %s in namespace %s (session %q, name %q, src %q, resource %q, ticket %q): %s %s",
+			e.Principal, e.Op, e.Namespace, e.SessId, e.SessName, e.Src, e.Resource, e.Ticket, e.Outcome, e.Error)
+	}
+	l := td.AuditLog()
+	if l == nil {
+		return
+	}
+	if err := l.Write(e); err != nil {
+		td.logger.Log(0, "Unable to write audit log: %s", err.Error())
+	}
+}
@@ -0,0 +1,160 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenAuditLog(path, 1024, 2)
+	r.NoError(err)
+	defer l.Close()
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		r.NoError(l.Write(&AuditEntry{Time: start.Add(time.Duration(i) * time.Second), Op: OpClaimTicket,
+			Namespace: DefaultNamespace, SessId: "s1", Resource: "jobs", Outcome: AuditOk}))
+	}
+	r.FileExists(path + ".1")
+	r.FileExists(path + ".2")
+	r.NoFileExists(path + ".3")
+	// Only what is left after rotation can be found, and the most recent entries come back, oldest first
+	entries, err := l.Query(&AuditQuery{Limit: 1000})
+	r.NoError(err)
+	r.True(len(entries) > 0 && len(entries) < 100)
+	r.Equal(start.Add(99*time.Second).Unix(), entries[len(entries)-1].Time.Unix())
+	entries, err = l.Query(&AuditQuery{Limit: 3})
+	r.NoError(err)
+	r.Len(entries, 3)
+	r.Equal(start.Add(97*time.Second).Unix(), entries[0].Time.Unix())
+	entries, err = l.Query(&AuditQuery{Since: start.Add(98 * time.Second)})
+	r.NoError(err)
+	r.Len(entries, 2)
+	entries, err = l.Query(&AuditQuery{Resource: "other"})
+	r.NoError(err)
+	r.Empty(entries)
+	// Reopening appends
+	r.NoError(l.Close())
+	l, err = OpenAuditLog(path, 1024, 2)
+	r.NoError(err)
+	r.NoError(l.Write(&AuditEntry{Time: start.Add(100 * time.Second), Op: OpLock, Resource: "leader", Outcome: AuditOk}))
+	entries, err = l.Query(&AuditQuery{Limit: 2})
+	r.NoError(err)
+	r.Equal(OpClaimTicket, entries[0].Op)
+	r.Equal(OpLock, entries[1].Op)
+}
+
+func TestAuditedOperations(t *testing.T) {
+	r := require.New(t)
+	l, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), 1024*1024, 1)
+	r.NoError(err)
+	defer l.Close()
+	td := NewTicketD(100, "", 0, &DefaultLogger{*logLevel}, nil)
+	td.SetCheckMode(CheckPanic)
+	td.SetAuditLog(l)
+	td.Start()
+	defer stopTicketD(td)
+	cli := NewLocalClient(td)
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	worker, err := cli.OpenSession("worker", 200)
+	r.NoError(err)
+	r.NoError(issuer.IssueTicket("jobs", "t1", nil))
+	ok, tk, err := worker.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+	ok, _, err = issuer.ClaimTicket("jobs")
+	r.NoError(err)
+	r.False(ok)
+	ok, err = issuer.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+	ok, err = worker.Lock("leader")
+	r.NoError(err)
+	r.False(ok)
+	r.NoError(worker.Refresh())
+	r.True(errors.Is(td.ForceUnlock("nope"), ErrNotFound))
+
+	entries, err := l.Query(&AuditQuery{SessId: worker.Id})
+	r.NoError(err)
+	r.Len(entries, 3) // Refreshes are left out
+	r.Equal(OpOpenSession, entries[0].Op)
+	r.Equal("worker", entries[0].SessName)
+	r.Equal("local", entries[0].Src)
+	r.Equal(OpClaimTicket, entries[1].Op)
+	r.Equal(AuditOk, entries[1].Outcome)
+	r.Equal("jobs", entries[1].Resource)
+	r.Equal(tk.Name, entries[1].Ticket)
+	r.Equal("worker", entries[1].SessName)
+	r.Equal(OpLock, entries[2].Op)
+	r.Equal("leader", entries[2].Ticket)
+	r.Equal(AuditRefused, entries[2].Outcome)
+	entries, err = l.Query(&AuditQuery{SessName: "issuer", Resource: "jobs"})
+	r.NoError(err)
+	r.Len(entries, 2)
+	r.Equal(OpIssueTicket, entries[0].Op)
+	r.Equal("t1", entries[0].Ticket)
+	r.Equal(AuditRefused, entries[1].Outcome)
+	entries, err = l.Query(&AuditQuery{Resource: "nope"})
+	r.NoError(err)
+	r.Len(entries, 1)
+	r.Equal(AuditFailed, entries[0].Outcome)
+	r.NotEmpty(entries[0].Error)
+
+	// Expiry is audited per session
+	time.Sleep(500 * time.Millisecond)
+	entries, err = l.Query(&AuditQuery{SessId: worker.Id, Limit: 1})
+	r.NoError(err)
+	r.Len(entries, 1)
+	r.Equal(OpExpire, entries[0].Op)
+	r.Equal("worker", entries[0].SessName)
+
+	// So is what the access control policy refuses
+	td.SetPolicy(&Policy{Grants: []*Grant{{Principal: "app", Verbs: []Verb{VerbClaim}, Resources: []string{"jobs"}}}})
+	defer td.SetPolicy(nil)
+	ctx := WithPrincipal(context.Background(), "app")
+	r.True(errors.Is(td.DeleteResourceContext(ctx, "jobs"), ErrForbidden))
+	entries, err = l.Query(&AuditQuery{Resource: "jobs", Limit: 1})
+	r.NoError(err)
+	r.Equal(OpDeleteResource, entries[0].Op)
+	r.Equal("app", entries[0].Principal)
+	r.Equal(AuditFailed, entries[0].Outcome)
+}
+
+func TestAuditQueryWhileWriting(t *testing.T) {
+	r := require.New(t)
+	l, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), 2048, 3)
+	r.NoError(err)
+	defer l.Close()
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 2000; i++ {
+			if err := l.Write(&AuditEntry{Time: start.Add(time.Duration(i) * time.Second), Op: OpIssueTicket,
+				Resource: "jobs", Outcome: AuditOk}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	// Queries see whole entries, in order, however the files rotate under them
+	for writing := true; writing; {
+		select {
+		case err = <-done:
+			r.NoError(err)
+			writing = false
+		default:
+		}
+		entries, err := l.Query(&AuditQuery{Limit: 1000})
+		r.NoError(err)
+		for i := 1; i < len(entries); i++ {
+			r.True(entries[i].Time.After(entries[i-1].Time))
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Client interfaces
+//
+// Code that uses ticketd can be written against Client and ClientSession, and then run against a remote server (the
+// http package's Client and Session implement them) or an in-process TicketD (LocalClient). Errors differ between the
+// two: a LocalClient returns ticketd errors, the http client returns http errors. Use errors.Is(err, ErrNotFound),
+// which works for both.
+
+// Opens sessions
+type Client interface {
+	NewSession(ctx context.Context, name string, ttlMs int) (ClientSession, error)
+}
+
+// A client session. Sessions should not be shared across goroutines
+type ClientSession interface {
+	SessionId() string
+	Get() (*Session, error)
+	GetContext(ctx context.Context) (*Session, error)
+	Close() error
+	CloseContext(ctx context.Context) error
+	Refresh() error
+	RefreshContext(ctx context.Context) error
+	RunHeartbeat(interval time.Duration, timeout time.Duration, ignoreNonHttpErrors bool, notify func(err error))
+	CancelHeartBeat()
+	IssueTicket(resource, name string, data []byte) error
+	IssueTicketContext(ctx context.Context, resource, name string, data []byte) error
+	RevokeTicket(resource, name string) error
+	RevokeTicketContext(ctx context.Context, resource, name string) error
+	SyncTickets(resource string, tickets map[string][]byte) (*SyncResult, error)
+	SyncTicketsContext(ctx context.Context, resource string, tickets map[string][]byte) (*SyncResult, error)
+	ClaimTicket(resource string) (bool, *Ticket, error)
+	ClaimTicketContext(ctx context.Context, resource string) (bool, *Ticket, error)
+	ReleaseTicket(resource, name string) error
+	ReleaseTicketContext(ctx context.Context, resource, name string) error
+	HasTicket(resource, name string) (bool, error)
+	HasTicketContext(ctx context.Context, resource, name string) (bool, error)
+	Lock(resource string) (bool, error)
+	LockContext(ctx context.Context, resource string) (bool, error)
+	Unlock(resource string) error
+	UnlockContext(ctx context.Context, resource string) error
+}
+
+var (
+	_ Client        = (*LocalClient)(nil)
+	_ ClientSession = (*LocalSession)(nil)
+)
+
+// A Client for an in-process TicketD
+type LocalClient struct {
+	td        *TicketD
+	Src       string // Reported as the source of sessions we open
+	Principal string // Calls are made on behalf of this principal, and checked against the policy. Empty for none
+	Namespace string // Sessions are opened in this namespace. Empty for the default namespace
+}
+
+// A ClientSession on an in-process TicketD
+type LocalSession struct {
+	td            *TicketD
+	Id            string
+	Token         string // Session token, presented with every call
+	principal     string
+	namespace     string
+	heartBeatStop context.CancelFunc
+	heartBeatWg   sync.WaitGroup
+}
+
+// Create a client for an in-process TicketD
+func NewLocalClient(td *TicketD) (c *LocalClient) {
+	c = &LocalClient{td: td, Src: "local"}
+	return
+}
+
+// Open a new session, as a ClientSession
+func (c *LocalClient) NewSession(ctx context.Context, name string, ttlMs int) (s ClientSession, err error) {
+	sess, err := c.OpenSessionContext(ctx, name, ttlMs)
+	if err == nil {
+		s = sess
+	}
+	return
+}
+
+// Open a new session
+func (c *LocalClient) OpenSession(name string, ttlMs int) (s *LocalSession, err error) {
+	return c.OpenSessionContext(context.Background(), name, ttlMs)
+}
+
+// Open a new session, giving up when ctx is done
+func (c *LocalClient) OpenSessionContext(ctx context.Context, name string, ttlMs int) (s *LocalSession, err error) {
+	ctx = withNamespace(withPrincipal(ctx, c.Principal), c.Namespace)
+	res := c.td.SubmitContext(ctx, &Command{Op: OpOpenSession, Name: name, Src: c.Src, Ttl: ttlMs})
+	if err = res.Err; err != nil {
+		return
+	}
+	s = &LocalSession{td: c.td, Id: res.SessId, Token: res.Token, principal: c.Principal, namespace: c.Namespace}
+	return
+}
+
+// Add the principal (if any) to a context
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	if principal == "" {
+		return ctx
+	}
+	return WithPrincipal(ctx, principal)
+}
+
+func withNamespace(ctx context.Context, namespace string) context.Context {
+	if namespace == "" {
+		return ctx
+	}
+	return WithNamespace(ctx, namespace)
+}
+
+// Add our principal, namespace and session token to a context
+func (s *LocalSession) context(ctx context.Context) context.Context {
+	return WithSessionToken(withNamespace(withPrincipal(ctx, s.principal), s.namespace), s.Token)
+}
+
+func (s *LocalSession) SessionId() string {
+	return s.Id
+}
+
+func (s *LocalSession) Get() (*Session, error) {
+	return s.GetContext(context.Background())
+}
+
+func (s *LocalSession) GetContext(ctx context.Context) (*Session, error) {
+	return s.td.GetSessionContext(s.context(ctx), s.Id)
+}
+
+// Close the session. Cancels the heartbeat if one is running
+func (s *LocalSession) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+func (s *LocalSession) CloseContext(ctx context.Context) error {
+	s.CancelHeartBeat()
+	return s.td.CloseSessionContext(s.context(ctx), s.Id)
+}
+
+func (s *LocalSession) Refresh() error {
+	return s.RefreshContext(context.Background())
+}
+
+func (s *LocalSession) RefreshContext(ctx context.Context) error {
+	return s.td.RefreshSessionContext(s.context(ctx), s.Id)
+}
+
+// Refresh the session every interval until it is closed or a refresh fails. notify is called when the heartbeat
+// ends. timeout bounds each refresh. Local refreshes only fail for good reasons, so ignoreNonHttpErrors only lets
+// a heartbeat ride out a stopped (ErrStopped) or leaderless (ErrNotLeader) ticketd
+func (s *LocalSession) RunHeartbeat(interval time.Duration, timeout time.Duration, ignoreNonHttpErrors bool, notify func(err error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.heartBeatStop = cancel
+	s.heartBeatWg.Add(1)
+	go func() {
+		defer s.heartBeatWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				go notify(nil)
+				return
+			case <-ticker.C:
+				refreshCtx, refreshCancel := context.WithTimeout(ctx, timeout)
+				err := s.RefreshContext(refreshCtx)
+				refreshCancel()
+				if ctx.Err() != nil {
+					go notify(nil)
+					return
+				}
+				transient := errors.Is(err, ErrStopped) || errors.Is(err, ErrNotLeader) || errors.Is(err, context.DeadlineExceeded)
+				if err != nil && (!ignoreNonHttpErrors || !transient) {
+					go notify(err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Cancel the heartbeat if running, else a noop
+func (s *LocalSession) CancelHeartBeat() {
+	if s.heartBeatStop != nil {
+		s.heartBeatStop()
+		s.heartBeatWg.Wait()
+		s.heartBeatStop = nil
+	}
+}
+
+func (s *LocalSession) IssueTicket(resource, name string, data []byte) error {
+	return s.IssueTicketContext(context.Background(), resource, name, data)
+}
+
+func (s *LocalSession) IssueTicketContext(ctx context.Context, resource, name string, data []byte) error {
+	return s.td.IssueTicketContext(s.context(ctx), s.Id, resource, name, data)
+}
+
+func (s *LocalSession) RevokeTicket(resource, name string) error {
+	return s.RevokeTicketContext(context.Background(), resource, name)
+}
+
+func (s *LocalSession) RevokeTicketContext(ctx context.Context, resource, name string) error {
+	return s.td.RevokeTicketContext(s.context(ctx), s.Id, resource, name)
+}
+
+func (s *LocalSession) SyncTickets(resource string, tickets map[string][]byte) (*SyncResult, error) {
+	return s.SyncTicketsContext(context.Background(), resource, tickets)
+}
+
+func (s *LocalSession) SyncTicketsContext(ctx context.Context, resource string, tickets map[string][]byte) (*SyncResult, error) {
+	return s.td.SyncTicketsContext(s.context(ctx), s.Id, resource, tickets)
+}
+
+func (s *LocalSession) ClaimTicket(resource string) (bool, *Ticket, error) {
+	return s.ClaimTicketContext(context.Background(), resource)
+}
+
+func (s *LocalSession) ClaimTicketContext(ctx context.Context, resource string) (bool, *Ticket, error) {
+	return s.td.ClaimTicketContext(s.context(ctx), s.Id, resource)
+}
+
+func (s *LocalSession) ReleaseTicket(resource, name string) error {
+	return s.ReleaseTicketContext(context.Background(), resource, name)
+}
+
+func (s *LocalSession) ReleaseTicketContext(ctx context.Context, resource, name string) error {
+	return s.td.ReleaseTicketContext(s.context(ctx), s.Id, resource, name)
+}
+
+func (s *LocalSession) HasTicket(resource, name string) (bool, error) {
+	return s.HasTicketContext(context.Background(), resource, name)
+}
+
+func (s *LocalSession) HasTicketContext(ctx context.Context, resource, name string) (bool, error) {
+	return s.td.HasTicketContext(s.context(ctx), s.Id, resource, name)
+}
+
+func (s *LocalSession) Lock(resource string) (bool, error) {
+	return s.LockContext(context.Background(), resource)
+}
+
+func (s *LocalSession) LockContext(ctx context.Context, resource string) (bool, error) {
+	return s.td.LockContext(s.context(ctx), s.Id, resource)
+}
+
+func (s *LocalSession) Unlock(resource string) error {
+	return s.UnlockContext(context.Background(), resource)
+}
+
+func (s *LocalSession) UnlockContext(ctx context.Context, resource string) error {
+	return s.td.UnlockContext(s.context(ctx), s.Id, resource)
+}
@@ -0,0 +1,182 @@
+package ticket
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of time for ticketd. Commands are stamped with the clock's time, which drives session refresh and expiry.
+// The expire loop runs off a clock ticker
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// A ticker made by a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// The wall clock. Used unless another clock is set
+type RealClock struct{}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+func (rt *realTicker) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt *realTicker) Stop() {
+	rt.t.Stop()
+}
+
+// A clock that only moves when told to. Tickers fire as the clock moves past their next tick. Used for tests and
+// for replaying recorded workloads
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+type manualTicker struct {
+	c       *ManualClock
+	d       time.Duration
+	next    time.Time
+	ch      chan time.Time
+	stopped bool
+}
+
+// Create a manual clock set to start
+func NewManualClock(start time.Time) (c *ManualClock) {
+	c = &ManualClock{now: start}
+	return
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mt := &manualTicker{c: c, d: d, next: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, mt)
+	return mt
+}
+
+// Move the clock forward by d, firing tickers on the way. Like time.Ticker, a ticker that is not read drops ticks
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Move the clock forward to t. The clock never moves back, so a t before the clock's time is ignored
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.set(t)
+	}
+}
+
+// Must be called with c.mu held
+func (c *ManualClock) set(t time.Time) {
+	c.now = t
+	for _, mt := range c.tickers {
+		if mt.stopped {
+			continue
+		}
+		for !mt.next.After(c.now) {
+			select {
+			case mt.ch <- mt.next:
+			default:
+			}
+			mt.next = mt.next.Add(mt.d)
+		}
+	}
+}
+
+func (mt *manualTicker) C() <-chan time.Time {
+	return mt.ch
+}
+
+func (mt *manualTicker) Stop() {
+	mt.c.mu.Lock()
+	defer mt.c.mu.Unlock()
+	mt.stopped = true
+}
+
+// A clock that can be frozen, for maintenance windows. While frozen, time stands still: sessions are not expired
+// however long clients go without refreshing, and refreshes are stamped with the time of the freeze. When thawed,
+// the clock picks up where it stopped, so the time spent frozen never counts against a session's ttl. The clock then
+// runs behind its base clock by the total time spent frozen. Everything stamped by the clock after a freeze (session
+// expiry, CreatedAt, ClaimedAt, LockedAt) is in that lagged time, and reads back that way. Another node reading those
+// stamps against its own clock sees them as older than they are, and expires sessions early by up to the time spent
+// frozen
+type FreezableClock struct {
+	Clock
+	mu       sync.Mutex
+	lost     time.Duration // Total time spent frozen
+	frozenAt time.Time     // Base clock time when frozen. Zero when running
+}
+
+// Create a freezable clock over base. A nil base gets the wall clock
+func NewFreezableClock(base Clock) (c *FreezableClock) {
+	if base == nil {
+		base = RealClock{}
+	}
+	c = &FreezableClock{Clock: base}
+	return
+}
+
+func (c *FreezableClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.frozenAt.IsZero() {
+		return c.frozenAt.Add(-c.lost)
+	}
+	return c.Clock.Now().Add(-c.lost)
+}
+
+// Stop the clock. Noop if frozen already
+func (c *FreezableClock) Freeze() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozenAt.IsZero() {
+		c.frozenAt = c.Clock.Now()
+	}
+}
+
+// Restart the clock where it stopped. Noop if not frozen
+func (c *FreezableClock) Thaw() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.frozenAt.IsZero() {
+		c.lost += c.Clock.Now().Sub(c.frozenAt)
+		c.frozenAt = time.Time{}
+	}
+}
+
+// Is the clock frozen?
+func (c *FreezableClock) Frozen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.frozenAt.IsZero()
+}
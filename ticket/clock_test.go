@@ -0,0 +1,112 @@
+package ticket
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualClock(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewManualClock(start)
+	ticker := c.NewTicker(100 * time.Millisecond)
+	c.Advance(50 * time.Millisecond)
+	r.Len(ticker.C(), 0)
+	c.Advance(250 * time.Millisecond)
+	r.Equal(start.Add(300*time.Millisecond), c.Now())
+	r.Equal(start.Add(100*time.Millisecond), <-ticker.C()) // Later ticks were dropped
+	c.Set(start)                                           // Never moves back
+	r.Equal(start.Add(300*time.Millisecond), c.Now())
+	ticker.Stop()
+	c.Advance(time.Second)
+	r.Len(ticker.C(), 0)
+}
+
+func TestFreezableClock(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	base := NewManualClock(start)
+	c := NewFreezableClock(base)
+	td := NewTicketD(100, "", 0, &DefaultLogger{*logLevel}, c)
+	td.Start()
+	defer td.Quit()
+	id, err := td.OpenSession("test", "ANY", 500)
+	r.NoError(err)
+	// A long maintenance window does not expire the session
+	c.Freeze()
+	r.True(c.Frozen())
+	base.Advance(time.Hour)
+	r.Equal(start, c.Now())
+	r.NoError(td.Expire())
+	_, err = td.GetSession(id)
+	r.NoError(err)
+	c.Thaw()
+	base.Advance(400 * time.Millisecond)
+	r.Equal(start.Add(400*time.Millisecond), c.Now())
+	r.NoError(td.Expire())
+	_, err = td.GetSession(id)
+	r.NoError(err)
+	// Timestamps are in the clock's time, which lags the base clock by the hour spent frozen
+	later, err := td.OpenSession("later", "ANY", 500)
+	r.NoError(err)
+	sess, err := td.GetSession(later)
+	r.NoError(err)
+	r.Equal(start.Add(400*time.Millisecond), sess.CreatedAt)
+	r.Equal(base.Now().Add(-time.Hour), sess.CreatedAt)
+	r.Equal(sess.CreatedAt.Add(500*time.Millisecond), sess.ExpiresAt)
+	// Time counts again once thawed
+	base.Advance(200 * time.Millisecond)
+	r.NoError(td.Expire())
+	_, err = td.GetSession(id)
+	r.ErrorIs(err, ErrNotFound)
+}
+
+func TestRecordReplay(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	td := NewTicketD(100, "", 0, &DefaultLogger{*logLevel}, clock)
+	td.Start()
+	defer td.Quit()
+	keeper, err := td.OpenSession("keeper", "ANY", 10000)
+	r.NoError(err)
+	// Record a workload in which one session expires
+	buf := &bytes.Buffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	recorded := make(chan error)
+	go func() { recorded <- Record(ctx, td, buf) }()
+	time.Sleep(50 * time.Millisecond) // Let the recorder subscribe
+	r.NoError(td.IssueTicket(keeper, "jobs", "job-1", []byte("A")))
+	short, err := td.OpenSession("short", "ANY", 500)
+	r.NoError(err)
+	ok, _, err := td.ClaimTicket(short, "jobs")
+	r.NoError(err)
+	r.True(ok)
+	clock.Advance(time.Minute)
+	r.NoError(td.Expire())
+	r.ErrorIs(td.RefreshSession(keeper), ErrNotFound) // Too late -- keeper has expired by now
+	time.Sleep(50 * time.Millisecond)                 // Let the recorder catch up
+	cancel()
+	r.NoError(<-recorded)
+	rec, err := ReadRecording(buf)
+	r.NoError(err)
+	r.Equal(start, rec.Time)
+	r.Len(rec.State.Sessions, 1)
+	// Replay against a fresh ticketd. The minute passes in no time, and the sessions expire as they did
+	replayClock := NewManualClock(time.Time{})
+	replayTd := NewTicketD(100, "", 0, &DefaultLogger{*logLevel}, replayClock)
+	replayTd.Start()
+	defer replayTd.Quit()
+	results, err := Replay(context.Background(), replayTd, replayClock, rec)
+	r.NoError(err)
+	r.Equal(len(rec.Commands), len(results))
+	r.ErrorIs(results[len(results)-1].Err, ErrNotFound)
+	r.Equal(start.Add(time.Minute), replayClock.Now())
+	sessions, err := replayTd.GetSessionsContext(context.Background())
+	r.NoError(err)
+	r.Empty(sessions)
+}
@@ -0,0 +1,130 @@
+package ticket
+
+import (
+	"context"
+	"fmt"
+)
+
+// Committer commits commands through a consensus log before they are applied (see the cluster package). Once a
+// command is committed, every node applies it with ApplyCommitted. Commit returns the result of applying the command
+// on this node, or a Result with an error wrapping ErrNotLeader if this node is not the leader
+type Committer interface {
+	Commit(cmd *Command) *Result
+	IsLeader() bool
+	Leader() string // Id of the current leader, or empty if there is none
+}
+
+// Member of a cluster
+type Member struct {
+	Id     string
+	Addr   string
+	Voter  bool
+	Leader bool
+}
+
+// Membership is implemented by committers that support membership changes
+type Membership interface {
+	AddMember(id, addr string) error
+	RemoveMember(id string) error
+	Members() ([]Member, error)
+}
+
+// Run ticketd as part of a cluster. Every mutation is passed to c to be committed instead of being applied directly.
+// Snapshotting is left to the committer, so you will normally want an empty snapshotPath.
+func (td *TicketD) SetCommitter(c Committer) {
+	td.roleLock.Lock()
+	defer td.roleLock.Unlock()
+	td.committer = c
+}
+
+// Are we part of a cluster?
+func (td *TicketD) Clustered() bool {
+	return td.getCommitter() != nil
+}
+
+func (td *TicketD) getCommitter() Committer {
+	td.roleLock.RLock()
+	defer td.roleLock.RUnlock()
+	return td.committer
+}
+
+// Apply a committed command. Called by the committer on every node, in log order
+func (td *TicketD) ApplyCommitted(cmd *Command) (res *Result) {
+	resChan := make(chan *Result, 1)
+	defer close(resChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		resChan <- td.commit(sessions, resources, cmd)
+	}
+	if err := td.send(context.Background(), f, "committed %s", cmd); err != nil {
+		return &Result{Err: err}
+	}
+	res = <-resChan
+	return
+}
+
+// Get a flattened copy of our state. Used by committers to snapshot state
+func (td *TicketD) ExportState() (state *ReplicaState, err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		state = exportState(td.seq, sessions, resources, td.requests)
+		errChan <- nil
+	}
+	if err = td.send(context.Background(), f, "export state"); err != nil {
+		return
+	}
+	<-errChan
+	return
+}
+
+// Replace our state with a flattened copy. Used by committers to restore a snapshot
+func (td *TicketD) RestoreState(state *ReplicaState) (err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		importState(state, sessions, resources)
+		td.requests = importRequests(state.Requests)
+		td.seq = state.Seq
+		errChan <- nil
+	}
+	if err = td.send(context.Background(), f, "restore state at seq %d", state.Seq); err != nil {
+		return
+	}
+	<-errChan
+	return
+}
+
+// Add a cluster member
+func (td *TicketD) AddMember(id, addr string) (err error) {
+	m, err := td.membership()
+	if err != nil {
+		return
+	}
+	return m.AddMember(id, addr)
+}
+
+// Remove a cluster member
+func (td *TicketD) RemoveMember(id string) (err error) {
+	m, err := td.membership()
+	if err != nil {
+		return
+	}
+	return m.RemoveMember(id)
+}
+
+// List cluster members
+func (td *TicketD) Members() (members []Member, err error) {
+	m, err := td.membership()
+	if err != nil {
+		return
+	}
+	return m.Members()
+}
+
+func (td *TicketD) membership() (m Membership, err error) {
+	m, ok := td.getCommitter().(Membership)
+	if !ok {
+		err = fmt.Errorf("membership changes not supported (%w)", ErrNotClustered)
+	}
+	return
+}
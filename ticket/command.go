@@ -0,0 +1,408 @@
+package ticket
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Command operations
+type Op string
+
+const (
+	OpOpenSession    Op = "open-session"
+	OpCloseSession   Op = "close-session"
+	OpRefreshSession Op = "refresh-session"
+	OpIssueTicket    Op = "issue-ticket"
+	OpRevokeTicket   Op = "revoke-ticket"
+	OpClaimTicket    Op = "claim-ticket"
+	OpReleaseTicket  Op = "release-ticket"
+	OpLock           Op = "lock"
+	OpUnlock         Op = "unlock"
+	OpExpire         Op = "expire"
+	OpSyncTickets    Op = "sync-tickets"
+)
+
+// A command describes a single mutation of ticketd state. Commands carry everything needed to apply them,
+// including the time they were issued, so the same commands applied in the same order to the same state always
+// give the same result. This is what lets a follower keep a live copy of a leader.
+type Command struct {
+	Op         Op
+	Time       time.Time // When the command was issued. Used for session refreshes and expiration
+	SessId     string
+	Name       string // Session name for OpOpenSession, else ticket name
+	Src        string
+	Ttl        int
+	Resource   string
+	Data       []byte
+	Tickets    map[string][]byte // Desired tickets (name -> data) for OpSyncTickets
+	RequestId  string            // Optional client request id. Repeats of a request get the original result
+	Principal  string            // Who made the request, if known
+	Token      string            // Session token. The new session's token for OpOpenSession, else the token presented
+	IssuerOnly bool              // Only the issuer may revoke tickets, for OpRevokeTicket and OpSyncTickets
+	Namespace  string            // Namespace of the call. Sessions only act in their own namespace
+	Quotas     *Quotas           `json:",omitempty"` // Limits in force in the namespace when the command was issued
+	Replayed   bool              `json:"-"`          // Applied again from the committer's log after a restart
+}
+
+// Result of applying a command
+type Result struct {
+	Ok     bool
+	SessId string      // Id of the opened session, for OpOpenSession
+	Token  string      // Token of the opened session, for OpOpenSession
+	Ticket *Ticket     // Copy of claimed ticket, for OpClaimTicket
+	Sync   *SyncResult // Changes made, for OpSyncTickets
+	Closed []string    // Ids of the sessions closed, for OpCloseSessions
+	Err    error
+}
+
+// Changes made by syncing a resource's tickets. Ticket names are sorted
+type SyncResult struct {
+	Issued    []string // New tickets
+	Updated   []string // Existing tickets with new data, or taken over from another session
+	Revoked   []string // Tickets that were not in the desired set
+	Unchanged []string
+}
+
+// Describe a command and its arguments, for logs. Ticket data is summarized by size
+func (cmd *Command) String() string {
+	desc := fmt.Sprintf("%s at %s (session %q, name %q, src %q, ttl %d, resource %q, %d bytes of data", cmd.Op,
+		cmd.Time.Format(time.RFC3339Nano), cmd.SessId, cmd.Name, cmd.Src, cmd.Ttl, cmd.Resource, len(cmd.Data))
+	if cmd.Tickets != nil {
+		desc += fmt.Sprintf(", %d tickets", len(cmd.Tickets))
+	}
+	if cmd.RequestId != "" {
+		desc += fmt.Sprintf(", request %s", cmd.RequestId)
+	}
+	if cmd.Principal != "" {
+		desc += fmt.Sprintf(", principal %s", cmd.Principal)
+	}
+	if cmd.Namespace != "" {
+		desc += fmt.Sprintf(", namespace %s", cmd.Namespace)
+	}
+	return desc + ")"
+}
+
+// Apply a command to sessions and resources. Must only be called from the ticket loop
+func (td *TicketD) applyCommand(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	if s := sessions[cmd.SessId]; s != nil && cmd.Op != OpOpenSession {
+		if err := checkNamespace(s, cmd); err != nil {
+			return &Result{Err: err}
+		}
+		if err := checkSessionToken(s, cmd); err != nil && !cmd.Op.forced() {
+			return &Result{Err: err}
+		}
+	}
+	if err := checkQuotas(sessions, resources, cmd); err != nil {
+		return &Result{Err: err}
+	}
+	switch cmd.Op {
+	case OpOpenSession:
+		return td.applyOpenSession(sessions, cmd)
+	case OpCloseSession:
+		return td.applyCloseSession(sessions, resources, cmd)
+	case OpRefreshSession:
+		return td.applyRefreshSession(sessions, cmd)
+	case OpIssueTicket:
+		return td.applyIssueTicket(sessions, resources, cmd)
+	case OpRevokeTicket:
+		return td.applyRevokeTicket(sessions, resources, cmd)
+	case OpClaimTicket:
+		return td.applyClaimTicket(sessions, resources, cmd)
+	case OpReleaseTicket:
+		return td.applyReleaseTicket(sessions, resources, cmd)
+	case OpLock:
+		return td.applyLock(sessions, resources, cmd)
+	case OpUnlock:
+		return td.applyUnlock(sessions, resources, cmd)
+	case OpSyncTickets:
+		return td.applySyncTickets(sessions, resources, cmd)
+	case OpForceCloseSession:
+		return td.applyForceCloseSession(sessions, resources, cmd)
+	case OpCloseSessions:
+		return td.applyCloseSessions(sessions, resources, cmd)
+	case OpForceUnlock:
+		return td.applyForceUnlock(sessions, resources, cmd)
+	case OpForceRelease:
+		return td.applyForceRelease(sessions, resources, cmd)
+	case OpDeleteResource:
+		return td.applyDeleteResource(sessions, resources, cmd)
+	case OpExpire:
+		td.expireSessions(sessions, resources, cmd.Time)
+		return &Result{}
+	}
+	return &Result{Err: fmt.Errorf("unknown command op: %s", cmd.Op)}
+}
+
+func (td *TicketD) applyOpenSession(sessions map[string]*Session, cmd *Command) (res *Result) {
+	s := newSession(cmd.SessId, cmd.Name, cmd.Src, cmd.Ttl, cmd.Time)
+	s.Token, s.Namespace, s.Principal = cmd.Token, cmd.namespace(), cmd.Principal
+	sessions[s.Id] = s
+	td.logger.Log(3, "Opened new session %s (%s)", s.Id, s.Name)
+	return &Result{Ok: true, SessId: s.Id, Token: s.Token}
+}
+
+func (td *TicketD) applyCloseSession(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	s := sessions[cmd.SessId]
+	if s == nil {
+		td.logger.Log(3, "Closing session: %s not found", cmd.SessId)
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	td.logger.Log(3, "Closing  session %s (%s)", s.Id, s.Name)
+	s.clearClaims(resources)
+	delete(sessions, cmd.SessId)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyRefreshSession(sessions map[string]*Session, cmd *Command) (res *Result) {
+	s := sessions[cmd.SessId]
+	if s == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	s.refresh(cmd.Time)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyIssueTicket(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	sess.refresh(cmd.Time)
+	// Create resource if it does not exist
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		r = newResource(cmd.namespace(), cmd.Resource, false)
+		resources[resourceKey(cmd.namespace(), cmd.Resource)] = r
+	} else if r.IsLock {
+		return &Result{Err: fmt.Errorf("cannot issue a ticket on a lock resource (%s) - %w", cmd.Resource, ErrResourceType)}
+	}
+	ticket := newTicket(cmd.Name, cmd.Resource, sess, cmd.Data, cmd.Time)
+	// If ticket exists, but issued by another session we are just going to take it over
+	if oldTick := r.Tickets[cmd.Name]; oldTick != nil {
+		if oldTick.Issuer == sess {
+			ticket.CreatedAt = oldTick.CreatedAt // Reissued, with new data
+		}
+		oldTick.Issuer = nil // Mark this issuer  as no longer valid
+		ticket.Claimant, ticket.ClaimedAt = oldTick.Claimant, oldTick.ClaimedAt
+	} else {
+		td.logger.Log(3, "Session %s issuing ticket  %s (%s)", sess.Id, r.Name, cmd.Name) // Only log on new ticket issuance
+	}
+	r.Tickets[cmd.Name] = ticket // Set new ticket in ticket list
+	// Add ticket to issuance list if it is not there already
+	sess.Issuances = ticketAddOrUpdate(sess.Issuances, ticket)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyRevokeTicket(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	// Get resource
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		return &Result{Err: fmt.Errorf("unknown resource: %s (%w)", cmd.Resource, ErrNotFound)}
+	}
+	// Get ticket -- if it exists
+	tick := r.Tickets[cmd.Name]
+	if tick == nil {
+		return &Result{Err: fmt.Errorf("unknown ticket for resource %s -> : %s", cmd.Resource, cmd.Name)}
+	}
+	// We still allow revocation of a ticket issued in another session, unless the revoke policy says otherwise
+	if err := checkRevoke(sess, tick, cmd); err != nil {
+		return &Result{Err: err}
+	}
+	td.logger.Log(3, "Session %s revoking ticket  %s (%s)", sess.Id, r.Name, tick.Name)
+	revoke(r, tick)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyClaimTicket(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	res = &Result{}
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		res.Err = fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)
+		return
+	}
+	// Get resource
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		// We treat a missing resource as if the ticket is already claimed
+		return
+	} else if r.IsLock {
+		res.Err = fmt.Errorf("cannot claim a ticket on a lock resource (%s) - %w", cmd.Resource, ErrResourceType)
+		return
+	}
+	// Walk tickets in name order, so every replica picks the same ticket
+	names := make([]string, 0, len(r.Tickets))
+	for name := range r.Tickets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ticket := r.Tickets[name]
+		if ticket.Issuer != nil && (ticket.Claimant == nil || ticket.Claimant == sess) {
+			if ticket.Claimant == nil {
+				ticket.ClaimedAt = cmd.Time
+			}
+			ticket.Claimant = sess
+			res.Ok = true
+			sess.Tickets = ticketAddOrUpdate(sess.Tickets, ticket)
+			res.Ticket = ticket.clone()
+			td.logger.Log(3, "Session %s claimed ticket  %s (%s)", sess.Id, r.Name, ticket.Name)
+			break
+		}
+	}
+	return
+}
+
+func (td *TicketD) applyReleaseTicket(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	// Get resource
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		return &Result{Err: fmt.Errorf("unknown resource: %s (%w)", cmd.Resource, ErrNotFound)}
+	}
+	ticket := r.Tickets[cmd.Name]
+	if ticket != nil && ticket.Claimant == sess {
+		ticket.Claimant, ticket.ClaimedAt = nil, time.Time{}
+		sess.Tickets = ticketRemove(sess.Tickets, ticket)
+		td.logger.Log(3, "Session %s released ticket  %s (%s)", sess.Id, r.Name, ticket.Name)
+	}
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applyLock(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	// Get resource
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		r = newResource(cmd.namespace(), cmd.Resource, true)
+		resources[resourceKey(cmd.namespace(), cmd.Resource)] = r
+	} else if !r.IsLock {
+		return &Result{Err: fmt.Errorf("cannot lock/unlock a non-lock  resource (%s) - %w", cmd.Resource, ErrResourceType)}
+	}
+	ticket := r.Tickets[cmd.Resource]
+	// We should have either no tickets or a single ticket with the same name as the resource
+	if len(r.Tickets) > 1 || (len(r.Tickets) == 1 && ticket == nil) {
+		return &Result{Err: fmt.Errorf("malformed lock resource %s. More than one ticket present or wrong ticket name in resource", cmd.Resource)}
+	}
+	if ticket == nil {
+		ticket = newTicket(cmd.Resource, cmd.Resource, sess, []byte{}, cmd.Time)
+		ticket.LockedAt = cmd.Time
+		r.Tickets[cmd.Resource] = ticket
+		sess.Issuances = ticketAddOrUpdate(sess.Issuances, ticket)
+	}
+	// If the single ticket is not nil, then it must belong to us (issuer) or we can't lock it
+	if ticket.Issuer != nil && ticket.Issuer.Id == sess.Id {
+		return &Result{Ok: true}
+	}
+	// Someone else holds the lock
+	return &Result{}
+}
+
+func (td *TicketD) applyUnlock(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		return &Result{Err: fmt.Errorf("session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	// Get resource
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		return &Result{Err: fmt.Errorf("could not find lock resource %s (%w)", cmd.Resource, ErrNotFound)}
+	} else if !r.IsLock {
+		return &Result{Err: fmt.Errorf("cannot lock/unlock a non-lock  resource (%s) - %w", cmd.Resource, ErrResourceType)}
+	}
+	ticket := r.Tickets[cmd.Resource]
+	// We should have either no tickets or a single ticket with the same name as the resource
+	if ticket == nil {
+		return &Result{Err: fmt.Errorf("Resource %s is not locked (%w)", cmd.Resource, ErrNotFound)}
+	}
+	// If the single ticket is not nil, then it must belong to us (issuer) or we can't unlock it
+	if ticket.Issuer == nil || ticket.Issuer.Id != sess.Id {
+		return &Result{Err: fmt.Errorf("Resource %s is locked  by another session (%w)", cmd.Resource, ErrNotFound)}
+	}
+	// There is a ticket and we are the issuer -- so we can delete the ticket
+	ticket.Issuer = nil
+	delete(r.Tickets, ticket.Name)
+	sess.Issuances = ticketRemove(sess.Issuances, ticket)
+	return &Result{Ok: true}
+}
+
+func (td *TicketD) applySyncTickets(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	sess := sessions[cmd.SessId]
+	if sess == nil {
+		return &Result{Err: fmt.Errorf("Session not found: %s (%w)", cmd.SessId, ErrNotFound)}
+	}
+	sess.refresh(cmd.Time)
+	r := resources[resourceKey(cmd.namespace(), cmd.Resource)]
+	if r == nil {
+		r = newResource(cmd.namespace(), cmd.Resource, false)
+		resources[resourceKey(cmd.namespace(), cmd.Resource)] = r
+	} else if r.IsLock {
+		return &Result{Err: fmt.Errorf("cannot issue a ticket on a lock resource (%s) - %w", cmd.Resource, ErrResourceType)}
+	}
+	// Syncing revokes or takes over tickets, whoever issued them. Check first, so a refused sync changes nothing
+	for _, tick := range r.Tickets {
+		if err := checkRevoke(sess, tick, cmd); err != nil {
+			return &Result{Err: err}
+		}
+	}
+	sync := &SyncResult{Issued: []string{}, Updated: []string{}, Revoked: []string{}, Unchanged: []string{}}
+	// Revoke tickets that are not wanted
+	for name, tick := range r.Tickets {
+		if _, ok := cmd.Tickets[name]; ok {
+			continue
+		}
+		revoke(r, tick)
+		sync.Revoked = append(sync.Revoked, name)
+	}
+	// Issue new tickets, and update changed ones. Claims on tickets we keep are kept
+	for name, data := range cmd.Tickets {
+		if data == nil {
+			data = []byte{}
+		}
+		oldTick := r.Tickets[name]
+		if oldTick != nil && oldTick.Issuer == sess {
+			if bytes.Equal(oldTick.Data, data) {
+				sync.Unchanged = append(sync.Unchanged, name)
+			} else {
+				oldTick.Data = data
+				sync.Updated = append(sync.Updated, name)
+			}
+			continue
+		}
+		ticket := newTicket(name, cmd.Resource, sess, data, cmd.Time)
+		if oldTick != nil {
+			// Taken over from another session. The claimant keeps its claim, on the new ticket
+			if oldTick.Issuer != nil {
+				oldTick.Issuer.Issuances = ticketRemove(oldTick.Issuer.Issuances, oldTick)
+				oldTick.Issuer = nil
+			}
+			ticket.Claimant, ticket.ClaimedAt = oldTick.Claimant, oldTick.ClaimedAt
+			if ticket.Claimant != nil {
+				ticket.Claimant.Tickets = ticketAddOrUpdate(ticket.Claimant.Tickets, ticket)
+			}
+			sync.Updated = append(sync.Updated, name)
+		} else {
+			sync.Issued = append(sync.Issued, name)
+		}
+		r.Tickets[name] = ticket
+		sess.Issuances = ticketAddOrUpdate(sess.Issuances, ticket)
+	}
+	sort.Strings(sync.Issued)
+	sort.Strings(sync.Updated)
+	sort.Strings(sync.Revoked)
+	sort.Strings(sync.Unchanged)
+	td.logger.Log(3, "Session %s synced tickets for %s: %d issued, %d updated, %d revoked", sess.Id, r.Name,
+		len(sync.Issued), len(sync.Updated), len(sync.Revoked))
+	return &Result{Ok: true, Sync: sync}
+}
@@ -6,3 +6,11 @@ import (
 
 var ErrNotFound = errors.New("entity not found")
 var ErrResourceType = errors.New("resource  type is incorrect")
+var ErrNotLeader = errors.New("not the leader")
+var ErrReplicaGap = errors.New("replication stream out of sequence")
+var ErrNotClustered = errors.New("not part of a cluster")
+var ErrRequestIdReused = errors.New("request id reused for a different operation")
+var ErrStopped = errors.New("ticketd is stopped")
+var ErrInternal = errors.New("internal error")
+var ErrForbidden = errors.New("forbidden")
+var ErrQuotaExceeded = errors.New("quota exceeded")
@@ -0,0 +1,154 @@
+package ticket
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Invariant checks
+//
+// Sessions and resources are tied together by pointers, which are easy to get wrong. The checker walks the maps and
+// reports anything that breaks the rules below. Session ticket lists may hold out of date pointers (see
+// fetchTicketPtr), so the checks follow pointers from resources to sessions, and only check session lists against
+// the tickets they name:
+//   - Map keys match session ids, resource keys and ticket names, and tickets name the resource they are in
+//   - A ticket's issuer and claimant are in the namespace of its resource
+//   - A ticket's issuer and claimant, when set, are live sessions (the same session, not a copy)
+//   - A ticket's issuer lists the ticket in its issuances, and its claimant lists it in its claimed tickets
+//   - Session lists name each ticket at most once
+//   - Lock resources hold at most one ticket, named after the resource, and lock tickets are never claimed
+
+// What to do about invariant violations found after each call into the ticket loop
+type CheckMode int
+
+const (
+	CheckOff   CheckMode = iota // Don't check. The default
+	CheckLog                    // Log violations
+	CheckPanic                  // Log violations, then panic. The call that broke the invariant fails with ErrInternal
+)
+
+// Check invariants after every call into the ticket loop. Checks walk all of ticketd's state, so this is for
+// debugging. Must be called before Start
+func (td *TicketD) SetCheckMode(mode CheckMode) {
+	td.checkMode = mode
+}
+
+// Check invariants now. Returns a description of each violation found, or none if all is well
+func (td *TicketD) CheckInvariants() (violations []string, err error) {
+	return td.CheckInvariantsContext(context.Background())
+}
+
+// Check invariants now, giving up when ctx is done
+func (td *TicketD) CheckInvariantsContext(ctx context.Context) (violations []string, err error) {
+	errChan := make(chan error, 1)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		violations = checkInvariants(sessions, resources)
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "invariant check"); err != nil {
+		return
+	}
+	err = <-errChan
+	return
+}
+
+// Check invariants after a call into the ticket loop, if asked to. Must only be called from the ticket loop
+func (td *TicketD) debugCheck(sessions map[string]*Session, resources map[string]*Resource, call *ticketCall) {
+	if td.checkMode == CheckOff {
+		return
+	}
+	violations := checkInvariants(sessions, resources)
+	if len(violations) == 0 {
+		return
+	}
+	after := fmt.Sprintf(call.op, call.args...)
+	for _, v := range violations {
+		td.logger.Log(0, "INVARIANT VIOLATED after %s: %s", after, v)
+	}
+	if td.checkMode == CheckPanic {
+		panic(fmt.Sprintf("%d invariant violations after %s. First: %s", len(violations), after, violations[0]))
+	}
+}
+
+// Find invariant violations. Sorted, so results are stable
+func checkInvariants(sessions map[string]*Session, resources map[string]*Resource) (violations []string) {
+	report := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+	for id, s := range sessions {
+		if s.Id != id {
+			report("session %s is filed under id %s", s.Id, id)
+		}
+		checkSessionList(report, s, "claimed tickets", s.Tickets)
+		checkSessionList(report, s, "issuances", s.Issuances)
+	}
+	for name, r := range resources {
+		if resourceKey(r.Namespace, r.Name) != name {
+			report("resource %s in namespace %s is filed under %q", r.Name, r.Namespace, name)
+		}
+		if r.IsLock && (len(r.Tickets) > 1 || (len(r.Tickets) == 1 && r.Tickets[r.Name] == nil)) {
+			report("lock resource %s holds %d tickets", r.Name, len(r.Tickets))
+		}
+		for tn, t := range r.Tickets {
+			where := fmt.Sprintf("ticket %s on resource %s", tn, name)
+			if t.Name != tn {
+				report("%s is named %s", where, t.Name)
+			}
+			if t.ResourceName != r.Name {
+				report("%s names resource %s", where, t.ResourceName)
+			}
+			if t.Issuer != nil {
+				if normalNamespace(t.Issuer.Namespace) != normalNamespace(r.Namespace) {
+					report("%s was issued by session %s in namespace %s", where, t.Issuer.Id, t.Issuer.Namespace)
+				}
+				if sessions[t.Issuer.Id] != t.Issuer {
+					report("%s was issued by session %s, which is not live", where, t.Issuer.Id)
+				} else if !listsTicket(t.Issuer.Issuances, t) {
+					report("%s is not in the issuances of its issuer %s", where, t.Issuer.Id)
+				}
+			}
+			if t.Claimant != nil {
+				if r.IsLock {
+					report("%s is a claimed lock ticket", where)
+				}
+				if normalNamespace(t.Claimant.Namespace) != normalNamespace(r.Namespace) {
+					report("%s is claimed by session %s in namespace %s", where, t.Claimant.Id, t.Claimant.Namespace)
+				}
+				if sessions[t.Claimant.Id] != t.Claimant {
+					report("%s is claimed by session %s, which is not live", where, t.Claimant.Id)
+				} else if !listsTicket(t.Claimant.Tickets, t) {
+					report("%s is not in the claimed tickets of its claimant %s", where, t.Claimant.Id)
+				}
+			}
+		}
+	}
+	sort.Strings(violations)
+	return
+}
+
+// Check a session's list of claimed or issued tickets
+func checkSessionList(report func(format string, args ...interface{}), s *Session, what string, list []*Ticket) {
+	seen := make(map[string]bool, len(list))
+	for _, t := range list {
+		if t == nil {
+			report("session %s has a nil ticket in its %s", s.Id, what)
+			continue
+		}
+		key := t.ResourceName + "/" + t.Name
+		if seen[key] {
+			report("session %s lists ticket %s more than once in its %s", s.Id, key, what)
+		}
+		seen[key] = true
+	}
+}
+
+// Does a session list name this ticket?
+func listsTicket(list []*Ticket, t *Ticket) bool {
+	for _, tk := range list {
+		if tk != nil && tk.Name == t.Name && tk.ResourceName == t.ResourceName {
+			return true
+		}
+	}
+	return false
+}
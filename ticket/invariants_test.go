@@ -0,0 +1,45 @@
+package ticket
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvariants(t *testing.T) {
+	r := require.New(t)
+	td := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, nil) // Not checking: we break things on purpose below
+	td.Start()
+	defer td.Quit()
+	issuer, err := td.OpenSession("issuer", "ANY", 5000)
+	r.NoError(err)
+	claimant, err := td.OpenSession("claimant", "ANY", 5000)
+	r.NoError(err)
+	r.NoError(td.IssueTicket(issuer, "jobs", "job-1", nil))
+	_, _, err = td.ClaimTicket(claimant, "jobs")
+	r.NoError(err)
+	_, err = td.Lock(claimant, "lock")
+	r.NoError(err)
+	violations, err := td.CheckInvariants()
+	r.NoError(err)
+	r.Empty(violations)
+	// Break things behind ticketd's back
+	errChan := make(chan error, 1)
+	r.NoError(td.send(context.Background(), func(sessions map[string]*Session, resources map[string]*Resource) {
+		stray := &Session{Id: "stray"}
+		resources["jobs"].Tickets["job-1"].Claimant = stray
+		resources["lock"].Tickets["extra"] = newTicket("extra", "lock", sessions[issuer], nil, td.clock.Now())
+		sessions[claimant].Tickets = append(sessions[claimant].Tickets, sessions[claimant].Tickets...)
+		errChan <- nil
+	}, "break invariants"))
+	<-errChan
+	violations, err = td.CheckInvariants()
+	r.NoError(err)
+	r.Equal([]string{
+		"lock resource lock holds 2 tickets",
+		"session " + claimant + " lists ticket jobs/job-1 more than once in its claimed tickets",
+		"ticket extra on resource lock is not in the issuances of its issuer " + issuer,
+		"ticket job-1 on resource jobs is claimed by session stray, which is not live",
+	}, violations)
+}
@@ -8,7 +8,7 @@ import (
 
 func TestLocks(t *testing.T) {
 	r := require.New(t)
-	td := startTicketD(false)
+	td := startTicketD("")
 	defer stopTicketD(td)
 	sessId1, err := td.OpenSession("session-1", "ANY", 100)
 	r.NoError(err)
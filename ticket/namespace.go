@@ -0,0 +1,87 @@
+package ticket
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Namespaces
+//
+// Namespaces keep tenants apart. Every session belongs to exactly one namespace, and acts only on the resources of its
+// namespace, so two namespaces can each have a resource called db. Resources share one map, filed under
+// resourceKey(namespace, name). Resources in the default namespace are filed under their bare name, so state from
+// before namespaces loads as the default namespace. Resource names can't contain NUL, which separates the namespace
+// from the name in keys. Calls carry their namespace in their context (WithNamespace), and
+// calls without one are in the default namespace. Dumps only show the namespace of the call.
+
+// The namespace of calls that don't name one
+const DefaultNamespace = "default"
+
+var namespaceRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+type namespaceKeyType struct{}
+
+var namespaceKey namespaceKeyType
+
+// Is name usable as a namespace? Namespaces are up to 64 letters, digits, '.', '_' and '-', starting with a letter
+// or digit
+func ValidNamespace(name string) bool {
+	return namespaceRe.MatchString(name)
+}
+
+// Is name usable as a resource name? A name with a NUL in it would be the key of a resource in another namespace
+func ValidResourceName(name string) bool {
+	return !strings.ContainsRune(name, 0)
+}
+
+// Refuse resource names that aren't ValidResourceName. Like a bad namespace, a bad name is not found
+func checkResourceName(name string) error {
+	if !ValidResourceName(name) {
+		return fmt.Errorf("bad resource name %q (%w)", name, ErrNotFound)
+	}
+	return nil
+}
+
+// Get a context for calls in a namespace
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey, namespace)
+}
+
+// Get the namespace of a context. DefaultNamespace if it has none
+func ContextNamespace(ctx context.Context) string {
+	if ns, _ := ctx.Value(namespaceKey).(string); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
+
+// Namespaces left empty (by state and commands from before namespaces) are the default namespace
+func normalNamespace(ns string) string {
+	if ns == "" {
+		return DefaultNamespace
+	}
+	return ns
+}
+
+// Key of a resource in the resources map
+func resourceKey(namespace, name string) string {
+	if namespace = normalNamespace(namespace); namespace == DefaultNamespace {
+		return name
+	}
+	return namespace + "\x00" + name
+}
+
+// The namespace of a command
+func (cmd *Command) namespace() string {
+	return normalNamespace(cmd.Namespace)
+}
+
+// Check that a command's session is in the command's namespace. A session in another namespace is not found
+func checkNamespace(sess *Session, cmd *Command) error {
+	if normalNamespace(sess.Namespace) == cmd.namespace() {
+		return nil
+	}
+	return fmt.Errorf("Session not found: %s in namespace %s (%w)", sess.Id, cmd.namespace(), ErrNotFound)
+}
@@ -0,0 +1,94 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	teamA, teamB := NewLocalClient(td), NewLocalClient(td)
+	teamA.Namespace, teamB.Namespace = "team-a", "team-b"
+	sessA, err := teamA.OpenSession("a", 5000)
+	r.NoError(err)
+	sessB, err := teamB.OpenSession("b", 5000)
+	r.NoError(err)
+	sessDefault, err := NewLocalClient(td).OpenSession("default", 5000)
+	r.NoError(err)
+
+	// Each namespace has its own db
+	r.NoError(sessA.IssueTicket("db", "t1", []byte("a")))
+	r.NoError(sessB.IssueTicket("db", "t1", []byte("b")))
+	ok, tk, err := sessB.ClaimTicket("db")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("b", string(tk.Data))
+	ok, _, err = sessDefault.ClaimTicket("db")
+	r.NoError(err)
+	r.False(ok)
+	// Nor can a resource name reach into another namespace
+	_, _, err = sessDefault.ClaimTicket("team-a\x00db")
+	r.True(errors.Is(err, ErrNotFound))
+	_, err = td.HasTicket(sessDefault.Id, "team-a\x00db", "t1")
+	r.True(errors.Is(err, ErrNotFound))
+	ok, err = sessA.Lock("db-lock")
+	r.NoError(err)
+	r.True(ok)
+	ok, err = sessB.Lock("db-lock")
+	r.NoError(err)
+	r.True(ok)
+
+	// Sessions only act in their own namespace
+	ctxB := WithNamespace(WithSessionToken(context.Background(), sessA.Token), "team-b")
+	r.True(errors.Is(td.IssueTicketContext(ctxB, sessA.Id, "db", "t2", nil), ErrNotFound))
+	_, err = td.GetSessionContext(ctxB, sessA.Id)
+	r.True(errors.Is(err, ErrNotFound))
+	_, err = td.GetSession(sessA.Id)
+	r.True(errors.Is(err, ErrNotFound))
+
+	// Dumps are scoped to the namespace
+	resources, err := td.GetResourcesContext(WithNamespace(context.Background(), "team-a"))
+	r.NoError(err)
+	r.Len(resources, 2)
+	r.Equal("team-a", resources["db"].Namespace)
+	r.Equal("a", string(resources["db"].Tickets["t1"].Data))
+	sessions, err := td.GetSessionsContext(WithNamespace(context.Background(), "team-b"))
+	r.NoError(err)
+	r.Len(sessions, 1)
+	r.Len(sessions[sessB.Id].Tickets, 1)
+	r.Empty(td.GetResources())
+	r.Len(td.GetSessions(), 1)
+
+	// Grants apply in their own namespace
+	td.SetPolicy(&Policy{Grants: []*Grant{
+		{Principal: "app", Verbs: []Verb{VerbAll}, Resources: []string{"*"}, Namespace: "team-a"},
+	}})
+	defer td.SetPolicy(nil)
+	r.NoError(td.Authorize(WithNamespace(WithPrincipal(context.Background(), "app"), "team-a"), VerbIssue, "db"))
+	r.True(errors.Is(td.Authorize(WithNamespace(WithPrincipal(context.Background(), "app"), "team-b"), VerbIssue, "db"),
+		ErrForbidden))
+	r.True(errors.Is(td.Authorize(WithPrincipal(context.Background(), "app"), VerbIssue, "db"), ErrForbidden))
+
+	// Namespaces survive snapshots and replication
+	allSessions, err := td.getSessions(context.Background(), "")
+	r.NoError(err)
+	allResources, err := td.getResources(context.Background(), "")
+	r.NoError(err)
+	dir := t.TempDir()
+	r.NoError(snapshot(dir, allSessions, allResources))
+	sessions, resources, err = td.loadSnapshot(dir)
+	r.NoError(err)
+	r.Empty(checkInvariants(sessions, resources))
+	r.Equal("team-b", sessions[sessB.Id].Namespace)
+	r.Equal("b", string(resources[resourceKey("team-b", "db")].Tickets["t1"].Data))
+	state := exportState(0, sessions, resources, newRequestCache())
+	sessions, resources = make(map[string]*Session), make(map[string]*Resource)
+	importState(state, sessions, resources)
+	r.Empty(checkInvariants(sessions, resources))
+	r.Equal("team-a", sessions[sessA.Id].Namespace)
+	r.Same(sessions[sessB.Id], resources[resourceKey("team-b", "db")].Tickets["t1"].Claimant)
+}
@@ -0,0 +1,282 @@
+package ticket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Quotas
+//
+// Everything ticketd holds lives in memory and is copied on every snapshot, so a runaway client can take it down.
+// Quotas put limits on what each namespace may hold. Limits are checked as commands are applied, and a command that
+// would go over one fails with ErrQuotaExceeded and changes nothing. The limits in force travel with each command
+// (Command.Quotas), so every replica applies a command the same way, whatever quotas it has been given itself.
+// Lowering a limit doesn't take anything away; it only stops growth past the new limit.
+
+// Limits on a namespace. Zero means no limit
+type Quotas struct {
+	SessionsPerOwner   int   // Open sessions per principal, or per source host for sessions opened without one
+	TicketsPerResource int   // Tickets on one resource
+	Resources          int   // Resources, including locks
+	ClaimsPerSession   int   // Tickets one session may hold claims on
+	TicketDataBytes    int64 // Ticket data, in bytes, across all tickets
+}
+
+// Quotas for every namespace. Namespaces not listed get the default
+type QuotaConfig struct {
+	Default    *Quotas
+	Namespaces map[string]*Quotas
+}
+
+// What a namespace holds, and the quotas it holds it under
+type Usage struct {
+	Sessions              int
+	SessionsByOwner       map[string]int // Open sessions per principal, or per source host
+	Resources             int
+	Tickets               int
+	MaxTicketsPerResource int // Tickets on the busiest resource
+	Claims                int
+	MaxClaimsPerSession   int // Claims held by the busiest session
+	TicketDataBytes       int64
+	Quotas                *Quotas `json:",omitempty"`
+}
+
+// Load quotas from a json file
+func LoadQuotas(file string) (c *QuotaConfig, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	c = &QuotaConfig{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("quotas %s: %w", file, err)
+	}
+	if err = c.Validate(); err != nil {
+		return nil, fmt.Errorf("quotas %s: %w", file, err)
+	}
+	return
+}
+
+// Check quotas for negative limits and bad namespace names
+func (c *QuotaConfig) Validate() error {
+	if err := c.Default.validate(); err != nil {
+		return fmt.Errorf("default quotas: %w", err)
+	}
+	for ns, q := range c.Namespaces {
+		if !ValidNamespace(ns) {
+			return fmt.Errorf("bad namespace %q", ns)
+		}
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("quotas for %s: %w", ns, err)
+		}
+	}
+	return nil
+}
+
+func (q *Quotas) validate() error {
+	if q == nil {
+		return nil
+	}
+	if q.SessionsPerOwner < 0 || q.TicketsPerResource < 0 || q.Resources < 0 || q.ClaimsPerSession < 0 ||
+		q.TicketDataBytes < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	return nil
+}
+
+// Get the quotas for a namespace. Nil if there are none. Safe to call on a nil config
+func (c *QuotaConfig) For(namespace string) *Quotas {
+	if c == nil {
+		return nil
+	}
+	if q, ok := c.Namespaces[normalNamespace(namespace)]; ok {
+		return q
+	}
+	return c.Default
+}
+
+// Set the quotas. Nil turns quotas off. Safe to call at any time. Commands already issued keep the quotas they were
+// issued under
+func (td *TicketD) SetQuotas(c *QuotaConfig) {
+	td.quotas.Store(c)
+}
+
+// Get the quotas. Nil if there are none
+func (td *TicketD) Quotas() *QuotaConfig {
+	return td.quotas.Load()
+}
+
+// Get what each namespace holds, keyed by namespace
+func (td *TicketD) Usage() (usage map[string]*Usage, err error) {
+	return td.UsageContext(context.Background())
+}
+
+// Get what each namespace holds, giving up when ctx is done
+func (td *TicketD) UsageContext(ctx context.Context) (usage map[string]*Usage, err error) {
+	quotas := td.Quotas()
+	errChan := make(chan error, 1)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		usage = collectUsage("", sessions, resources)
+		for ns, u := range usage {
+			u.Quotas = quotas.For(ns)
+		}
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "usage"); err != nil {
+		return
+	}
+	err = <-errChan
+	return
+}
+
+// Work out what each namespace holds, or only one namespace if only is set. Must only be called from the ticket
+// loop
+func collectUsage(only string, sessions map[string]*Session, resources map[string]*Resource) (usage map[string]*Usage) {
+	usage = make(map[string]*Usage)
+	get := func(ns string) *Usage {
+		if usage[ns] == nil {
+			usage[ns] = &Usage{SessionsByOwner: make(map[string]int)}
+		}
+		return usage[ns]
+	}
+	for _, s := range sessions {
+		ns := normalNamespace(s.Namespace)
+		if only != "" && ns != only {
+			continue
+		}
+		u := get(ns)
+		u.Sessions++
+		u.SessionsByOwner[s.owner()]++
+		if n := s.claims(resources); n > u.MaxClaimsPerSession {
+			u.MaxClaimsPerSession = n
+		}
+	}
+	for _, r := range resources {
+		ns := normalNamespace(r.Namespace)
+		if only != "" && ns != only {
+			continue
+		}
+		u := get(ns)
+		u.Resources++
+		u.Tickets += len(r.Tickets)
+		if len(r.Tickets) > u.MaxTicketsPerResource {
+			u.MaxTicketsPerResource = len(r.Tickets)
+		}
+		for _, t := range r.Tickets {
+			u.TicketDataBytes += int64(len(t.Data))
+			if t.Claimant != nil {
+				u.Claims++
+			}
+		}
+	}
+	return
+}
+
+// Who a session counts against: its principal, or the host it came from if it has none. Src is the address the api
+// server saw the session opened from, so it can't be picked by the caller
+func (s *Session) owner() string {
+	if s.Principal != "" {
+		return s.Principal
+	}
+	if host, _, err := net.SplitHostPort(s.Src); err == nil {
+		return host
+	}
+	return s.Src
+}
+
+// How many tickets a session has claimed. Session lists can hold out of date pointers (see fetchTicketPtr), so only
+// tickets that are still on their resource, claimed by the session, count
+func (s *Session) claims(resources map[string]*Resource) (n int) {
+	for _, t := range s.Tickets {
+		if t = fetchTicketPtr(s.Namespace, t, resources); t != nil && t.Claimant == s {
+			n++
+		}
+	}
+	return
+}
+
+// Check that applying a command keeps its namespace within the command's quotas. Must only be called from the
+// ticket loop
+func checkQuotas(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) error {
+	q := cmd.Quotas
+	if q == nil {
+		return nil
+	}
+	ns := cmd.namespace()
+	r := resources[resourceKey(ns, cmd.Resource)]
+	if r != nil && r.IsLock != (cmd.Op == OpLock) {
+		return nil // Fails on the resource type anyway
+	}
+	// Usage is only worked out if a limit needs it
+	var u *Usage
+	usage := func() *Usage {
+		if u == nil {
+			if u = collectUsage(ns, sessions, resources)[ns]; u == nil {
+				u = &Usage{}
+			}
+		}
+		return u
+	}
+	creates := r == nil && (cmd.Op == OpIssueTicket || cmd.Op == OpSyncTickets || cmd.Op == OpLock)
+	if creates && q.Resources > 0 && usage().Resources >= q.Resources {
+		return fmt.Errorf("namespace %s has %d resources, the most it may have (%w)", ns, usage().Resources,
+			ErrQuotaExceeded)
+	}
+	switch cmd.Op {
+	case OpOpenSession:
+		owner := (&Session{Principal: cmd.Principal, Src: cmd.Src}).owner()
+		if n := usage().SessionsByOwner[owner]; q.SessionsPerOwner > 0 && n >= q.SessionsPerOwner {
+			return fmt.Errorf("%s has %d sessions open in namespace %s, the most it may have (%w)", owner, n, ns,
+				ErrQuotaExceeded)
+		}
+	case OpIssueTicket:
+		var old *Ticket
+		if r != nil {
+			old = r.Tickets[cmd.Name]
+		}
+		if old == nil && r != nil && q.TicketsPerResource > 0 && len(r.Tickets) >= q.TicketsPerResource {
+			return fmt.Errorf("resource %s has %d tickets, the most it may have (%w)", cmd.Resource, len(r.Tickets),
+				ErrQuotaExceeded)
+		}
+		if q.TicketDataBytes > 0 {
+			bytes := usage().TicketDataBytes + int64(len(cmd.Data))
+			if old != nil {
+				bytes -= int64(len(old.Data))
+			}
+			if bytes > q.TicketDataBytes {
+				return fmt.Errorf("namespace %s would hold %d bytes of ticket data, over its quota of %d (%w)", ns, bytes,
+					q.TicketDataBytes, ErrQuotaExceeded)
+			}
+		}
+	case OpSyncTickets:
+		if q.TicketsPerResource > 0 && len(cmd.Tickets) > q.TicketsPerResource {
+			return fmt.Errorf("resource %s may have %d tickets, not %d (%w)", cmd.Resource, q.TicketsPerResource,
+				len(cmd.Tickets), ErrQuotaExceeded)
+		}
+		if q.TicketDataBytes > 0 {
+			bytes := usage().TicketDataBytes
+			if r != nil {
+				for _, t := range r.Tickets {
+					bytes -= int64(len(t.Data))
+				}
+			}
+			for _, data := range cmd.Tickets {
+				bytes += int64(len(data))
+			}
+			if bytes > q.TicketDataBytes {
+				return fmt.Errorf("namespace %s would hold %d bytes of ticket data, over its quota of %d (%w)", ns, bytes,
+					q.TicketDataBytes, ErrQuotaExceeded)
+			}
+		}
+	case OpClaimTicket:
+		if s := sessions[cmd.SessId]; s != nil && q.ClaimsPerSession > 0 {
+			if n := s.claims(resources); n >= q.ClaimsPerSession {
+				return fmt.Errorf("session %s holds %d claims, the most it may hold (%w)", s.Id, n, ErrQuotaExceeded)
+			}
+		}
+	}
+	return nil
+}
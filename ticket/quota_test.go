@@ -0,0 +1,88 @@
+package ticket
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	td.SetQuotas(&QuotaConfig{
+		Default: &Quotas{SessionsPerOwner: 2, TicketsPerResource: 2, Resources: 2, ClaimsPerSession: 1,
+			TicketDataBytes: 10},
+		Namespaces: map[string]*Quotas{"unlimited": nil},
+	})
+	cli := NewLocalClient(td)
+	sess1, err := cli.OpenSession("1", 5000)
+	r.NoError(err)
+	sess2, err := cli.OpenSession("2", 5000)
+	r.NoError(err)
+	_, err = cli.OpenSession("3", 5000)
+	r.True(errors.Is(err, ErrQuotaExceeded))
+	// Sessions count against their principal, if they have one
+	cli.Principal = "app"
+	_, err = cli.OpenSession("3", 5000)
+	r.NoError(err)
+
+	// Tickets per resource and ticket data. Replacing a ticket only counts the difference
+	r.NoError(sess1.IssueTicket("jobs", "t1", []byte("12345")))
+	r.NoError(sess1.IssueTicket("jobs", "t2", []byte("1234")))
+	r.True(errors.Is(sess1.IssueTicket("jobs", "t3", nil), ErrQuotaExceeded))
+	r.True(errors.Is(sess1.IssueTicket("jobs", "t2", []byte("123456")), ErrQuotaExceeded))
+	r.NoError(sess1.IssueTicket("jobs", "t2", []byte("12345")))
+	_, err = sess1.SyncTickets("jobs", map[string][]byte{"t1": nil, "t2": nil, "t3": nil})
+	r.True(errors.Is(err, ErrQuotaExceeded))
+	r.Len(td.GetResources()["jobs"].Tickets, 2)
+
+	// Resources, counting locks
+	ok, err := sess1.Lock("leader")
+	r.NoError(err)
+	r.True(ok)
+	r.True(errors.Is(sess1.IssueTicket("more-jobs", "t1", nil), ErrQuotaExceeded))
+	_, err = sess1.Lock("other-leader")
+	r.True(errors.Is(err, ErrQuotaExceeded))
+
+	// Claims per session
+	ok, claimed, err := sess2.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+	_, _, err = sess2.ClaimTicket("jobs")
+	r.True(errors.Is(err, ErrQuotaExceeded))
+
+	// Usage is reported per namespace, with its quotas
+	usage, err := td.Usage()
+	r.NoError(err)
+	u := usage[DefaultNamespace]
+	r.Equal(3, u.Sessions)
+	r.Equal(map[string]int{"local": 2, "app": 1}, u.SessionsByOwner)
+	r.Equal(2, u.Resources)
+	r.Equal(3, u.Tickets)
+	r.Equal(2, u.MaxTicketsPerResource)
+	r.Equal(1, u.Claims)
+	r.Equal(1, u.MaxClaimsPerSession)
+	r.EqualValues(10, u.TicketDataBytes)
+	r.Equal(2, u.Quotas.Resources)
+	// A claim on a ticket its issuer revoked no longer counts
+	r.NoError(sess1.RevokeTicket("jobs", claimed.Name))
+	usage, err = td.Usage()
+	r.NoError(err)
+	r.Equal(0, usage[DefaultNamespace].MaxClaimsPerSession)
+	ok, _, err = sess2.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+
+	// Namespaces have their own quotas
+	cli = NewLocalClient(td)
+	cli.Namespace = "unlimited"
+	for i := 0; i < 3; i++ {
+		_, err = cli.OpenSession("unlimited", 5000)
+		r.NoError(err)
+	}
+	r.Len(td.GetSessions(), 3)
+	td.SetQuotas(nil)
+	_, err = NewLocalClient(td).OpenSession("4", 5000)
+	r.NoError(err)
+}
@@ -0,0 +1,128 @@
+package ticket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Recording and replay
+//
+// A ticketd workload can be recorded as the state ticketd started from, plus every command it applied, and replayed
+// later against another ticketd on a ManualClock. Commands carry the time they were issued, so the replay clock is
+// moved to each command's time before the command is applied. Sessions expire exactly as they did when recorded,
+// however fast the replay runs. Recordings are json, one line per state or command.
+
+// A recorded workload
+type Recording struct {
+	Time     time.Time     // Clock time when recording started
+	State    *ReplicaState // State when recording started
+	Commands []*Command    // Commands applied, in order
+}
+
+// A line of a recording. Exactly one field is set
+type recordingLine struct {
+	Start   *recordingStart `json:",omitempty"`
+	Command *Command        `json:",omitempty"`
+}
+
+type recordingStart struct {
+	Time  time.Time
+	State *ReplicaState
+}
+
+// Record the commands td applies to w, until ctx is done. Returns nil when ctx is done, or an error if recording could
+// not go on (td stopped, or w could not keep up)
+func Record(ctx context.Context, td *TicketD, w io.Writer) (err error) {
+	sub, err := td.SubscribeContext(ctx)
+	if err != nil {
+		return
+	}
+	defer td.Unsubscribe(sub)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(&recordingLine{Start: &recordingStart{Time: td.Now(), State: sub.State}}); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case entry, ok := <-sub.C:
+			if !ok {
+				return errors.New("recording ended: ticketd stopped, or the recording fell behind")
+			}
+			if err = enc.Encode(&recordingLine{Command: entry.Command}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read a recording written by Record
+func ReadRecording(r io.Reader) (rec *Recording, err error) {
+	rec = &Recording{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rl recordingLine
+		if err = json.Unmarshal(scanner.Bytes(), &rl); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+		switch {
+		case rl.Start != nil:
+			rec.Time, rec.State = rl.Start.Time, rl.Start.State
+		case rl.Command != nil:
+			rec.Commands = append(rec.Commands, rl.Command)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Replay a recording against td, which must be a leader running on clock. td's state is replaced by the recording's
+// starting state, then each command is applied at its recorded time. Returns the result of each command
+func Replay(ctx context.Context, td *TicketD, clock *ManualClock, rec *Recording) (results []*Result, err error) {
+	clock.Set(rec.Time)
+	if rec.State != nil {
+		if err = td.loadRecordedState(ctx, rec.State); err != nil {
+			return
+		}
+	}
+	results = make([]*Result, 0, len(rec.Commands))
+	for _, recorded := range rec.Commands {
+		cmd := *recorded
+		clock.Set(cmd.Time)
+		res := td.SubmitContext(ctx, &cmd)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		results = append(results, res)
+	}
+	return
+}
+
+// Replace our state with the starting state of a recording. Only allowed on a leader
+func (td *TicketD) loadRecordedState(ctx context.Context, state *ReplicaState) (err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		if !td.IsLeader() {
+			errChan <- ErrNotLeader
+			return
+		}
+		importState(state, sessions, resources)
+		td.requests = importRequests(state.Requests)
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "load recorded state at seq %d", state.Seq); err != nil {
+		return
+	}
+	err = <-errChan
+	return
+}
@@ -0,0 +1,325 @@
+package ticket
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Replication
+//
+// The leader applies every mutation as a Command and hands it to subscribers along with a sequence number. A follower
+// loads a copy of the leader state, then applies the same commands in the same order. Followers never expire sessions
+// on their own -- expirations arrive from the leader as commands -- but session expiration times are part of the
+// replicated state, so a promoted follower picks up expiring sessions where the leader left off.
+
+// How many entries a subscriber can fall behind before we drop it
+const subscriberBacklog = 4096
+
+// A replicated command
+type ReplicaEntry struct {
+	Seq     uint64
+	Command *Command
+}
+
+// A flattened copy of ticketd state. Pointers between sessions and tickets are replaced by session ids
+type ReplicaState struct {
+	Seq       uint64
+	Sessions  []*ReplicaSession
+	Resources []*ReplicaResource
+	Requests  []*ReplicaRequest // Recent request results, oldest first
+}
+
+type ReplicaSession struct {
+	Name      string
+	Id        string
+	Src       string
+	Ttl       int
+	Expires   time.Time
+	Token     string
+	Namespace string `json:",omitempty"`
+	Principal string `json:",omitempty"`
+
+	CreatedAt       time.Time
+	LastRefreshedAt time.Time
+}
+
+type ReplicaResource struct {
+	Name      string
+	IsLock    bool
+	Tickets   []*ReplicaTicket
+	Namespace string `json:",omitempty"`
+}
+
+type ReplicaTicket struct {
+	Name       string
+	Data       []byte
+	IssuerId   string // Empty if ticket has no issuer
+	ClaimantId string // Empty if ticket is not claimed
+	CreatedAt  time.Time
+	ClaimedAt  time.Time
+	LockedAt   time.Time
+}
+
+// A replication subscription. State holds the state at the time we subscribed, and every command applied after
+// that is delivered on C. C is closed if the subscriber falls too far behind, or when ticketd quits
+type Subscription struct {
+	State *ReplicaState
+	C     <-chan *ReplicaEntry
+	c     chan *ReplicaEntry
+}
+
+// Subscribe to state changes. Returns nil if ticketd has stopped
+func (td *TicketD) Subscribe() (sub *Subscription) {
+	sub, _ = td.SubscribeContext(context.Background())
+	return
+}
+
+// Subscribe to state changes, giving up when ctx is done
+func (td *TicketD) SubscribeContext(ctx context.Context) (sub *Subscription, err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		c := make(chan *ReplicaEntry, subscriberBacklog)
+		sub = &Subscription{State: exportState(td.seq, sessions, resources, td.requests), C: c, c: c}
+		td.subscribers = append(td.subscribers, sub)
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "subscribe"); err != nil {
+		return
+	}
+	<-errChan
+	return
+}
+
+// Cancel a subscription
+func (td *TicketD) Unsubscribe(sub *Subscription) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		td.dropSubscriber(sub)
+		errChan <- nil
+	}
+	if td.send(context.Background(), f, "unsubscribe") == nil {
+		<-errChan
+	}
+}
+
+// Pass an entry on to subscribers. Subscribers that can't keep up are dropped. Must only be called from the ticket loop
+func (td *TicketD) publish(entry *ReplicaEntry) {
+	for _, sub := range td.subscribers {
+		select {
+		case sub.c <- entry:
+		default:
+			td.logger.Log(1, "Replication subscriber fell behind at seq %d. Dropping it", entry.Seq)
+			td.dropSubscriber(sub)
+		}
+	}
+}
+
+// Remove a subscriber and close its channel. Must only be called from the ticket loop
+func (td *TicketD) dropSubscriber(sub *Subscription) {
+	for i, s := range td.subscribers {
+		if s == sub {
+			close(s.c)
+			td.subscribers = append(td.subscribers[:i:i], td.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close all subscriber channels. Must only be called from the ticket loop
+func (td *TicketD) closeSubscribers() {
+	for _, sub := range td.subscribers {
+		close(sub.c)
+	}
+	td.subscribers = nil
+}
+
+// Is this node the leader?
+func (td *TicketD) IsLeader() bool {
+	td.roleLock.RLock()
+	defer td.roleLock.RUnlock()
+	if td.committer != nil {
+		return td.committer.IsLeader()
+	}
+	return td.leader == ""
+}
+
+// Get the leader we follow. Empty if we are the leader, or if we are clustered and there is no leader
+func (td *TicketD) Leader() string {
+	td.roleLock.RLock()
+	defer td.roleLock.RUnlock()
+	if td.committer != nil {
+		if td.committer.IsLeader() {
+			return ""
+		}
+		return td.committer.Leader()
+	}
+	return td.leader
+}
+
+// Follow a leader. The leader is an opaque address (usually the leader's base url). Mutations are refused with
+// ErrNotLeader until we are promoted again. State is loaded with LoadReplicaState and kept current with ApplyReplicated
+func (td *TicketD) Follow(leader string) {
+	td.roleLock.Lock()
+	defer td.roleLock.Unlock()
+	td.logger.Log(2, "Following leader %s", leader)
+	td.leader = leader
+}
+
+// Promote this node to leader. Session expirations are kept as they are
+func (td *TicketD) Promote() {
+	td.roleLock.Lock()
+	defer td.roleLock.Unlock()
+	if td.leader != "" {
+		td.logger.Log(1, "Promoted to leader (was following %s)", td.leader)
+	}
+	td.leader = ""
+}
+
+// Get the sequence number of the last applied command. Returns 0 if ticketd has stopped
+func (td *TicketD) Seq() (seq uint64) {
+	seq, _ = td.SeqContext(context.Background())
+	return
+}
+
+// Get the sequence number of the last applied command, giving up when ctx is done
+func (td *TicketD) SeqContext(ctx context.Context) (seq uint64, err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		seq = td.seq
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "get seq"); err != nil {
+		return
+	}
+	<-errChan
+	return
+}
+
+// Replace our state with a copy of the leader's state. Only allowed on a follower
+func (td *TicketD) LoadReplicaState(state *ReplicaState) (err error) {
+	return td.LoadReplicaStateContext(context.Background(), state)
+}
+
+// Replace our state with a copy of the leader's state, giving up when ctx is done
+func (td *TicketD) LoadReplicaStateContext(ctx context.Context, state *ReplicaState) (err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		if td.IsLeader() {
+			errChan <- fmt.Errorf("cannot load replica state: not following a leader")
+			return
+		}
+		importState(state, sessions, resources)
+		td.requests = importRequests(state.Requests)
+		td.seq = state.Seq
+		td.logger.Log(2, "Loaded replica state at seq %d: %d sessions, %d resources", state.Seq, len(sessions), len(resources))
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "load replica state at seq %d", state.Seq); err != nil {
+		return
+	}
+	err = <-errChan
+	return
+}
+
+// Apply a command received from the leader. Entries must arrive in sequence, else ErrReplicaGap is returned and the
+// follower should reload state. Only allowed on a follower
+func (td *TicketD) ApplyReplicated(entry *ReplicaEntry) (err error) {
+	return td.ApplyReplicatedContext(context.Background(), entry)
+}
+
+// Apply a command received from the leader, giving up when ctx is done
+func (td *TicketD) ApplyReplicatedContext(ctx context.Context, entry *ReplicaEntry) (err error) {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		if td.IsLeader() {
+			errChan <- fmt.Errorf("cannot apply replicated command: not following a leader")
+			return
+		}
+		if entry.Seq != td.seq+1 {
+			errChan <- fmt.Errorf("expected seq %d, got %d (%w)", td.seq+1, entry.Seq, ErrReplicaGap)
+			return
+		}
+		td.applyRequest(sessions, resources, entry.Command)
+		td.seq = entry.Seq
+		td.publish(entry)
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "replicated %d %s", entry.Seq, entry.Command); err != nil {
+		return
+	}
+	err = <-errChan
+	return
+}
+
+// Flatten sessions and resources. Resources and tickets are sorted by name so that importing the result always
+// builds sessions with the same ticket order
+func exportState(seq uint64, sessions map[string]*Session, resources map[string]*Resource, requests *requestCache) (state *ReplicaState) {
+	state = &ReplicaState{Seq: seq, Sessions: make([]*ReplicaSession, 0, len(sessions)),
+		Resources: make([]*ReplicaResource, 0, len(resources)), Requests: requests.export()}
+	for _, s := range sessions {
+		state.Sessions = append(state.Sessions, &ReplicaSession{s.Name, s.Id, s.Src, s.Ttl, s.ExpiresAt, s.Token, s.Namespace,
+			s.Principal, s.CreatedAt, s.LastRefreshedAt})
+	}
+	sort.Slice(state.Sessions, func(i, j int) bool { return state.Sessions[i].Id < state.Sessions[j].Id })
+	for _, r := range resources {
+		rr := &ReplicaResource{Name: r.Name, IsLock: r.IsLock, Tickets: make([]*ReplicaTicket, 0, len(r.Tickets)),
+			Namespace: r.Namespace}
+		for _, t := range r.Tickets {
+			rt := &ReplicaTicket{Name: t.Name, Data: append([]byte{}, t.Data...), CreatedAt: t.CreatedAt,
+				ClaimedAt: t.ClaimedAt, LockedAt: t.LockedAt}
+			if t.Issuer != nil {
+				rt.IssuerId = t.Issuer.Id
+			}
+			if t.Claimant != nil {
+				rt.ClaimantId = t.Claimant.Id
+			}
+			rr.Tickets = append(rr.Tickets, rt)
+		}
+		sort.Slice(rr.Tickets, func(i, j int) bool { return rr.Tickets[i].Name < rr.Tickets[j].Name })
+		state.Resources = append(state.Resources, rr)
+	}
+	sort.Slice(state.Resources, func(i, j int) bool { return state.Resources[i].Name < state.Resources[j].Name })
+	return
+}
+
+// Rebuild sessions and resources (in place) from a flattened copy
+func importState(state *ReplicaState, sessions map[string]*Session, resources map[string]*Resource) {
+	for id := range sessions {
+		delete(sessions, id)
+	}
+	for name := range resources {
+		delete(resources, name)
+	}
+	for _, rs := range state.Sessions {
+		sessions[rs.Id] = &Session{Name: rs.Name, Id: rs.Id, Src: rs.Src, Ttl: rs.Ttl, Token: rs.Token,
+			Namespace: normalNamespace(rs.Namespace), Principal: rs.Principal, Tickets: []*Ticket{}, Issuances: []*Ticket{}, CreatedAt: rs.CreatedAt,
+			LastRefreshedAt: rs.LastRefreshedAt, ExpiresAt: rs.Expires}
+	}
+	for _, rr := range state.Resources {
+		r := newResource(rr.Namespace, rr.Name, rr.IsLock)
+		for _, rt := range rr.Tickets {
+			data := rt.Data
+			if data == nil {
+				data = []byte{}
+			}
+			t := newTicket(rt.Name, rr.Name, sessions[rt.IssuerId], data, rt.CreatedAt)
+			t.LockedAt = rt.LockedAt
+			if t.Issuer != nil {
+				t.Issuer.Issuances = append(t.Issuer.Issuances, t)
+			}
+			if t.Claimant = sessions[rt.ClaimantId]; t.Claimant != nil {
+				t.ClaimedAt = rt.ClaimedAt
+				t.Claimant.Tickets = append(t.Claimant.Tickets, t)
+			}
+			r.Tickets[t.Name] = t
+		}
+		resources[resourceKey(r.Namespace, r.Name)] = r
+	}
+}
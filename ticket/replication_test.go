@@ -0,0 +1,97 @@
+package ticket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Pump entries from a subscription into a follower until the subscription closes
+func pumpReplica(td *TicketD, sub *Subscription, done chan interface{}) {
+	defer close(done)
+	for entry := range sub.C {
+		if err := td.ApplyReplicated(entry); err != nil {
+			return
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	r := require.New(t)
+	leader := startTicketD("")
+	follower := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, nil)
+	follower.Follow("leader")
+	follower.Start()
+	defer stopTicketD(follower)
+	// Some state before the follower subscribes
+	issuerId, err := leader.OpenSession("issuer", "ANY", 1000)
+	r.NoError(err)
+	r.NoError(leader.IssueTicket(issuerId, "test", "foo", []byte("foo data")))
+	r.NoError(leader.IssueTicket(issuerId, "test", "bar", []byte("bar data")))
+	claimantId, err := leader.OpenSession("claimant", "ANY", 1000)
+	r.NoError(err)
+	ok, claimed, err := leader.ClaimTicket(claimantId, "test")
+	r.NoError(err)
+	r.True(ok)
+	// Subscribe and load state
+	sub := leader.Subscribe()
+	r.NoError(follower.LoadReplicaState(sub.State))
+	done := make(chan interface{})
+	go pumpReplica(follower, sub, done)
+	// State after the follower subscribes
+	lockerId, err := leader.OpenSession("locker", "ANY", 1000)
+	r.NoError(err)
+	ok, err = leader.Lock(lockerId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	claimant2Id, err := leader.OpenSession("claimant 2", "ANY", 1000)
+	r.NoError(err)
+	ok, claimed2, err := leader.ClaimTicket(claimant2Id, "test")
+	r.NoError(err)
+	r.True(ok)
+	r.NotEqual(claimed.Name, claimed2.Name)
+	// Wait for follower to catch up
+	seq := leader.Seq()
+	for follower.Seq() < seq {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ok, err = follower.HasTicket(claimantId, "test", claimed.Name)
+	r.NoError(err)
+	r.True(ok)
+	ok, err = follower.HasTicket(claimant2Id, "test", claimed2.Name)
+	r.NoError(err)
+	r.True(ok)
+	r.Len(follower.GetSessions(), 4)
+	r.Len(follower.GetResources(), 2)
+	// Followers refuse mutations
+	_, err = follower.OpenSession("nope", "ANY", 1000)
+	r.True(errors.Is(err, ErrNotLeader))
+	// Stop leader. Followers do not expire sessions on their own
+	stopTicketD(leader)
+	<-done
+	time.Sleep(1200 * time.Millisecond)
+	r.Len(follower.GetSessions(), 4)
+	// Promote follower. Sessions should expire without having been reset by the promotion
+	follower.Promote()
+	r.True(follower.IsLeader())
+	time.Sleep(600 * time.Millisecond)
+	r.Empty(follower.GetSessions())
+	r.Empty(follower.GetResources())
+}
+
+func TestReplicaGap(t *testing.T) {
+	r := require.New(t)
+	follower := startTicketD("")
+	defer stopTicketD(follower)
+	// Leaders refuse replicated commands
+	err := follower.ApplyReplicated(&ReplicaEntry{1, &Command{Op: OpOpenSession, SessId: "x", Time: time.Now()}})
+	r.Error(err)
+	follower.Follow("leader")
+	r.NoError(follower.LoadReplicaState(&ReplicaState{Seq: 10}))
+	err = follower.ApplyReplicated(&ReplicaEntry{12, &Command{Op: OpOpenSession, SessId: "x", Time: time.Now()}})
+	r.True(errors.Is(err, ErrReplicaGap))
+	r.NoError(follower.ApplyReplicated(&ReplicaEntry{11, &Command{Op: OpOpenSession, SessId: "x", Ttl: 1000, Time: time.Now()}}))
+	r.Len(follower.GetSessions(), 1)
+}
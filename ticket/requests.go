@@ -0,0 +1,194 @@
+package ticket
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Idempotent requests
+//
+// A client that times out waiting for a mutation can't tell whether it was applied. Commands may carry a client
+// supplied request id so they can be retried safely: we keep the results of recent requests, and a command with an
+// id we have already seen gets the original result back instead of being applied again. The record is kept by the
+// ticket loop as part of applying commands, so followers and cluster members hold the same record as the leader and
+// a retry against a new leader still gets the original result. A result is only replayed to the caller that made the
+// request: the same principal, in the same namespace, presenting the same session token.
+
+const (
+	requestCacheSize = 10000            // Most requests we remember
+	requestCacheTtl  = 10 * time.Minute // How long we remember a request
+)
+
+// A remembered request
+type requestRecord struct {
+	id        string
+	op        Op
+	time      time.Time
+	res       *Result
+	principal string
+	namespace string
+	token     string // Session token the request presented. Empty for OpOpenSession, which is given a new one
+}
+
+// Bounded record of recent request results. Oldest requests are dropped first. Only touched by the ticket loop
+type requestCache struct {
+	records map[string]*requestRecord
+	order   []*requestRecord
+}
+
+// Flattened copy of a remembered request. Errors are kept as their message, plus the ticketd error they wrap (if any)
+type ReplicaRequest struct {
+	Id      string
+	Op      Op
+	Time    time.Time
+	Ok      bool
+	SessId  string
+	Token   string
+	Ticket  *Ticket
+	Sync    *SyncResult
+	Closed  []string `json:",omitempty"`
+	Err     string
+	ErrKind string
+
+	Principal string `json:",omitempty"`
+	Namespace string `json:",omitempty"`
+	SessToken string `json:",omitempty"` // Session token the request presented
+}
+
+// Errors we preserve through a replica copy, so replayed errors map to the same api errors
+var requestErrKinds = map[string]error{
+	"not-found":     ErrNotFound,
+	"resource-type": ErrResourceType,
+	"request-reuse": ErrRequestIdReused,
+	"forbidden":     ErrForbidden,
+	"quota":         ErrQuotaExceeded,
+}
+
+// A replayed error. Keeps the original message and wrapped ticketd error
+type replayedError struct {
+	msg  string
+	kind error
+}
+
+func (e *replayedError) Error() string {
+	return e.msg
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.kind
+}
+
+func newRequestCache() *requestCache {
+	return &requestCache{records: make(map[string]*requestRecord)}
+}
+
+// Look up a request. Records older than the cache ttl (as of now) are ignored
+func (rc *requestCache) get(id string, now time.Time) *requestRecord {
+	rec := rc.records[id]
+	if rec == nil || now.Sub(rec.time) > requestCacheTtl {
+		return nil
+	}
+	return rec
+}
+
+// Remember the result of a command's request, dropping records that are too old or too many
+func (rc *requestCache) add(cmd *Command, res *Result) {
+	id, now := cmd.RequestId, cmd.Time
+	rec := &requestRecord{id: id, op: cmd.Op, time: now, res: res.clone(), principal: cmd.Principal,
+		namespace: cmd.namespace()}
+	if cmd.Op != OpOpenSession {
+		rec.token = cmd.Token
+	}
+	rc.records[id] = rec
+	rc.order = append(rc.order, rec)
+	for len(rc.order) > 0 && (len(rc.order) > requestCacheSize || now.Sub(rc.order[0].time) > requestCacheTtl) {
+		if old := rc.order[0]; rc.records[old.id] == old {
+			delete(rc.records, old.id)
+		}
+		rc.order[0] = nil
+		rc.order = rc.order[1:]
+	}
+}
+
+// Apply a command, unless it repeats a request we have already seen. Must only be called from the ticket loop
+func (td *TicketD) applyRequest(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	if cmd.RequestId == "" {
+		return td.applyCommand(sessions, resources, cmd)
+	}
+	if rec := td.requests.get(cmd.RequestId, cmd.Time); rec != nil {
+		if rec.op != cmd.Op {
+			return &Result{Err: fmt.Errorf("request id %s was used for %s (%w)", cmd.RequestId, rec.op, ErrRequestIdReused)}
+		}
+		if !rec.sameCaller(cmd) {
+			return &Result{Err: fmt.Errorf("request id %s was used by another caller (%w)", cmd.RequestId, ErrRequestIdReused)}
+		}
+		td.logger.Log(3, "Replaying result of request %s (%s)", cmd.RequestId, cmd.Op)
+		return rec.res.clone()
+	}
+	res = td.applyCommand(sessions, resources, cmd)
+	td.requests.add(cmd, res)
+	return
+}
+
+// Does a command come from the caller that made a remembered request?
+func (rec *requestRecord) sameCaller(cmd *Command) bool {
+	token := ""
+	if cmd.Op != OpOpenSession {
+		token = cmd.Token
+	}
+	return rec.principal == cmd.Principal && rec.namespace == cmd.namespace() &&
+		subtle.ConstantTimeCompare([]byte(rec.token), []byte(token)) == 1
+}
+
+// Flatten the request record, oldest first
+func (rc *requestCache) export() (out []*ReplicaRequest) {
+	out = make([]*ReplicaRequest, 0, len(rc.order))
+	for _, rec := range rc.order {
+		if rc.records[rec.id] != rec {
+			continue // Superseded by a later record with the same id
+		}
+		rr := &ReplicaRequest{Id: rec.id, Op: rec.op, Time: rec.time, Ok: rec.res.Ok, SessId: rec.res.SessId,
+			Token: rec.res.Token, Sync: rec.res.Sync, Closed: rec.res.Closed, Principal: rec.principal, Namespace: rec.namespace, SessToken: rec.token}
+		if rec.res.Ticket != nil {
+			rr.Ticket = rec.res.Ticket.clone()
+		}
+		if rec.res.Err != nil {
+			rr.Err = rec.res.Err.Error()
+			for kind, kindErr := range requestErrKinds {
+				if errors.Is(rec.res.Err, kindErr) {
+					rr.ErrKind = kind
+					break
+				}
+			}
+		}
+		out = append(out, rr)
+	}
+	return
+}
+
+// Rebuild a request record from a flattened copy
+func importRequests(in []*ReplicaRequest) (rc *requestCache) {
+	rc = newRequestCache()
+	for _, rr := range in {
+		res := &Result{Ok: rr.Ok, SessId: rr.SessId, Token: rr.Token, Ticket: rr.Ticket, Sync: rr.Sync, Closed: rr.Closed}
+		if rr.Err != "" {
+			res.Err = &replayedError{msg: rr.Err, kind: requestErrKinds[rr.ErrKind]}
+		}
+		rec := &requestRecord{id: rr.Id, op: rr.Op, time: rr.Time, res: res, principal: rr.Principal,
+			namespace: normalNamespace(rr.Namespace), token: rr.SessToken}
+		rc.records[rec.id] = rec
+		rc.order = append(rc.order, rec)
+	}
+	return
+}
+
+// Copy a result, so callers can't modify a remembered result
+func (res *Result) clone() (out *Result) {
+	r := *res
+	if res.Ticket != nil {
+		r.Ticket = res.Ticket.clone()
+	}
+	return &r
+}
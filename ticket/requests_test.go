@@ -0,0 +1,136 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestReplay(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	// Repeating an open session request gives us the same session
+	res := td.Submit(&Command{Op: OpOpenSession, RequestId: "open-1", Name: "issuer", Src: "ANY", Ttl: 1000})
+	r.NoError(res.Err)
+	issuerId := res.SessId
+	res = td.Submit(&Command{Op: OpOpenSession, RequestId: "open-1", Name: "issuer", Src: "ANY", Ttl: 1000})
+	r.NoError(res.Err)
+	r.Equal(issuerId, res.SessId)
+	r.Len(td.GetSessions(), 1)
+	r.NoError(td.IssueTicket(issuerId, "test", "foo", []byte("foo data")))
+	r.NoError(td.IssueTicket(issuerId, "test", "bar", []byte("bar data")))
+	claimantId, err := td.OpenSession("claimant", "ANY", 1000)
+	r.NoError(err)
+	// Repeating a claim gives us the same ticket, and does not claim another
+	res = td.Submit(&Command{Op: OpClaimTicket, RequestId: "claim-1", SessId: claimantId, Resource: "test"})
+	r.NoError(res.Err)
+	r.True(res.Ok)
+	claimed := res.Ticket.Name
+	res = td.Submit(&Command{Op: OpClaimTicket, RequestId: "claim-1", SessId: claimantId, Resource: "test"})
+	r.NoError(res.Err)
+	r.True(res.Ok)
+	r.Equal(claimed, res.Ticket.Name)
+	sess, err := td.GetSession(claimantId)
+	r.NoError(err)
+	r.Len(sess.Tickets, 1)
+	// Errors are replayed too
+	res = td.Submit(&Command{Op: OpUnlock, RequestId: "unlock-1", SessId: claimantId, Resource: "nope"})
+	r.True(errors.Is(res.Err, ErrNotFound))
+	res = td.Submit(&Command{Op: OpUnlock, RequestId: "unlock-1", SessId: claimantId, Resource: "nope"})
+	r.True(errors.Is(res.Err, ErrNotFound))
+	// A request id can't be reused for a different operation
+	res = td.Submit(&Command{Op: OpLock, RequestId: "claim-1", SessId: claimantId, Resource: "lock"})
+	r.True(errors.Is(res.Err, ErrRequestIdReused))
+}
+
+func TestRequestReplayOtherCaller(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	ctx := WithPrincipal(context.Background(), "app")
+	res := td.SubmitContext(ctx, &Command{Op: OpOpenSession, RequestId: "open-1", Name: "app", Src: "ANY", Ttl: 5000})
+	r.NoError(res.Err)
+	// The same request id from another principal, or in another namespace, doesn't get the session or its token
+	for _, other := range []context.Context{WithPrincipal(context.Background(), "intruder"), context.Background(),
+		WithNamespace(ctx, "team-a")} {
+		replay := td.SubmitContext(other, &Command{Op: OpOpenSession, RequestId: "open-1", Name: "app", Src: "ANY", Ttl: 5000})
+		r.True(errors.Is(replay.Err, ErrRequestIdReused))
+		r.Empty(replay.Token)
+	}
+	replay := td.SubmitContext(ctx, &Command{Op: OpOpenSession, RequestId: "open-1", Name: "app", Src: "ANY", Ttl: 5000})
+	r.NoError(replay.Err)
+	r.Equal(res.Token, replay.Token)
+	// Nor does a session call presenting another token
+	r.NoError(td.IssueTicket(res.SessId, "test", "foo", []byte("secret")))
+	claim := td.SubmitContext(ctx, &Command{Op: OpClaimTicket, RequestId: "claim-1", SessId: res.SessId, Token: res.Token,
+		Resource: "test"})
+	r.True(claim.Ok)
+	replay = td.SubmitContext(ctx, &Command{Op: OpClaimTicket, RequestId: "claim-1", SessId: res.SessId, Token: "guess",
+		Resource: "test"})
+	r.True(errors.Is(replay.Err, ErrRequestIdReused))
+	r.Nil(replay.Ticket)
+}
+
+func TestRequestReplayAfterResync(t *testing.T) {
+	r := require.New(t)
+	leader := startTicketD("")
+	defer stopTicketD(leader)
+	res := leader.Submit(&Command{Op: OpOpenSession, RequestId: "open-1", Name: "issuer", Src: "ANY", Ttl: 5000})
+	r.NoError(res.Err)
+	r.NotEmpty(res.Token)
+	// A follower loads the leader's state, and is promoted
+	follower := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, nil)
+	follower.Follow("leader")
+	follower.Start()
+	defer stopTicketD(follower)
+	r.NoError(follower.LoadReplicaState(leader.Subscribe().State))
+	follower.Promote()
+	// The retry gets the session back with its token, and the token works
+	retry := follower.Submit(&Command{Op: OpOpenSession, RequestId: "open-1", Name: "issuer", Src: "ANY", Ttl: 5000})
+	r.NoError(retry.Err)
+	r.Equal(res.SessId, retry.SessId)
+	r.Equal(res.Token, retry.Token)
+	r.NoError(follower.Submit(&Command{Op: OpRefreshSession, SessId: retry.SessId, Token: retry.Token}).Err)
+}
+
+func TestRequestCache(t *testing.T) {
+	r := require.New(t)
+	rc := newRequestCache()
+	start := time.Now()
+	for i := 0; i < requestCacheSize+10; i++ {
+		rc.add(&Command{RequestId: fmt.Sprintf("req-%d", i), Op: OpLock, Time: start}, &Result{Ok: true})
+	}
+	r.Len(rc.order, requestCacheSize)
+	r.Len(rc.records, requestCacheSize)
+	// Old requests are forgotten
+	rc.add(&Command{RequestId: "old", Op: OpLock, Time: start}, &Result{Ok: true})
+	r.NotNil(rc.get("old", start.Add(time.Minute)))
+	r.Nil(rc.get("old", start.Add(requestCacheTtl+time.Second)))
+	rc.add(&Command{RequestId: "new", Op: OpLock, Time: start.Add(requestCacheTtl+time.Second)}, &Result{Ok: true})
+	r.Len(rc.order, 1)
+	// Requests survive a replica copy, errors included
+	rc.add(&Command{RequestId: "failed", Op: OpUnlock, Time: start.Add(requestCacheTtl+time.Second)}, &Result{Err: ErrNotFound})
+	rc.add(&Command{RequestId: "over-quota", Op: OpOpenSession, Time: start.Add(requestCacheTtl+time.Second)},
+		&Result{Err: fmt.Errorf("too many sessions (%w)", ErrQuotaExceeded)})
+	rc.add(&Command{RequestId: "forbidden", Op: OpRevokeTicket, Time: start.Add(requestCacheTtl+time.Second)},
+		&Result{Err: fmt.Errorf("issued by another session (%w)", ErrForbidden)})
+	copied := importRequests(rc.export())
+	r.Len(copied.order, 4)
+	rec := copied.get("failed", start.Add(requestCacheTtl+time.Second))
+	r.NotNil(rec)
+	r.Equal(OpUnlock, rec.op)
+	r.True(errors.Is(rec.res.Err, ErrNotFound))
+	rec = copied.get("over-quota", start.Add(requestCacheTtl+time.Second))
+	r.True(errors.Is(rec.res.Err, ErrQuotaExceeded))
+	r.Equal("too many sessions (quota exceeded)", rec.res.Err.Error())
+	r.True(errors.Is(copied.get("forbidden", start.Add(requestCacheTtl+time.Second)).res.Err, ErrForbidden))
+	rc.add(&Command{RequestId: "closed", Op: OpCloseSessions, Time: start.Add(requestCacheTtl+time.Second)},
+		&Result{Ok: true, Closed: []string{"s1", "s2"}})
+	copied = importRequests(rc.export())
+	r.Equal([]string{"s1", "s2"}, copied.get("closed", start.Add(requestCacheTtl+time.Second)).res.Closed)
+}
@@ -1,6 +1,7 @@
 package ticket
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ func (td *TicketD) loadSnapshot(path string) (sessions map[string]*Session, reso
 	}
 	// Now we have to fix up a lot of pointers
 	for _, sess := range sessions {
+		sess.Namespace = normalNamespace(sess.Namespace)
 		if sess.Issuances == nil {
 			sess.Issuances = []*Ticket{}
 		}
@@ -34,7 +36,7 @@ func (td *TicketD) loadSnapshot(path string) (sessions map[string]*Session, reso
 	for _, sess := range sessions {
 		for i, ticket := range sess.Tickets {
 			// Be sure the things we THINK exist exist in resources
-			res := resources[ticket.ResourceName]
+			res := resources[resourceKey(sess.Namespace, ticket.ResourceName)]
 			if res == nil {
 				return nil, nil, fmt.Errorf("unable to find resource %s", ticket.ResourceName)
 			}
@@ -48,7 +50,7 @@ func (td *TicketD) loadSnapshot(path string) (sessions map[string]*Session, reso
 		}
 		for i, ticket := range sess.Issuances {
 			// Be sure the things we THINK exist exist in resources
-			res := resources[ticket.ResourceName]
+			res := resources[resourceKey(sess.Namespace, ticket.ResourceName)]
 			if res == nil {
 				return nil, nil, fmt.Errorf("unable to find resource %s", ticket.ResourceName)
 			}
@@ -59,7 +61,8 @@ func (td *TicketD) loadSnapshot(path string) (sessions map[string]*Session, reso
 			}
 			sess.Issuances[i].Issuer = sess
 		}
-		sess.refresh()
+		// Sessions get a full ttl from now, so they don't expire while we were down. When they were last refreshed is kept
+		sess.ExpiresAt = td.clock.Now().Add(time.Millisecond * time.Duration(sess.Ttl))
 	}
 	for _, res := range resources {
 		for _, ticket := range res.Tickets {
@@ -93,9 +96,17 @@ func (td *TicketD) snapshotProc() (restart bool) {
 	for {
 		select {
 		case <-ticker.C:
-			sess := td.GetSessions()
-			res := td.GetResources()
-			err := snapshot(td.snapshotPath, sess, res)
+			sess, err := td.getSessions(context.Background(), "")
+			if err != nil {
+				td.logger.Log(1, "Unable to snapshot: %s", err.Error())
+				continue
+			}
+			res, err := td.getResources(context.Background(), "")
+			if err != nil {
+				td.logger.Log(1, "Unable to snapshot: %s", err.Error())
+				continue
+			}
+			err = snapshot(td.snapshotPath, sess, res)
 			if err != nil {
 				td.logger.Log(1, "Unable to snapshot: %s", err.Error())
 			}
@@ -188,7 +199,8 @@ func loadResources(path string) (resources map[string]*Resource, err error) {
 			}
 			break
 		}
-		resources[r.Name] = &r
+		r.Namespace = normalNamespace(r.Namespace) // Snapshots from before namespaces
+		resources[resourceKey(r.Namespace, r.Name)] = &r
 	}
 	return
 }
@@ -1,9 +1,12 @@
 package ticket
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/segmentio/ksuid"
@@ -13,14 +16,38 @@ const expireDelayMs = 1000
 
 type ticketFunc func(map[string]*Session, map[string]*Resource)
 
+// A call into the ticket loop. op and args describe the call, in case it panics. done gets nil when f returns, or an
+// ErrInternal error if f panics
+type ticketCall struct {
+	f    ticketFunc
+	op   string
+	args []interface{}
+	done chan error
+}
+
 type TicketD struct {
-	ticketChan       chan ticketFunc
+	ticketChan       chan *ticketCall
 	quitChan         chan interface{}
+	stoppedChan      chan interface{} // Closed when the ticket loop exits for good
+	quitOnce         sync.Once
 	quitSnapChan     chan interface{}
 	expireTickTimeMs int
 	snapshotInterval int
 	snapshotPath     string
 	logger           Logger
+	seq              uint64          // Sequence number of last applied command. Only touched by the ticket loop
+	subscribers      []*Subscription // Replication subscribers. Only touched by the ticket loop
+	roleLock         sync.RWMutex
+	leader           string        // Leader we follow. Empty if we are the leader
+	committer        Committer     // Consensus log, if we are part of a cluster
+	expiring         int32         // Set while an expiration is being committed
+	requests         *requestCache // Results of recent requests. Only touched by the ticket loop
+	clock            Clock
+	checkMode        CheckMode // Invariant checking after each call into the ticket loop
+	policy           atomic.Pointer[Policy]
+	revokePolicy     RevokePolicy
+	quotas           atomic.Pointer[QuotaConfig]
+	auditLog         atomic.Pointer[AuditLog]
 }
 
 // Client session
@@ -31,7 +58,13 @@ type Session struct {
 	Ttl       int       // ticket ttl in ms
 	Tickets   []*Ticket // tickets claimed
 	Issuances []*Ticket // tickets issued for this session
-	expires   time.Time
+	Namespace string    // Namespace the session acts in
+	Principal string    // Who opened the session, if known
+	Token     string    `json:"-"` // Secret the session's owner presents. Never sent over the api
+
+	CreatedAt       time.Time // When the session was opened
+	LastRefreshedAt time.Time // When the session was last refreshed, by a heartbeat or a call that refreshes it
+	ExpiresAt       time.Time // When the session expires, unless it is refreshed first
 }
 
 // Ticket for a resource
@@ -41,42 +74,52 @@ type Ticket struct {
 	Data         []byte   // ticket data
 	Issuer       *Session // Issuer  session of ticket. Never empty
 	Claimant     *Session // Session ID of ticket claimant, if there is one or empty
+
+	CreatedAt time.Time // When the ticket was issued
+	ClaimedAt time.Time // When the current claimant claimed it. Zero if it is not claimed
+	LockedAt  time.Time // When the lock was taken, for lock tickets. Zero for other tickets
 }
 
 // Resource -- a thing that can be claimed with a ticket
 type Resource struct {
-	Name    string
-	IsLock  bool
-	Tickets map[string]*Ticket
+	Name      string
+	IsLock    bool
+	Tickets   map[string]*Ticket
+	Namespace string
 }
 
 // Create a new resource
-func newResource(name string, isLock bool) (r *Resource) {
-	r = &Resource{name, isLock, make(map[string]*Ticket)}
+func newResource(namespace, name string, isLock bool) (r *Resource) {
+	r = &Resource{name, isLock, make(map[string]*Ticket), normalNamespace(namespace)}
 	return
 }
 
 // Create a new ticket
-func newTicket(name, resname string, issuer *Session, data []byte) (t *Ticket) {
-	t = &Ticket{name, resname, data, issuer, nil}
+func newTicket(name, resname string, issuer *Session, data []byte, now time.Time) (t *Ticket) {
+	t = &Ticket{Name: name, ResourceName: resname, Data: data, Issuer: issuer, CreatedAt: now}
 	return
 }
 
-// Creae a new session
-func newSession(name, src string, ttl int) (s *Session) {
-	guid := ksuid.New()
-	s = &Session{Name: name, Id: guid.String(), Src: src, Ttl: ttl, Tickets: []*Ticket{}, Issuances: []*Ticket{}}
-	s.refresh()
+// Creae a new session. Session ids are generated by newSessionId
+func newSession(id, name, src string, ttl int, now time.Time) (s *Session) {
+	s = &Session{Name: name, Id: id, Src: src, Ttl: ttl, Tickets: []*Ticket{}, Issuances: []*Ticket{}, CreatedAt: now}
+	s.refresh(now)
 	return
 }
 
+// Generate a new session id
+func newSessionId() string {
+	return ksuid.New().String()
+}
+
 // Create a new ticketd instance. expireTickMs specifies how often to run the session expiration loop. Defaults to 1000ms. snapshotPath specifies a directory
 // to write snapshots to (we will attempt to create it). If empty, no snapshotting is done. snapshotInterval specifies (in ms) how often to
 // write out a snashot. Defaults to 1000ms. Finally, you can pass in your own logger. If no logger is  specified, you get a DefaultLogger (logs to console) set to
-// a loglevel of 3.
-func NewTicketD(expireTickMs int, snapshotPath string, snapshotInterval int, logger Logger) (td *TicketD) {
-	td = &TicketD{make(chan ticketFunc), make(chan interface{}), nil,
-		expireTickMs, snapshotInterval, snapshotPath, logger}
+// a loglevel of 3. clock is the source of time for session refresh and expiry. If nil, the wall clock (RealClock) is used.
+func NewTicketD(expireTickMs int, snapshotPath string, snapshotInterval int, logger Logger, clock Clock) (td *TicketD) {
+	td = &TicketD{ticketChan: make(chan *ticketCall), quitChan: make(chan interface{}), stoppedChan: make(chan interface{}),
+		expireTickTimeMs: expireTickMs, snapshotInterval: snapshotInterval, snapshotPath: snapshotPath, logger: logger,
+		requests: newRequestCache(), clock: clock}
 	if td.expireTickTimeMs == 0 {
 		td.expireTickTimeMs = expireDelayMs
 	}
@@ -86,9 +129,22 @@ func NewTicketD(expireTickMs int, snapshotPath string, snapshotInterval int, log
 	if td.logger == nil {
 		td.logger = &DefaultLogger{3}
 	}
+	if td.clock == nil {
+		td.clock = RealClock{}
+	}
 	return
 }
 
+// Our clock
+func (td *TicketD) Clock() Clock {
+	return td.clock
+}
+
+// The time according to our clock
+func (td *TicketD) Now() time.Time {
+	return td.clock.Now()
+}
+
 // Manage locks, sessions and tickets
 func (td *TicketD) ticketProc() (restart bool) {
 	sessions := make(map[string]*Session)
@@ -113,20 +169,28 @@ func (td *TicketD) ticketProc() (restart bool) {
 		}
 	}()
 
-	ticker := time.NewTicker(time.Duration(td.expireTickTimeMs) * time.Millisecond)
+	ticker := td.clock.NewTicker(time.Duration(td.expireTickTimeMs) * time.Millisecond)
+	defer ticker.Stop()
 	td.logger.Log(2, "Ticket processing starting...")
 	for {
 		select {
-		case <-ticker.C:
-			td.expireSessions(sessions, resources)
+		case <-ticker.C():
+			// Only the leader expires sessions. Followers get expirations from the leader
+			now := td.clock.Now()
+			if td.IsLeader() && needsExpire(sessions, resources, now) {
+				td.run(&ticketCall{f: func(sessions map[string]*Session, resources map[string]*Resource) {
+					td.expire(sessions, resources, now)
+				}, op: "expiration"}, sessions, resources)
+			}
 		case q := <-td.quitChan:
 			if q == nil {
 				td.logger.Log(2, "Received quit signal. Exiting ticket processing loop...")
-				close(td.quitChan)
+				td.closeSubscribers()
+				close(td.stoppedChan)
 				return
 			}
-		case f := <-td.ticketChan:
-			f(sessions, resources)
+		case call := <-td.ticketChan:
+			call.done <- td.run(call, sessions, resources)
 		}
 	}
 }
@@ -152,22 +216,213 @@ func (td *TicketD) Start() {
 	}
 }
 
-// Stop ticketd.
+// Stop ticketd. Calls made after ticketd stops fail with ErrStopped. Safe to call more than once
 func (td *TicketD) Quit() {
-	if td.quitSnapChan != nil {
-		td.logger.Log(2, "Signaling snapshotter to quit...")
-		td.quitSnapChan <- nil
-		<-td.quitSnapChan
+	td.quitOnce.Do(func() {
+		if td.quitSnapChan != nil {
+			td.logger.Log(2, "Signaling snapshotter to quit...")
+			td.quitSnapChan <- nil
+			<-td.quitSnapChan
+		}
+		td.logger.Log(2, "Signaling ticket processor to quit...")
+		td.quitChan <- nil
+		<-td.stoppedChan
+	})
+}
+
+// Hand a function to the ticket loop and wait for it to run. Fails with ErrStopped if ticketd has quit, or with the
+// context error if the context is done before the loop takes the function. Once taken, the function runs without
+// delay. If the function panics, the panic is logged along with op (a format string) and args, and send fails with
+// ErrInternal. Functions should hand their results over on buffered channels, as send returns only once they are done
+func (td *TicketD) send(ctx context.Context, f ticketFunc, op string, args ...interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
 	}
-	td.logger.Log(2, "Signaling ticket processor to quit...")
-	td.quitChan <- nil
-	<-td.quitChan
+	call := &ticketCall{f: f, op: op, args: args, done: make(chan error, 1)}
+	select {
+	case td.ticketChan <- call:
+	case <-td.stoppedChan:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-call.done
 }
 
-func (td *TicketD) expireSessions(sessions map[string]*Session, resources map[string]*Resource) {
+// Run a call in the ticket loop. A panic fails the call, but leaves the loop and our state as they are: whatever the
+// call changed before it panicked stays changed. Must only be called from the ticket loop
+func (td *TicketD) run(call *ticketCall, sessions map[string]*Session, resources map[string]*Resource) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			op := fmt.Sprintf(call.op, call.args...)
+			td.logger.Log(0, "PANIC in ticket loop running %s: %v", op, r)
+			td.logger.Log(0, "Stack trace:\n%s", debug.Stack())
+			err = fmt.Errorf("%s failed: %v (%w)", op, r, ErrInternal)
+		}
+	}()
+	call.f(sessions, resources)
+	td.debugCheck(sessions, resources, call)
+	return
+}
+
+// Run a command through the ticket loop (or the committer, if we are clustered) and wait for the result. Commands
+// are only accepted by the leader, and are checked against the access control policy first
+func (td *TicketD) execute(ctx context.Context, cmd *Command) (res *Result) {
+	if err := td.authorizeCommand(ctx, cmd); err != nil {
+		td.auditRefused(ctx, cmd, err)
+		return &Result{Err: err}
+	}
+	if principal, ok := ContextPrincipal(ctx); ok && cmd.Principal == "" {
+		cmd.Principal = principal
+	}
+	if cmd.Token == "" {
+		cmd.Token = ContextSessionToken(ctx)
+	}
+	if cmd.Namespace == "" {
+		cmd.Namespace = ContextNamespace(ctx)
+	}
+	if !ValidNamespace(cmd.Namespace) {
+		return &Result{Err: fmt.Errorf("bad namespace %q (%w)", cmd.Namespace, ErrNotFound)}
+	}
+	if err := checkResourceName(cmd.Resource); err != nil {
+		return &Result{Err: err}
+	}
+	if (cmd.Op == OpRevokeTicket || cmd.Op == OpSyncTickets) && td.revokePolicy == RevokeIssuerOnly {
+		cmd.IssuerOnly = true
+	}
+	if cmd.Quotas == nil {
+		cmd.Quotas = td.Quotas().For(cmd.Namespace)
+	}
+	if cmd.Time.IsZero() {
+		cmd.Time = td.clock.Now()
+	}
+	if c := td.getCommitter(); c != nil {
+		if err := ctx.Err(); err != nil {
+			return &Result{Err: err}
+		}
+		// The commit can't be abandoned once started, but we don't have to wait for it
+		resChan := make(chan *Result, 1)
+		go func() { resChan <- c.Commit(cmd) }()
+		select {
+		case res = <-resChan:
+		case <-ctx.Done():
+			res = &Result{Err: ctx.Err()}
+		}
+		return
+	}
+	resChan := make(chan *Result, 1)
+	defer close(resChan)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		if !td.IsLeader() {
+			resChan <- &Result{Err: fmt.Errorf("this node follows %s (%w)", td.Leader(), ErrNotLeader)}
+			return
+		}
+		resChan <- td.commit(sessions, resources, cmd)
+	}
+	if err := td.send(ctx, f, "command %s", cmd); err != nil {
+		return &Result{Err: err}
+	}
+	res = <-resChan
+	return
+}
+
+// Run a command, and wait for the result. This is what the public mutators use. Set cmd.RequestId to make the
+// command safe to retry: a command repeating a recent request id gets the original result back
+func (td *TicketD) Submit(cmd *Command) (res *Result) {
+	return td.SubmitContext(context.Background(), cmd)
+}
+
+// Run a command, giving up when ctx is done. A command that has already been handed on may still be applied
+func (td *TicketD) SubmitContext(ctx context.Context, cmd *Command) (res *Result) {
+	if cmd.Op == OpOpenSession && cmd.SessId == "" {
+		cmd.SessId, cmd.Token = newSessionId(), newSessionToken()
+	}
+	return td.execute(ctx, cmd)
+}
+
+// Apply a command and pass it on to replication subscribers. Must only be called from the ticket loop
+func (td *TicketD) commit(sessions map[string]*Session, resources map[string]*Resource, cmd *Command) (res *Result) {
+	// Repeats of a request were audited the first time round
+	var entries []*AuditEntry
+	if (td.AuditLog() != nil || cmd.Op.forced()) && (cmd.RequestId == "" || td.requests.get(cmd.RequestId, cmd.Time) == nil) {
+		entries = auditEntries(sessions, cmd)
+	}
+	res = td.applyRequest(sessions, resources, cmd)
+	td.seq++
+	td.audit(td.seq, cmd.Replayed, entries, res)
+	td.publish(&ReplicaEntry{td.seq, cmd})
+	return
+}
+
+// Expire sessions. When clustered, the expiration is committed in the background -- we can't block the ticket loop
+// while it is committed, since committed commands are applied by the ticket loop. Must only be called from the ticket loop
+func (td *TicketD) expire(sessions map[string]*Session, resources map[string]*Resource, now time.Time) {
+	cmd := &Command{Op: OpExpire, Time: now}
+	c := td.getCommitter()
+	if c == nil {
+		td.commit(sessions, resources, cmd)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&td.expiring, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&td.expiring, 0)
+		if res := c.Commit(cmd); res.Err != nil {
+			td.logger.Log(2, "Unable to commit expiration: %s", res.Err.Error())
+		}
+	}()
+}
+
+// Run an expiration pass now, as of our clock's time, instead of waiting for the expire tick. Useful with a clock
+// that does not run by itself. Only the leader expires sessions
+func (td *TicketD) Expire() (err error) {
+	return td.ExpireContext(context.Background())
+}
+
+// Run an expiration pass now, giving up when ctx is done
+func (td *TicketD) ExpireContext(ctx context.Context) (err error) {
+	if !td.IsLeader() {
+		return ErrNotLeader
+	}
+	errChan := make(chan error, 1)
+	f := func(sessions map[string]*Session, resources map[string]*Resource) {
+		if now := td.clock.Now(); needsExpire(sessions, resources, now) {
+			td.expire(sessions, resources, now)
+		}
+		errChan <- nil
+	}
+	if err = td.send(ctx, f, "expiration"); err != nil {
+		return
+	}
+	err = <-errChan
+	return
+}
+
+// Check to see if an expiration pass would change anything
+func needsExpire(sessions map[string]*Session, resources map[string]*Resource, now time.Time) bool {
+	for _, s := range sessions {
+		if s.ExpiresAt.Before(now) {
+			return true
+		}
+	}
+	for _, resource := range resources {
+		if len(resource.Tickets) == 0 {
+			return true
+		}
+		for _, tick := range resource.Tickets {
+			if tick.Issuer == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (td *TicketD) expireSessions(sessions map[string]*Session, resources map[string]*Resource, now time.Time) {
 	// Expire sessions
 	for id, s := range sessions {
-		if s.expires.Before(time.Now()) {
+		if s.ExpiresAt.Before(now) {
 			td.logger.Log(3, "Expiring session %s (%s) with timeout %ds ms", s.Id, s.Name, s.Ttl)
 			s.clearClaims(resources)
 			delete(sessions, id)
@@ -190,22 +445,23 @@ func (td *TicketD) expireSessions(sessions map[string]*Session, resources map[st
 }
 
 // refresh session
-func (s *Session) refresh() {
-	s.expires = time.Now().Add(time.Millisecond * time.Duration(s.Ttl))
+func (s *Session) refresh(now time.Time) {
+	s.LastRefreshedAt = now
+	s.ExpiresAt = now.Add(time.Millisecond * time.Duration(s.Ttl))
 }
 
 // Clear session claims, issuances, etc
 // Used on expiration of session
 func (s *Session) clearClaims(resources map[string]*Resource) {
 	for _, ticket := range s.Tickets {
-		t := fetchTicketPtr(ticket, resources) // Refresh ticket ptr -- can be out of date
+		t := fetchTicketPtr(s.Namespace, ticket, resources) // Refresh ticket ptr -- can be out of date
 		if t != nil && t.Claimant == s {
 			log.Printf("Clearing session %s claim on ticket %s", s.Id, ticket.Name)
-			t.Claimant = nil
+			t.Claimant, t.ClaimedAt = nil, time.Time{}
 		}
 	}
 	for _, ticket := range s.Issuances {
-		t := fetchTicketPtr(ticket, resources) // Refresh ticket ptr -- can be out of date
+		t := fetchTicketPtr(s.Namespace, ticket, resources) // Refresh ticket ptr -- can be out of date
 		if t != nil && t.Issuer == s {
 			log.Printf("Clearing session %s issuer  on ticket %s", s.Id, ticket.Name)
 			t.Issuer = nil
@@ -216,9 +472,9 @@ func (s *Session) clearClaims(resources map[string]*Resource) {
 	s.Issuances = []*Ticket{}
 }
 
-// Fetch a ticket pointer
-func fetchTicketPtr(in *Ticket, resources map[string]*Resource) (out *Ticket) {
-	r := resources[in.ResourceName]
+// Fetch a ticket pointer. Tickets are in the namespace of the sessions that hold them
+func fetchTicketPtr(namespace string, in *Ticket, resources map[string]*Resource) (out *Ticket) {
+	r := resources[resourceKey(namespace, in.ResourceName)]
 	if r == nil {
 		return
 	}
@@ -286,71 +542,66 @@ func ticketRemove(oldArray []*Ticket, t *Ticket) []*Ticket {
 }
 
 // Public functions for sessions
+//
+// Every public function that goes through the ticket loop has a ...Context variant. The context bounds how long we
+// wait for the ticket loop (or the cluster) to take the call. Calls fail with ErrStopped once ticketd has quit
 
 // Open a new session
 func (td *TicketD) OpenSession(name, src string, ttl int) (id string, err error) {
-	errChan := make(chan error)
-	s := newSession(name, src, ttl)
-	id = s.Id
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		sessions[s.Id] = s
-		td.logger.Log(3, "Opened new session %s (%s)", s.Id, s.Name)
-		errChan <- nil
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.OpenSessionContext(context.Background(), name, src, ttl)
+}
+
+// Open a new session, giving up when ctx is done
+func (td *TicketD) OpenSessionContext(ctx context.Context, name, src string, ttl int) (id string, err error) {
+	res := td.SubmitContext(ctx, &Command{Op: OpOpenSession, Name: name, Src: src, Ttl: ttl})
+	id, err = res.SessId, res.Err
 	return
 }
 
 // Close a session and release all tickets issued and claimed
 func (td *TicketD) CloseSession(id string) (err error) {
-	errChan := make(chan error)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		if s := sessions[id]; s != nil {
-			td.logger.Log(3, "Closing  session %s (%s)", s.Id, s.Name)
-			s.clearClaims(resources)
-			delete(sessions, id)
-			errChan <- nil
-		} else {
-			td.logger.Log(3, "Closing session: %s not found", id)
-			errChan <- fmt.Errorf("Session not found: %s (%w)", id, ErrNotFound)
-		}
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.CloseSessionContext(context.Background(), id)
+}
+
+// Close a session, giving up when ctx is done
+func (td *TicketD) CloseSessionContext(ctx context.Context, id string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpCloseSession, SessId: id}).Err
 	return
 }
 
 // Get a copy of a session
 func (td *TicketD) GetSession(id string) (ret *Session, err error) {
-	errChan := make(chan error)
+	return td.GetSessionContext(context.Background(), id)
+}
+
+// Get a copy of a session, giving up when ctx is done
+func (td *TicketD) GetSessionContext(ctx context.Context, id string) (ret *Session, err error) {
+	errChan := make(chan error, 1)
 	ret = &Session{}
+	ns := ContextNamespace(ctx)
 	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		if s := sessions[id]; s != nil {
+		if s := sessions[id]; s != nil && normalNamespace(s.Namespace) == ns {
 			ret = s.clone()
 			errChan <- nil
 		} else {
 			errChan <- fmt.Errorf("Session not found: %s (%w)", id, ErrNotFound)
 		}
 	}
-	td.ticketChan <- f
+	if err = td.send(ctx, f, "get session %s", id); err != nil {
+		return
+	}
 	err = <-errChan
 	return
 }
 
 // Refresh session timer
 func (td *TicketD) RefreshSession(id string) (err error) {
-	errChan := make(chan error)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		if s := sessions[id]; s != nil {
-			s.refresh()
-			errChan <- nil
-		} else {
-			errChan <- fmt.Errorf("Session not found: %s (%w)", id, ErrNotFound)
-		}
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.RefreshSessionContext(context.Background(), id)
+}
+
+// Refresh session timer, giving up when ctx is done
+func (td *TicketD) RefreshSessionContext(ctx context.Context, id string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpRefreshSession, SessId: id}).Err
 	return
 }
 
@@ -358,73 +609,37 @@ func (td *TicketD) RefreshSession(id string) (err error) {
 
 // Issue a ticket for a resource
 func (td *TicketD) IssueTicket(sessId string, resource string, name string, data []byte) (err error) {
-	errChan := make(chan error)
-	defer close(errChan)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		sess := sessions[sessId]
-		if sess == nil {
-			errChan <- fmt.Errorf("Session not found: %s (%w)", sessId, ErrNotFound)
-			return
-		}
-		sess.refresh()
-		// Create resource if it does not exist
-		r := resources[resource]
-		if r == nil {
-			r = newResource(resource, false)
-			resources[resource] = r
-		} else if r.IsLock {
-			errChan <- fmt.Errorf("cannot issue a ticket on a lock resource (%s) - %w", resource, ErrResourceType)
-			return
-		}
-		ticket := newTicket(name, resource, sess, data)
-		// If ticket exists, but issued by another session we are just going to take it over
-		if oldTick := r.Tickets[name]; oldTick != nil {
-			oldTick.Issuer = nil // Mark this issuer  as no longer valid
-			ticket.Claimant = oldTick.Claimant
-		} else {
-			td.logger.Log(3, "Session %s issuing ticket  %s (%s)", sess.Id, r.Name, name) // Only log on new ticket issuance
-		}
-		r.Tickets[name] = ticket // Set new ticket in ticket list
-		// Add ticket to issuance list if it is not there already
-		sess.Issuances = ticketAddOrUpdate(sess.Issuances, ticket)
-		errChan <- nil
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.IssueTicketContext(context.Background(), sessId, resource, name, data)
+}
+
+// Issue a ticket for a resource, giving up when ctx is done
+func (td *TicketD) IssueTicketContext(ctx context.Context, sessId string, resource string, name string, data []byte) (err error) {
+	err = td.execute(ctx, &Command{Op: OpIssueTicket, SessId: sessId, Resource: resource, Name: name, Data: data}).Err
 	return
 }
 
 // Revoke a ticket for a resource
 func (td *TicketD) RevokeTicket(sessId string, resource string, name string) (err error) {
-	errChan := make(chan error)
-	defer close(errChan)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		sess := sessions[sessId]
-		if sess == nil {
-			errChan <- fmt.Errorf("Session not found: %s (%w)", sessId, ErrNotFound)
-			return
-		}
-		// Get resource
-		r := resources[resource]
-		if r == nil {
-			errChan <- fmt.Errorf("unknown resource: %s (%w)", resource, ErrNotFound)
-			return
-		}
-		// Get ticket -- if it exists
-		tick := r.Tickets[name]
-		if tick == nil {
-			errChan <- fmt.Errorf("unknown ticket for resource %s -> : %s", resource, name)
-			return
-		}
-		// We still allow revocation of a ticket, even if issued in another session
-		td.logger.Log(3, "Session %s revoking ticket  %s (%s)", sess.Id, r.Name, tick.Name)
-		delete(r.Tickets, name)
-		// Remove ticket from session issuance list
-		sess.Issuances = ticketRemove(sess.Issuances, tick)
-		errChan <- nil
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.RevokeTicketContext(context.Background(), sessId, resource, name)
+}
+
+// Revoke a ticket for a resource, giving up when ctx is done
+func (td *TicketD) RevokeTicketContext(ctx context.Context, sessId string, resource string, name string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpRevokeTicket, SessId: sessId, Resource: resource, Name: name}).Err
+	return
+}
+
+// Bring a resource's tickets in line with a desired set (ticket name -> data) in one step. Tickets not in the set are
+// revoked, whoever issued them. New tickets are issued by the session, and tickets that remain keep their claims.
+// Returns the changes made
+func (td *TicketD) SyncTickets(sessId string, resource string, tickets map[string][]byte) (res *SyncResult, err error) {
+	return td.SyncTicketsContext(context.Background(), sessId, resource, tickets)
+}
+
+// Sync a resource's tickets, giving up when ctx is done
+func (td *TicketD) SyncTicketsContext(ctx context.Context, sessId string, resource string, tickets map[string][]byte) (res *SyncResult, err error) {
+	r := td.execute(ctx, &Command{Op: OpSyncTickets, SessId: sessId, Resource: resource, Tickets: tickets})
+	res, err = r.Sync, r.Err
 	return
 }
 
@@ -433,93 +648,115 @@ func (td *TicketD) RevokeTicket(sessId string, resource string, name string) (er
 // If the ticket is clamed, ok will be false, and ticket will be nil. err eill be nil
 // On anything else, err will be set
 func (td *TicketD) ClaimTicket(sessId string, resource string) (ok bool, t *Ticket, err error) {
-	errChan := make(chan error)
-	defer close(errChan)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		sess := sessions[sessId]
-		if sess == nil {
-			errChan <- fmt.Errorf("Session not found: %s (%w)", sessId, ErrNotFound)
-			return
-		}
-		// Get resource
-		r := resources[resource]
-		if r == nil {
-			// We treat a missing resource as if the ticket is already claimed
-			errChan <- nil
-			return
-		} else if r.IsLock {
-			errChan <- fmt.Errorf("cannot claim a ticket on a lock resource (%s) - %w", resource, ErrResourceType)
-			return
-		}
-		for _, ticket := range r.Tickets {
-			if ticket.Issuer != nil && (ticket.Claimant == nil || ticket.Claimant == sess) {
-				ticket.Claimant = sess
-				ok = true
-				sess.Tickets = ticketAddOrUpdate(sess.Tickets, ticket)
-				t = ticket.clone()
-				td.logger.Log(3, "Session %s claimed ticket  %s (%s)", sess.Id, r.Name, t.Name)
-				break
-			}
-		}
-		errChan <- nil
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.ClaimTicketContext(context.Background(), sessId, resource)
+}
+
+// Claim a ticket for a resource, giving up when ctx is done
+func (td *TicketD) ClaimTicketContext(ctx context.Context, sessId string, resource string) (ok bool, t *Ticket, err error) {
+	res := td.execute(ctx, &Command{Op: OpClaimTicket, SessId: sessId, Resource: resource})
+	ok, t, err = res.Ok, res.Ticket, res.Err
 	return
 }
 
 // Release a ticket for a resource back to pool
 func (td *TicketD) ReleaseTicket(sessId string, resource string, name string) (err error) {
-	errChan := make(chan error)
+	return td.ReleaseTicketContext(context.Background(), sessId, resource, name)
+}
+
+// Release a ticket for a resource back to pool, giving up when ctx is done
+func (td *TicketD) ReleaseTicketContext(ctx context.Context, sessId string, resource string, name string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpReleaseTicket, SessId: sessId, Resource: resource, Name: name}).Err
+	return
+}
+
+// Verify that a session holds a parituclar ticket
+func (td *TicketD) HasTicket(sessId string, resource string, name string) (ok bool, err error) {
+	return td.HasTicketContext(context.Background(), sessId, resource, name)
+}
+
+// Verify that a session holds a particular ticket, giving up when ctx is done. A session token carried by ctx must
+// match the session's
+func (td *TicketD) HasTicketContext(ctx context.Context, sessId string, resource string, name string) (ok bool, err error) {
+	if err = checkResourceName(resource); err != nil {
+		return
+	}
+	if err = td.Authorize(ctx, VerbClaim, resource); err != nil {
+		return
+	}
+	errChan := make(chan error, 1)
 	defer close(errChan)
+	ns := ContextNamespace(ctx)
+	token := ContextSessionToken(ctx)
 	f := func(sessions map[string]*Session, resources map[string]*Resource) {
 		sess := sessions[sessId]
-		if sess == nil {
+		if sess == nil || normalNamespace(sess.Namespace) != ns {
 			errChan <- fmt.Errorf("Session not found: %s (%w)", sessId, ErrNotFound)
 			return
 		}
+		if err := checkSessionToken(sess, &Command{Token: token}); err != nil {
+			errChan <- err
+			return
+		}
 		// Get resource
-		r := resources[resource]
+		r := resources[resourceKey(ns, resource)]
 		if r == nil {
 			errChan <- fmt.Errorf("unknown resource: %s (%w)", resource, ErrNotFound)
 			return
 		}
 		ticket := r.Tickets[name]
 		if ticket != nil && ticket.Claimant == sess {
-			ticket.Claimant = nil
-			sess.Tickets = ticketRemove(sess.Tickets, ticket)
-			td.logger.Log(3, "Session %s released ticket  %s (%s)", sess.Id, r.Name, ticket.Name)
+			ok = true
 		}
 		errChan <- nil
 	}
-	td.ticketChan <- f
+	if err = td.send(ctx, f, "has ticket %s/%s for session %s", resource, name, sessId); err != nil {
+		return
+	}
 	err = <-errChan
 	return
 }
 
-// Verify that a session holds a parituclar ticket
-func (td *TicketD) HasTicket(sessId string, resource string, name string) (ok bool, err error) {
-	errChan := make(chan error)
+// Check whether a session holds the lock on a resource. token is the session token, if one is presented
+func (td *TicketD) HasLock(sessId, token, resource string) (ok bool, err error) {
+	return td.HasLockContext(context.Background(), sessId, token, resource)
+}
+
+// Check whether a session holds the lock on a resource, giving up when ctx is done
+func (td *TicketD) HasLockContext(ctx context.Context, sessId, token, resource string) (ok bool, err error) {
+	if err = checkResourceName(resource); err != nil {
+		return
+	}
+	if err = td.Authorize(ctx, VerbLock, resource); err != nil {
+		return
+	}
+	errChan := make(chan error, 1)
 	defer close(errChan)
+	ns := ContextNamespace(ctx)
 	f := func(sessions map[string]*Session, resources map[string]*Resource) {
 		sess := sessions[sessId]
-		if sess == nil {
+		if sess == nil || normalNamespace(sess.Namespace) != ns {
 			errChan <- fmt.Errorf("Session not found: %s (%w)", sessId, ErrNotFound)
 			return
 		}
-		// Get resource
-		r := resources[resource]
-		if r == nil {
-			errChan <- fmt.Errorf("unknown resource: %s (%w)", resource, ErrNotFound)
+		if err := checkSessionToken(sess, &Command{Token: token}); err != nil {
+			errChan <- err
 			return
 		}
-		ticket := r.Tickets[name]
-		if ticket != nil && ticket.Claimant == sess {
-			ok = true
+		r := resources[resourceKey(ns, resource)]
+		if r == nil {
+			errChan <- fmt.Errorf("could not find lock resource %s (%w)", resource, ErrNotFound)
+			return
+		} else if !r.IsLock {
+			errChan <- fmt.Errorf("cannot lock/unlock a non-lock  resource (%s) - %w", resource, ErrResourceType)
+			return
 		}
+		ticket := r.Tickets[resource]
+		ok = ticket != nil && ticket.Issuer == sess
 		errChan <- nil
 	}
-	td.ticketChan <- f
+	if err = td.send(ctx, f, "has lock %s for session %s", resource, sessId); err != nil {
+		return
+	}
 	err = <-errChan
 	return
 }
@@ -528,20 +765,44 @@ func (td *TicketD) HasTicket(sessId string, resource string, name string) (ok bo
 
 // Get a copy of the resources table, along with all associated tickets
 func (td *TicketD) GetResources() (out map[string]*Resource) {
+	out, _ = td.GetResourcesContext(context.Background())
+	return
+}
+
+// Get a copy of the resources table, giving up when ctx is done. Only resources in the namespace of ctx that the
+// principal in ctx may dump are included, keyed by name
+func (td *TicketD) GetResourcesContext(ctx context.Context) (out map[string]*Resource, err error) {
+	if err = td.authorizeAny(ctx, VerbDump); err != nil {
+		return make(map[string]*Resource), err
+	}
+	return td.getResources(ctx, ContextNamespace(ctx))
+}
+
+// Get a copy of the resources in a namespace, keyed by name. An empty namespace gets all of them, keyed by
+// resourceKey
+func (td *TicketD) getResources(ctx context.Context, namespace string) (out map[string]*Resource, err error) {
 	out = make(map[string]*Resource)
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 	defer close(errChan)
 	f := func(sessions map[string]*Session, resources map[string]*Resource) {
 		for k, v := range resources {
-			nr := Resource{Name: k, IsLock: v.IsLock, Tickets: make(map[string]*Ticket)}
+			if namespace != "" && (v.Namespace != namespace || td.Authorize(ctx, VerbDump, v.Name) != nil) {
+				continue
+			}
+			nr := Resource{Name: v.Name, IsLock: v.IsLock, Tickets: make(map[string]*Ticket), Namespace: v.Namespace}
 			for tn, tick := range v.Tickets {
 				nr.Tickets[tn] = tick.clone()
 			}
+			if namespace != "" {
+				k = v.Name
+			}
 			out[k] = &nr
 		}
 		errChan <- nil
 	}
-	td.ticketChan <- f
+	if err = td.send(ctx, f, "get resources"); err != nil {
+		return
+	}
 	<-errChan
 	return
 }
@@ -549,101 +810,77 @@ func (td *TicketD) GetResources() (out map[string]*Resource) {
 // Lock a lockable resource. If it does not exist, it will be created. If the resource exists, but is not lockable, an error is retured.
 // Returns ok==true if lock succeeds. Else you can retry
 func (td *TicketD) Lock(sessId, resource string) (ok bool, err error) {
-	errChan := make(chan error)
-	defer close(errChan)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		sess := sessions[sessId]
-		if sess == nil {
-			errChan <- fmt.Errorf("Session not found: %s (%w)", sessId, ErrNotFound)
-			return
-		}
-		// Get resource
-		r := resources[resource]
-		if r == nil {
-			r = newResource(resource, true)
-			resources[resource] = r
-		} else if !r.IsLock {
-			errChan <- fmt.Errorf("cannot lock/unlock a non-lock  resource (%s) - %w", resource, ErrResourceType)
-			return
-		}
-		ticket := r.Tickets[resource]
-		// We should have either no tickets or a single ticket with the same name as the resource
-		if len(r.Tickets) > 1 || (len(r.Tickets) == 1 && ticket == nil) {
-			errChan <- fmt.Errorf("malformed lock resource %s. More than one ticket present or wrong ticket name in resource", resource)
-			return
-		}
-		if ticket == nil {
-			ticket = newTicket(resource, resource, sess, []byte{})
-			r.Tickets[resource] = ticket
-			sess.Issuances = ticketAddOrUpdate(sess.Issuances, ticket)
-		}
-		// If the single ticket is not nil, then it must belong to us (issuer) or we can't lock it
-		if ticket != nil && ticket.Issuer.Id == sess.Id {
-			ok = true
-			errChan <- nil
-			return
-		}
-		// No icket, so we can claim it
-		errChan <- nil
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.LockContext(context.Background(), sessId, resource)
+}
+
+// Lock a lockable resource, giving up when ctx is done
+func (td *TicketD) LockContext(ctx context.Context, sessId, resource string) (ok bool, err error) {
+	res := td.execute(ctx, &Command{Op: OpLock, SessId: sessId, Resource: resource})
+	ok, err = res.Ok, res.Err
 	return
 }
 
 // Unlock a locked resource.
 func (td *TicketD) Unlock(sessId, resource string) (err error) {
-	errChan := make(chan error)
-	defer close(errChan)
-	f := func(sessions map[string]*Session, resources map[string]*Resource) {
-		sess := sessions[sessId]
-		if sess == nil {
-			errChan <- fmt.Errorf("session not found: %s (%w)", sessId, ErrNotFound)
-			return
-		}
-		// Get resource
-		r := resources[resource]
-		if r == nil {
-			errChan <- fmt.Errorf("could not find lock resource %s (%w)", resource, ErrNotFound)
-			return
-		} else if !r.IsLock {
-			errChan <- fmt.Errorf("cannot lock/unlock a non-lock  resource (%s) - %w", resource, ErrResourceType)
-			return
-		}
-		ticket := r.Tickets[resource]
-		// We should have either no tickets or a single ticket with the same name as the resource
-		if ticket == nil {
-			errChan <- fmt.Errorf("Resource %s is not locked (%w)", resource, ErrNotFound)
-			return
-		}
-		// If the single ticket is not nil, then it must belong to us (issuer) or we can't lock it
-		if ticket.Issuer.Id != sess.Id {
-			errChan <- fmt.Errorf("Resource %s is locked  by another session (%w)", resource, ErrNotFound)
-			return
-		}
-		// There is a ticket and we are the issue -- so we can delete the ticket
-		ticket.Issuer = nil
-		delete(r.Tickets, ticket.Name)
-		sess.Issuances = ticketRemove(sess.Issuances, ticket)
-		errChan <- nil
-	}
-	td.ticketChan <- f
-	err = <-errChan
+	return td.UnlockContext(context.Background(), sessId, resource)
+}
+
+// Unlock a locked resource, giving up when ctx is done
+func (td *TicketD) UnlockContext(ctx context.Context, sessId, resource string) (err error) {
+	err = td.execute(ctx, &Command{Op: OpUnlock, SessId: sessId, Resource: resource}).Err
 	return
 }
 
 // Get a copy of the sessions table
 func (td *TicketD) GetSessions() (out map[string]*Session) {
+	out, _ = td.GetSessionsContext(context.Background())
+	return
+}
+
+// Get a copy of the sessions table, giving up when ctx is done. Only sessions in the namespace of ctx are included,
+// and tickets for resources the principal in ctx may not dump are left out
+func (td *TicketD) GetSessionsContext(ctx context.Context) (out map[string]*Session, err error) {
+	if err = td.authorizeAny(ctx, VerbDump); err != nil {
+		return make(map[string]*Session), err
+	}
+	return td.getSessions(ctx, ContextNamespace(ctx))
+}
+
+// Get a copy of the sessions in a namespace. An empty namespace gets all of them, with all their tickets
+func (td *TicketD) getSessions(ctx context.Context, namespace string) (out map[string]*Session, err error) {
 	out = make(map[string]*Session)
-	errChan := make(chan error)
+	dumpable := func(t *Ticket) bool { return td.Authorize(ctx, VerbDump, t.ResourceName) == nil }
+	errChan := make(chan error, 1)
 	defer close(errChan)
 	f := func(sessions map[string]*Session, resources map[string]*Resource) {
 		for k, v := range sessions {
-			out[k] = v.clone()
+			if namespace == "" {
+				out[k] = v.clone()
+				continue
+			}
+			if normalNamespace(v.Namespace) != namespace {
+				continue
+			}
+			s := v.clone()
+			s.Tickets, s.Issuances = filterTickets(s.Tickets, dumpable), filterTickets(s.Issuances, dumpable)
+			out[k] = s
 		}
 		errChan <- nil
 	}
-	td.ticketChan <- f
+	if err = td.send(ctx, f, "get sessions"); err != nil {
+		return
+	}
 	<-errChan
 	return
 }
+
+// Keep the tickets keep returns true for
+func filterTickets(tickets []*Ticket, keep func(t *Ticket) bool) (out []*Ticket) {
+	out = tickets[:0:0]
+	for _, t := range tickets {
+		if keep(t) {
+			out = append(out, t)
+		}
+	}
+	return
+}
@@ -2,6 +2,8 @@ package ticket
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -15,7 +17,7 @@ var logLevel = flag.Int("loglevel", 0, "Log level to use")
 
 func TestSession(t *testing.T) {
 	r := require.New(t)
-	td := startTicketD(false)
+	td := startTicketD("")
 	defer stopTicketD(td)
 	// Create and close a session
 	id, err := td.OpenSession("test session", "ANY", 5000)
@@ -50,7 +52,7 @@ func TestSession(t *testing.T) {
 
 func TestTicketIssue(t *testing.T) {
 	r := require.New(t)
-	td := startTicketD(false)
+	td := startTicketD("")
 	defer stopTicketD(td)
 	// Create and close a session
 	issuerId, err := td.OpenSession("test issuer", "ANY", 1000)
@@ -119,9 +121,75 @@ func TestTicketIssue(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
+func TestSyncTickets(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	issuerId, err := td.OpenSession("issuer", "ANY", 1000)
+	r.NoError(err)
+	otherId, err := td.OpenSession("other", "ANY", 1000)
+	r.NoError(err)
+	claimantId, err := td.OpenSession("claimant", "ANY", 1000)
+	r.NoError(err)
+	r.NoError(td.IssueTicket(issuerId, "test", "a", []byte("a data")))
+	r.NoError(td.IssueTicket(issuerId, "test", "b", []byte("b data")))
+	r.NoError(td.IssueTicket(otherId, "test", "x", []byte("x data")))
+	ok, tick, err := td.ClaimTicket(claimantId, "test")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal("a", tick.Name)
+	res, err := td.SyncTickets(issuerId, "test", map[string][]byte{"a": []byte("a data"), "b": []byte("new b data"),
+		"c": []byte("c data")})
+	r.NoError(err)
+	r.Equal([]string{"c"}, res.Issued)
+	r.Equal([]string{"b"}, res.Updated)
+	r.Equal([]string{"x"}, res.Revoked)
+	r.Equal([]string{"a"}, res.Unchanged)
+	// Claims on tickets we keep are kept
+	ok, err = td.HasTicket(claimantId, "test", "a")
+	r.NoError(err)
+	r.True(ok)
+	resources := td.GetResources()
+	r.Len(resources["test"].Tickets, 3)
+	r.Equal([]byte("new b data"), resources["test"].Tickets["b"].Data)
+	other, err := td.GetSession(otherId)
+	r.NoError(err)
+	r.Empty(other.Issuances)
+	// Revoked tickets are taken from their claimant, and taken over ones stay claimed
+	r.NoError(td.IssueTicket(otherId, "revoked", "x", nil))
+	r.NoError(td.IssueTicket(otherId, "taken", "x", nil))
+	for _, res := range []string{"revoked", "taken"} {
+		ok, _, err = td.ClaimTicket(claimantId, res)
+		r.NoError(err)
+		r.True(ok)
+	}
+	_, err = td.SyncTickets(issuerId, "revoked", map[string][]byte{"y": nil})
+	r.NoError(err)
+	_, err = td.SyncTickets(issuerId, "taken", map[string][]byte{"x": nil})
+	r.NoError(err)
+	claimant, err := td.GetSession(claimantId)
+	r.NoError(err)
+	r.Len(claimant.Tickets, 2)
+	for _, tk := range claimant.Tickets {
+		r.NotEqual("revoked", tk.ResourceName)
+	}
+	ok, err = td.HasTicket(claimantId, "taken", "x")
+	r.NoError(err)
+	r.True(ok)
+	other, err = td.GetSession(otherId)
+	r.NoError(err)
+	r.Empty(other.Issuances)
+	// Lock resources can't be synced
+	ok, err = td.Lock(issuerId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	_, err = td.SyncTickets(issuerId, "lock", map[string][]byte{"a": nil})
+	r.True(errors.Is(err, ErrResourceType))
+}
+
 func TestIssuerTimeout(t *testing.T) {
 	r := require.New(t)
-	td := startTicketD(false)
+	td := startTicketD("")
 	defer stopTicketD(td)
 	// Create a session, issue a ticket and let it expire
 	issuerId, err := td.OpenSession("test issuer", "ANY", 500)
@@ -139,7 +207,7 @@ func TestIssuerTimeout(t *testing.T) {
 
 func TestMultipleIssue(t *testing.T) {
 	r := require.New(t)
-	td := startTicketD(false)
+	td := startTicketD("")
 	defer stopTicketD(td)
 	// Create a session, issue a ticket and let it expire
 	issuerId, err := td.OpenSession("test issuer", "ANY", 500)
@@ -157,7 +225,7 @@ func TestMultipleIssue(t *testing.T) {
 
 func TestClaimantTimeout(t *testing.T) {
 	r := require.New(t)
-	td := startTicketD(false)
+	td := startTicketD("")
 	defer stopTicketD(td)
 	// Create a session, issue a ticket and let it expire
 	issuerId, err := td.OpenSession("test issuer", "ANY", 5000)
@@ -192,9 +260,9 @@ func TestClaimantTimeout(t *testing.T) {
 }
 
 func TestPersistence(t *testing.T) {
-	os.RemoveAll("./snaps")
 	r := require.New(t)
-	td := startTicketD(true)
+	snaps := t.TempDir()
+	td := startTicketD(snaps)
 	stopped := false
 	defer func() {
 		if !stopped {
@@ -218,7 +286,7 @@ func TestPersistence(t *testing.T) {
 	time.Sleep(2 * time.Second)
 	stopTicketD(td)
 	// Restart and check that claimant 1 still has ticket and claimant2 exists
-	td = startTicketD(true)
+	td = startTicketD(snaps)
 	ok, err = td.HasTicket(claimant1Id, "test", ticket.Name)
 	r.NoError(err)
 	r.True(ok)
@@ -233,16 +301,149 @@ func TestPersistence(t *testing.T) {
 	r.Nil(ticket)
 }
 
+func TestTimestamps(t *testing.T) {
+	r := require.New(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	td := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, clock)
+	td.SetCheckMode(CheckPanic)
+	td.Start()
+	defer stopTicketD(td)
+	issuerId, err := td.OpenSession("issuer", "ANY", 5000)
+	r.NoError(err)
+	claimantId, err := td.OpenSession("claimant", "ANY", 5000)
+	r.NoError(err)
+	clock.Advance(time.Second)
+	r.NoError(td.IssueTicket(issuerId, "test", "foo", nil))
+	clock.Advance(time.Second)
+	ok, claimed, err := td.ClaimTicket(claimantId, "test")
+	r.NoError(err)
+	r.True(ok)
+	r.Equal(start.Add(2*time.Second), claimed.ClaimedAt)
+	ok, err = td.Lock(issuerId, "lock")
+	r.NoError(err)
+	r.True(ok)
+	clock.Advance(time.Second)
+	r.NoError(td.RefreshSession(claimantId))
+	// Claiming again, or reissuing, doesn't move the times along
+	ok, _, err = td.ClaimTicket(claimantId, "test")
+	r.NoError(err)
+	r.True(ok)
+	r.NoError(td.IssueTicket(issuerId, "test", "foo", []byte("new data")))
+
+	sess, err := td.GetSession(claimantId)
+	r.NoError(err)
+	r.Equal(start, sess.CreatedAt)
+	r.Equal(start.Add(3*time.Second), sess.LastRefreshedAt)
+	r.Equal(start.Add(8*time.Second), sess.ExpiresAt)
+	tk := td.GetResources()["test"].Tickets["foo"]
+	r.Equal(start.Add(time.Second), tk.CreatedAt)
+	r.Equal(start.Add(2*time.Second), tk.ClaimedAt)
+	r.True(tk.LockedAt.IsZero())
+	lock := td.GetResources()["lock"].Tickets["lock"]
+	r.Equal(start.Add(2*time.Second), lock.LockedAt)
+	r.NoError(td.ReleaseTicket(claimantId, "test", "foo"))
+	r.True(td.GetResources()["test"].Tickets["foo"].ClaimedAt.IsZero())
+
+	// Timestamps are replicated
+	follower := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, nil)
+	follower.Follow("leader")
+	follower.Start()
+	defer stopTicketD(follower)
+	sub := td.Subscribe()
+	r.NoError(follower.LoadReplicaState(sub.State))
+	sess, err = follower.GetSession(claimantId)
+	r.NoError(err)
+	r.Equal(start, sess.CreatedAt)
+	r.Equal(start.Add(8*time.Second), sess.ExpiresAt)
+	r.Equal(start.Add(2*time.Second), follower.GetResources()["lock"].Tickets["lock"].LockedAt)
+}
+
 func TestStartStop(t *testing.T) {
-	td := startTicketD(true)
+	td := startTicketD(t.TempDir())
 	time.Sleep(2 * time.Second)
 	stopTicketD(td)
 }
 
+func TestStopped(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	id, err := td.OpenSession("test", "ANY", 1000)
+	r.NoError(err)
+	stopTicketD(td)
+	stopTicketD(td) // Quitting twice is fine
+	// Calls after quit fail rather than hang
+	_, err = td.OpenSession("test", "ANY", 1000)
+	r.True(errors.Is(err, ErrStopped))
+	_, err = td.GetSession(id)
+	r.True(errors.Is(err, ErrStopped))
+	_, err = td.GetSessionsContext(context.Background())
+	r.True(errors.Is(err, ErrStopped))
+	r.Empty(td.GetResources())
+}
+
+func TestPanicIsolation(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("") // Checks invariants, and panics on violations
+	defer stopTicketD(td)
+	id, err := td.OpenSession("test", "ANY", 5000)
+	r.NoError(err)
+	ok, err := td.Lock(id, "lock")
+	r.NoError(err)
+	r.True(ok)
+	// A panic fails the call, and nothing else
+	err = td.send(context.Background(), func(sessions map[string]*Session, resources map[string]*Resource) {
+		panic("boom")
+	}, "panic for session %s", id)
+	r.ErrorIs(err, ErrInternal)
+	r.Contains(err.Error(), "panic for session "+id)
+	// So does a call that breaks an invariant
+	err = td.send(context.Background(), func(sessions map[string]*Session, resources map[string]*Resource) {
+		resources["lock"].Tickets["lock"].Claimant = &Session{Id: "stray"}
+	}, "break lock")
+	r.ErrorIs(err, ErrInternal)
+	_, err = td.GetSession(id)
+	r.ErrorIs(err, ErrInternal) // Still broken, so the check fails this call too
+	r.NoError(td.send(context.Background(), func(sessions map[string]*Session, resources map[string]*Resource) {
+		resources["lock"].Tickets["lock"].Claimant = nil
+	}, "fix lock"))
+	// State survives
+	sess, err := td.GetSession(id)
+	r.NoError(err)
+	r.Len(sess.Issuances, 1)
+	ok, err = td.Lock(id, "lock")
+	r.NoError(err)
+	r.True(ok)
+}
+
+func TestContext(t *testing.T) {
+	r := require.New(t)
+	// Nothing takes calls from a ticketd that was never started, so calls wait until their context is done
+	td := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := td.OpenSessionContext(ctx, "test", "ANY", 1000)
+	r.True(errors.Is(err, context.DeadlineExceeded))
+	_, err = td.HasTicketContext(ctx, "id", "test", "foo")
+	r.True(errors.Is(err, context.DeadlineExceeded))
+	// A cancelled context fails straight away
+	td = startTicketD("")
+	defer stopTicketD(td)
+	ctx, cancel = context.WithCancel(context.Background())
+	id, err := td.OpenSessionContext(ctx, "test", "ANY", 1000)
+	r.NoError(err)
+	ok, err := td.LockContext(ctx, id, "lock")
+	r.NoError(err)
+	r.True(ok)
+	cancel()
+	_, err = td.LockContext(ctx, id, "lock")
+	r.True(errors.Is(err, context.Canceled))
+}
+
 func TestSnapshot(t *testing.T) {
-	os.RemoveAll("./snaps")
 	r := require.New(t)
-	td := startTicketD(true)
+	snaps := t.TempDir()
+	td := startTicketD(snaps)
 	stopped := false
 	defer func() {
 		if !stopped {
@@ -275,7 +476,7 @@ func TestSnapshot(t *testing.T) {
 	resources := td.GetResources()
 	time.Sleep(1 * time.Second) // Give us time to snapshot
 	stopTicketD(td)
-	td = startTicketD(true)
+	td = startTicketD(snaps)
 	lsess := td.GetSessions()
 	lres := td.GetResources()
 	r.NotNil(lsess)
@@ -289,7 +490,7 @@ func TestSnapshot(t *testing.T) {
 	}
 	tickets := resources["test"].Tickets
 	for k, v := range tickets {
-		ok, msgs := compareTicket(v, tickets[k])
+		ok, msgs := compareTicket(v, lres["test"].Tickets[k])
 		if !ok {
 			t.Logf("%#v", msgs)
 			r.True(ok)
@@ -321,6 +522,9 @@ func compareSession(l *Session, r *Session) (ok bool, msgs []string) {
 	if l.Ttl != r.Ttl {
 		msgs = append(msgs, "Ttlss do not match")
 	}
+	if !l.CreatedAt.Equal(r.CreatedAt) || !l.LastRefreshedAt.Equal(r.LastRefreshedAt) {
+		msgs = append(msgs, "Timestamps do not match")
+	}
 	if len(l.Tickets) != len(r.Tickets) {
 		msgs = append(msgs, "Claimed ticket arr lengths  do not match")
 		return
@@ -357,6 +561,9 @@ func compareTicket(l *Ticket, r *Ticket) (ok bool, msgs []string) {
 	if !bytes.Equal(l.Data, r.Data) {
 		msgs = append(msgs, "Data do not match")
 	}
+	if !l.CreatedAt.Equal(r.CreatedAt) || !l.ClaimedAt.Equal(r.ClaimedAt) || !l.LockedAt.Equal(r.LockedAt) {
+		msgs = append(msgs, "Timestamps do not match")
+	}
 	sessok, _ := compareSession(l.Claimant, r.Claimant)
 	if !sessok {
 		msgs = append(msgs, "Claimants  do not match")
@@ -422,12 +629,10 @@ func stopTicketD(td *TicketD) {
 	td.Quit()
 }
 
-func startTicketD(snap bool) *TicketD {
-	snapPath := ""
-	if snap {
-		snapPath = "./snaps"
-	}
-	td := NewTicketD(500, snapPath, 500, &DefaultLogger{*logLevel})
+// Start a ticketd, snapshotting to snapPath unless it is empty
+func startTicketD(snapPath string) *TicketD {
+	td := NewTicketD(500, snapPath, 500, &DefaultLogger{*logLevel}, nil)
+	td.SetCheckMode(CheckPanic)
 	td.Start()
 	return td
 }
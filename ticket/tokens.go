@@ -0,0 +1,73 @@
+package ticket
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// Session ownership
+//
+// Session ids are not secret -- they show up in dumps -- so every session also gets a secret token, handed out once
+// when the session is opened (Result.Token). Commands on a session that carry a token must carry the right one. The
+// api server refuses session calls without a token, so only the client that opened a session can use it. Calls made
+// in-process without a token (the embedding program's own calls) are trusted. Sessions opened before tokens existed
+// have none, and take any token.
+//
+// Separately, RevokeIssuerOnly stops sessions from revoking (or syncing away) tickets other sessions issued.
+
+// Who may revoke a ticket
+type RevokePolicy int
+
+const (
+	RevokeAny        RevokePolicy = iota // Any session may revoke any ticket
+	RevokeIssuerOnly                     // Only the session that issued a ticket may revoke it
+)
+
+type sessionTokenKeyType struct{}
+
+var sessionTokenKey sessionTokenKeyType
+
+// Get a context for calls that present a session token
+func WithSessionToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, sessionTokenKey, token)
+}
+
+// Get the session token a context carries. Empty if there is none
+func ContextSessionToken(ctx context.Context) string {
+	token, _ := ctx.Value(sessionTokenKey).(string)
+	return token
+}
+
+// Set who may revoke tickets. The policy is stamped on each revoke as it is submitted, so followers and replays
+// apply the leader's policy. Call before Start
+func (td *TicketD) SetRevokePolicy(p RevokePolicy) {
+	td.revokePolicy = p
+}
+
+// Generate a session token
+func newSessionToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("unable to generate a session token: %s", err.Error()))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Check the token a command presents against its session's token
+func checkSessionToken(sess *Session, cmd *Command) error {
+	if cmd.Token == "" || sess.Token == "" || subtle.ConstantTimeCompare([]byte(cmd.Token), []byte(sess.Token)) == 1 {
+		return nil
+	}
+	return fmt.Errorf("wrong token for session %s (%w)", sess.Id, ErrForbidden)
+}
+
+// Check that a session may revoke a ticket under the command's revoke policy
+func checkRevoke(sess *Session, t *Ticket, cmd *Command) error {
+	if !cmd.IssuerOnly || t.Issuer == nil || t.Issuer == sess {
+		return nil
+	}
+	return fmt.Errorf("ticket %s/%s was issued by another session (%w)", t.ResourceName, t.Name, ErrForbidden)
+}
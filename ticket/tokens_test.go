@@ -0,0 +1,61 @@
+package ticket
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSessionTokens(t *testing.T) {
+	r := require.New(t)
+	td := startTicketD("")
+	defer stopTicketD(td)
+	cli := NewLocalClient(td)
+	sess1, err := cli.OpenSession("session-1", 5000)
+	r.NoError(err)
+	r.NotEmpty(sess1.Token)
+	sess2, err := cli.OpenSession("session-2", 5000)
+	r.NoError(err)
+	r.NotEqual(sess1.Token, sess2.Token)
+	r.NoError(sess1.IssueTicket("tokens", "t1", nil))
+
+	// Someone else's token
+	ctx := WithSessionToken(context.Background(), sess2.Token)
+	r.True(errors.Is(td.IssueTicketContext(ctx, sess1.Id, "tokens", "t2", nil), ErrForbidden))
+	_, err = td.LockContext(ctx, sess1.Id, "tokens-lock")
+	r.True(errors.Is(err, ErrForbidden))
+	_, err = td.HasTicketContext(ctx, sess1.Id, "tokens", "t1")
+	r.True(errors.Is(err, ErrForbidden))
+	r.True(errors.Is(td.CloseSessionContext(ctx, sess1.Id), ErrForbidden))
+	// No token at all is the embedding program, which is trusted
+	r.NoError(td.RefreshSession(sess1.Id))
+
+	// Tokens survive replication, and are never dumped
+	state := exportState(0, map[string]*Session{sess1.Id: {Id: sess1.Id, Token: sess1.Token}}, nil, newRequestCache())
+	r.Equal(sess1.Token, state.Sessions[0].Token)
+	sessions := td.GetSessions()
+	r.Equal(sess1.Token, sessions[sess1.Id].Token)
+}
+
+func TestRevokeIssuerOnly(t *testing.T) {
+	r := require.New(t)
+	td := NewTicketD(500, "", 0, &DefaultLogger{*logLevel}, nil)
+	td.SetCheckMode(CheckPanic)
+	td.SetRevokePolicy(RevokeIssuerOnly)
+	td.Start()
+	defer stopTicketD(td)
+	cli := NewLocalClient(td)
+	issuer, err := cli.OpenSession("issuer", 5000)
+	r.NoError(err)
+	other, err := cli.OpenSession("other", 5000)
+	r.NoError(err)
+	r.NoError(issuer.IssueTicket("revoke", "t1", nil))
+	r.True(errors.Is(other.RevokeTicket("revoke", "t1"), ErrForbidden))
+	_, err = other.SyncTickets("revoke", map[string][]byte{})
+	r.True(errors.Is(err, ErrForbidden))
+	_, err = other.SyncTickets("revoke", map[string][]byte{"t1": nil})
+	r.True(errors.Is(err, ErrForbidden))
+	r.NotNil(td.GetResources()["revoke"].Tickets["t1"])
+	r.NoError(issuer.RevokeTicket("revoke", "t1"))
+}
@@ -0,0 +1,99 @@
+package tickettest
+
+import (
+	"context"
+	"github.com/turbosquid/ticketd/ticket"
+	"testing"
+)
+
+// Fail the test now unless session id is live. Returns a copy of the session
+func RequireSession(t testing.TB, td *ticket.TicketD, id string) (sess *ticket.Session) {
+	t.Helper()
+	sess, err := td.GetSession(id)
+	if err != nil {
+		t.Fatalf("session %s: %s", id, err.Error())
+	}
+	return
+}
+
+// Fail the test now if session id is live
+func RequireNoSession(t testing.TB, td *ticket.TicketD, id string) {
+	t.Helper()
+	if _, err := td.GetSession(id); err == nil {
+		t.Fatalf("session %s is live", id)
+	}
+}
+
+// Fail the test now unless the ticket is issued. Returns a copy of the ticket
+func RequireTicket(t testing.TB, td *ticket.TicketD, resource, name string) (tick *ticket.Ticket) {
+	t.Helper()
+	if tick = getTicket(t, td, resource, name); tick == nil {
+		t.Fatalf("no ticket %s on resource %s", name, resource)
+	}
+	return
+}
+
+// Fail the test now if the ticket is issued
+func RequireNoTicket(t testing.TB, td *ticket.TicketD, resource, name string) {
+	t.Helper()
+	if tick := getTicket(t, td, resource, name); tick != nil {
+		t.Fatalf("ticket %s is issued on resource %s", name, resource)
+	}
+}
+
+// Fail the test now unless the ticket is claimed by session sessId. An empty sessId requires an unclaimed ticket
+func RequireClaimedBy(t testing.TB, td *ticket.TicketD, resource, name, sessId string) {
+	t.Helper()
+	tick := RequireTicket(t, td, resource, name)
+	if claimant := sessionId(tick.Claimant); claimant != sessId {
+		t.Fatalf("ticket %s on resource %s is claimed by %q, not %q", name, resource, claimant, sessId)
+	}
+}
+
+// Fail the test now unless lock resource is held by session sessId. An empty sessId requires an unlocked resource
+func RequireLockedBy(t testing.TB, td *ticket.TicketD, resource, sessId string) {
+	t.Helper()
+	holder := ""
+	if tick := getTicket(t, td, resource, resource); tick != nil {
+		holder = sessionId(tick.Issuer)
+	}
+	if holder != sessId {
+		t.Fatalf("lock %s is held by %q, not %q", resource, holder, sessId)
+	}
+}
+
+// Fail the test now unless resource has exactly n tickets issued
+func RequireTicketCount(t testing.TB, td *ticket.TicketD, resource string, n int) {
+	t.Helper()
+	count := 0
+	if r := getResource(t, td, resource); r != nil {
+		count = len(r.Tickets)
+	}
+	if count != n {
+		t.Fatalf("resource %s has %d tickets, not %d", resource, count, n)
+	}
+}
+
+func getResource(t testing.TB, td *ticket.TicketD, resource string) *ticket.Resource {
+	t.Helper()
+	resources, err := td.GetResourcesContext(context.Background())
+	if err != nil {
+		t.Fatalf("resources: %s", err.Error())
+	}
+	return resources[resource]
+}
+
+func getTicket(t testing.TB, td *ticket.TicketD, resource, name string) *ticket.Ticket {
+	t.Helper()
+	if r := getResource(t, td, resource); r != nil {
+		return r.Tickets[name]
+	}
+	return nil
+}
+
+func sessionId(sess *ticket.Session) string {
+	if sess == nil {
+		return ""
+	}
+	return sess.Id
+}
@@ -0,0 +1,17 @@
+package tickettest
+
+import (
+	"github.com/turbosquid/ticketd/ticket"
+	"time"
+)
+
+// A ticket.Clock that only moves when told to. Tickers fire as Advance moves the clock past their next tick
+type Clock = ticket.ManualClock
+
+// Create a clock set to start. A zero start gets a fixed date, so runs are repeatable
+func NewClock(start time.Time) (c *Clock) {
+	if start.IsZero() {
+		start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return ticket.NewManualClock(start)
+}
@@ -0,0 +1,68 @@
+// Package tickettest helps test code that uses ticketd. It runs a ticketd and its api server in process, on a fake
+// clock, so session expiry can be tested without waiting for it
+package tickettest
+
+import (
+	"context"
+	tdhttp "github.com/turbosquid/ticketd/http"
+	"github.com/turbosquid/ticketd/ticket"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// How often the test ticketd would run its expire loop, in fake clock time
+const ExpireTickMs = 100
+
+// LogLevel for test servers
+var LogLevel = 1
+
+// An in-process ticketd and api server, on a fake clock
+type Server struct {
+	TD    *ticket.TicketD
+	Clock *Clock
+	URL   string // Base url of the api server
+	svr   *http.Server
+}
+
+// Start a ticketd with a fake clock, and an api server on an ephemeral localhost port. The server is stopped when
+// the test ends
+func NewServer(t testing.TB) (s *Server) {
+	t.Helper()
+	s = &Server{Clock: NewClock(time.Time{})}
+	s.TD = ticket.NewTicketD(ExpireTickMs, "", 0, &ticket.DefaultLogger{Level: LogLevel}, s.Clock)
+	s.TD.Start()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.TD.Quit()
+		t.Fatalf("tickettest: unable to listen: %s", err.Error())
+	}
+	s.URL = "http://" + ln.Addr().String()
+	s.svr = tdhttp.StartServerListener(ln, s.TD, nil)
+	t.Cleanup(s.Close)
+	return
+}
+
+// A http client for the server
+func (s *Server) Client() *tdhttp.Client {
+	return tdhttp.NewClient(s.URL, 5*time.Second)
+}
+
+// A client that calls the ticketd directly
+func (s *Server) LocalClient() *ticket.LocalClient {
+	return ticket.NewLocalClient(s.TD)
+}
+
+// Move the clock forward by d, and expire whatever is due. Sessions that outlive their ttl are gone when Advance
+// returns
+func (s *Server) Advance(d time.Duration) {
+	s.Clock.Advance(d)
+	s.TD.Expire()
+}
+
+// Stop the api server and ticketd. Safe to call more than once
+func (s *Server) Close() {
+	s.svr.Shutdown(context.Background())
+	s.TD.Quit()
+}
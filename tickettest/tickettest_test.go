@@ -0,0 +1,41 @@
+package tickettest
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	r := require.New(t)
+	s := NewServer(t)
+	cli := s.Client()
+	issuer, err := cli.OpenSession("issuer", 10000)
+	r.NoError(err)
+	claimant, err := cli.OpenSession("claimant", 500)
+	r.NoError(err)
+	r.NoError(issuer.IssueTicket("jobs", "job-1", nil))
+	ok, _, err := claimant.ClaimTicket("jobs")
+	r.NoError(err)
+	r.True(ok)
+	ok, err = claimant.Lock("lock")
+	r.NoError(err)
+	r.True(ok)
+	RequireClaimedBy(t, s.TD, "jobs", "job-1", claimant.Id)
+	RequireLockedBy(t, s.TD, "lock", claimant.Id)
+	// Refreshes keep the session alive however much time passes
+	for i := 0; i < 5; i++ {
+		s.Advance(400 * time.Millisecond)
+		RequireSession(t, s.TD, claimant.Id)
+		r.NoError(claimant.Refresh())
+	}
+	s.Advance(600 * time.Millisecond)
+	RequireNoSession(t, s.TD, claimant.Id)
+	RequireClaimedBy(t, s.TD, "jobs", "job-1", "")
+	RequireLockedBy(t, s.TD, "lock", "")
+	RequireTicketCount(t, s.TD, "jobs", 1)
+	// Issued tickets go with their issuer
+	s.Advance(10 * time.Second)
+	RequireNoSession(t, s.TD, issuer.Id)
+	RequireNoTicket(t, s.TD, "jobs", "job-1")
+}